@@ -0,0 +1,138 @@
+package global
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, dir string, pipelines string) string {
+	text := `
+addr: 127.0.0.1:3306
+user: root
+pass: 123456
+charset: utf8
+slave_id: 1001
+data_dir: ` + dir + `
+target: redis
+redis_addrs: 127.0.0.1:6379
+enable_ddl: true
+skip_no_pk_table: true
+transaction_mode: true
+enable_spool: true
+rule:
+  - schema: eseap
+    table: t_user
+pipelines:
+` + pipelines
+	file := filepath.Join(dir, "app.yml")
+	if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPipelineInherit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := writeTestConfig(t, dir, `
+  - name: inherited
+    slave_id: 1002
+    target: redis
+    redis_addrs: 127.0.0.1:6379
+    rule:
+      - schema: eseap
+        table: t_order
+  - name: overridden
+    slave_id: 1003
+    target: redis
+    redis_addrs: 127.0.0.1:6379
+    rule:
+      - schema: eseap
+        table: t_order
+    enable_ddl: false
+    schema_history: true
+    transaction_mode: false
+`)
+	if err := initConfig(file); err != nil {
+		t.Fatal(err)
+	}
+
+	inherited, _ := PipelineCfg("inherited")
+	if !inherited.EnableDDL || !inherited.SkipNoPkTable || inherited.SchemaHistory {
+		t.Errorf("pipeline inherited unexpected switches %v %v %v", inherited.EnableDDL, inherited.SkipNoPkTable, inherited.SchemaHistory)
+	}
+	if !inherited.TransactionMode || !inherited.EnableSpool {
+		t.Errorf("pipeline inherited unexpected transaction_mode %v enable_spool %v", inherited.TransactionMode, inherited.EnableSpool)
+	}
+	overridden, _ := PipelineCfg("overridden")
+	if overridden.EnableDDL || !overridden.SkipNoPkTable || !overridden.SchemaHistory {
+		t.Errorf("pipeline overridden unexpected switches %v %v %v", overridden.EnableDDL, overridden.SkipNoPkTable, overridden.SchemaHistory)
+	}
+	if overridden.TransactionMode || !overridden.EnableSpool {
+		t.Errorf("pipeline overridden unexpected transaction_mode %v enable_spool %v", overridden.TransactionMode, overridden.EnableSpool)
+	}
+
+	// 默认管道可以用default访问
+	if c, ok := PipelineCfg("default"); !ok || !c.IsDefaultPipeline() || c.PipelineName() != "default" {
+		t.Error("default pipeline not found")
+	}
+
+	file = writeTestConfig(t, dir, `
+  - name: default
+    slave_id: 1002
+    target: redis
+    redis_addrs: 127.0.0.1:6379
+    rule:
+      - schema: eseap
+        table: t_order
+`)
+	if err := initConfig(file); err == nil {
+		t.Error("expect error for reserved pipeline name")
+	}
+}
+
+func TestKafkaExactlyOnceConfig(t *testing.T) {
+	c := &Config{KafkaAddr: "127.0.0.1:9092", KafkaDelivery: KafkaDeliveryExactlyOnce, ConsumeWorkers: 2}
+	if err := checkKafkaConfig(c); err == nil {
+		t.Error("expect error for consume_workers with exactly_once")
+	}
+
+	c = &Config{Name: "order", KafkaAddr: "127.0.0.1:9092", KafkaDelivery: KafkaDeliveryExactlyOnce, ConsumeWorkers: 1}
+	if err := checkKafkaConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.KafkaTransactionalId != "go-mysql-transfer-order" || c.KafkaPositionTopic != _kafkaPositionTopic {
+		t.Errorf("unexpected defaults %s %s", c.KafkaTransactionalId, c.KafkaPositionTopic)
+	}
+}
+
+func TestRetryJitterConfig(t *testing.T) {
+	// 未配置时使用默认值，显式配置为0时不抖动
+	c := &Config{}
+	if err := checkRetryConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if *c.Retry.Jitter != _retryJitter {
+		t.Errorf("expect default jitter %v, got %v", _retryJitter, *c.Retry.Jitter)
+	}
+
+	jitter := 0.0
+	c = &Config{Retry: &Retry{Jitter: &jitter}}
+	if err := checkRetryConfig(c); err != nil {
+		t.Fatal(err)
+	}
+	if *c.Retry.Jitter != 0 {
+		t.Errorf("expect jitter 0 kept, got %v", *c.Retry.Jitter)
+	}
+
+	jitter = 1.5
+	if err := checkRetryConfig(&Config{Retry: &Retry{Jitter: &jitter}}); err == nil {
+		t.Error("expect error for jitter out of range")
+	}
+}
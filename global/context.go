@@ -80,8 +80,13 @@ func Initialize(configPath string) error {
 
 	log.Println(fmt.Sprintf("process id: %d", _pid))
 	log.Println(fmt.Sprintf("GOMAXPROCS :%d", _config.Maxprocs))
-	log.Println(fmt.Sprintf("source  %s(%s)", _config.Flavor, _config.Addr))
-	log.Println(fmt.Sprintf("destination %s", _config.Destination()))
+	for _, p := range _pipelines {
+		if !p.IsDefaultPipeline() {
+			log.Println(fmt.Sprintf("pipeline %s", p.Name))
+		}
+		log.Println(fmt.Sprintf("source  %s(%s)", p.Flavor, p.Addr))
+		log.Println(fmt.Sprintf("destination %s", p.Destination()))
+	}
 
 	return nil
 }
@@ -32,6 +32,7 @@ import (
 
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/util/dates"
+	"go-mysql-transfer/util/exprs"
 	"go-mysql-transfer/util/files"
 	"go-mysql-transfer/util/stringutil"
 )
@@ -43,14 +44,29 @@ const (
 	RedisStructureSet       = "Set"
 	RedisStructureSortedSet = "SortedSet"
 
+	RabbitmqExchangeDirect = "direct"
+	RabbitmqExchangeTopic  = "topic"
+	RabbitmqExchangeFanout = "fanout"
+
 	ValEncoderJson     = "json"
 	ValEncoderKVCommas = "kv-commas"
 	ValEncoderVCommas  = "v-commas"
+	ValEncoderAvro     = "avro"     // Avro二进制，schema注册到schema registry
+	ValEncoderProtobuf = "protobuf" // Protobuf二进制，schema注册到schema registry
+
+	MessageFormatNative   = "native"
+	MessageFormatDebezium = "debezium" // Debezium的变更事件格式
+	MessageFormatCanal    = "canal"    // Canal的FlatMessage格式
+
+	FilterIdentAction = "action" // 过滤表达式中的事件类型
+	FilterPrefixOld   = "old."   // 过滤表达式中update之前的值
+	FilterPrefixNew   = "new."
 )
 
 var (
-	_ruleInsMap       = make(map[string]*Rule)
-	_lockOfRuleInsMap sync.RWMutex
+	_ruleInsMap        = make(map[string]*Rule)
+	_retiredRuleInsMap = make(map[string]*Rule) // 表被删除或重命名后移除的规则，落后目标的追赶流程仍然需要
+	_lockOfRuleInsMap  sync.RWMutex
 )
 
 type EsMapping struct {
@@ -82,6 +98,18 @@ type Rule struct {
 
 	ReserveRawData bool `yaml:"reserve_raw_data"` // 保留update之前的数据，针对KAFKA、RABBITMQ、ROCKETMQ有效
 
+	// 消息格式，针对KAFKA、RABBITMQ、ROCKETMQ有效；支持native(默认)、debezium、canal
+	MessageFormat string `yaml:"message_format"`
+
+	// 行过滤表达式，不满足条件的行不同步，如：status != 'deleted' AND tenant_id IN (3,5)
+	// 可以使用old.列名获取update之前的值，action获取事件类型(insert、update、delete)
+	Filter string `yaml:"filter"`
+
+	ColumnTransforms []*ColumnTransform `yaml:"column_transforms"` // 列值转换，如：哈希、掩码、截断、类型转换、固定值
+
+	ChangedColumnsOnly bool   `yaml:"changed_columns_only"` // update只发送变化的列和主键，不支持redis
+	WatchColumnConfig  string `yaml:"watch_columns"`        // 关注的列，多值逗号分隔；update时这些列都没有变化则不同步
+
 	// ------------------- REDIS -----------------
 	//对应redis的5种数据类型 String、Hash(字典) 、List(列表) 、Set(集合)、Sorted Set(有序集合)
 	RedisStructure string `yaml:"redis_structure"`
@@ -111,10 +139,24 @@ type Rule struct {
 	MongodbCollection string `yaml:"mongodb_collection"` //mongodb collection，可以为空，默认使用表(Table)名称
 
 	// ------------------- RABBITMQ -----------------
-	RabbitmqQueue string `yaml:"rabbitmq_queue"` //queue名称,可以为空，默认使用表(Table)名称
+	RabbitmqQueue        string `yaml:"rabbitmq_queue"`         //queue名称,可以为空，未配置rabbitmq_exchange时默认使用表(Table)名称
+	RabbitmqExchange     string `yaml:"rabbitmq_exchange"`      //exchange名称,可以为空，为空时发送到默认exchange，routing key为queue名称
+	RabbitmqExchangeType string `yaml:"rabbitmq_exchange_type"` //exchange类型，支持direct、topic、fanout，默认direct
+	// routing key,支持模板如{{.tenant_id}}.user；可以为空，默认使用表(Table)名称
+	RabbitmqRoutingKey string `yaml:"rabbitmq_routing_key"`
+	// rabbitmq_queue绑定到exchange的binding key,可以为空，默认与routing key相同；routing key为模板时topic类型默认为#
+	RabbitmqBindingKey     string `yaml:"rabbitmq_binding_key"`
+	RabbitmqRoutingKeyTmpl *template.Template
 
 	// ------------------- KAFKA -----------------
 	KafkaTopic string `yaml:"kafka_topic"` //TOPIC名称,可以为空，默认使用表(Table)名称
+	// 使用哪个列的值作为消息的key，不填写默认使用主键；相同key的消息发送到同一个分区
+	KafkaKeyColumn string `yaml:"kafka_key_column"`
+	// 格式化定义key,如{{.tenant_id}}-{{.id}}；优先于kafka_key_column
+	KafkaKeyFormatter   string `yaml:"kafka_key_formatter"`
+	KafkaPartition      *int32 `yaml:"kafka_partition"` // 固定发送到的分区，不填写按照key的哈希值选择分区
+	KafkaKeyColumnIndex int
+	KafkaKeyTmpl        *template.Template
 
 	// ------------------- ES -----------------
 	ElsIndex   string       `yaml:"es_index"`    //Elasticsearch Index,可以为空，默认使用表(Table)名称
@@ -122,6 +164,7 @@ type Rule struct {
 	EsMappings []*EsMapping `yaml:"es_mappings"` //Elasticsearch mappings映射关系,可以为空，为空时根据数据类型自己推导
 
 	// --------------- no config ----------------
+	Pipeline              string // 所属管道名称，默认管道为空
 	TableInfo             *schema.Table
 	TableColumnSize       int
 	IsCompositeKey        bool //是否联合主键
@@ -130,6 +173,9 @@ type Rule struct {
 	LuaProto              *lua.FunctionProto
 	LuaFunction           *lua.LFunction
 	ValueTmpl             *template.Template
+	FilterExpr            *exprs.Expr `msgpack:"-"`
+	WatchColumnIndexs     []int
+	ColumnTransformMap    map[int]*ColumnTransform `msgpack:"-"` // 列序号 -> 列值转换，表结构变更后重新生成
 }
 
 func RuleDeepClone(res *Rule) (*Rule, error) {
@@ -156,6 +202,28 @@ func AddRuleIns(ruleKey string, r *Rule) {
 	defer _lockOfRuleInsMap.Unlock()
 
 	_ruleInsMap[ruleKey] = r
+	delete(_retiredRuleInsMap, ruleKey)
+}
+
+// RemoveRuleIns 表被删除或重命名后移除规则，移除的规则保留给落后目标的追赶流程
+func RemoveRuleIns(ruleKey string) {
+	_lockOfRuleInsMap.Lock()
+	defer _lockOfRuleInsMap.Unlock()
+
+	if r, ok := _ruleInsMap[ruleKey]; ok {
+		_retiredRuleInsMap[ruleKey] = r
+	}
+	delete(_ruleInsMap, ruleKey)
+}
+
+// RetiredRuleIns 已经移除的规则
+func RetiredRuleIns(ruleKey string) (*Rule, bool) {
+	_lockOfRuleInsMap.RLock()
+	defer _lockOfRuleInsMap.RUnlock()
+
+	r, ok := _retiredRuleInsMap[ruleKey]
+
+	return r, ok
 }
 
 func RuleIns(ruleKey string) (*Rule, bool) {
@@ -195,6 +263,42 @@ func RuleInsList() []*Rule {
 	return list
 }
 
+// PipelineRuleInsList 管道内的规则
+func PipelineRuleInsList(pipeline string) []*Rule {
+	_lockOfRuleInsMap.RLock()
+	defer _lockOfRuleInsMap.RUnlock()
+
+	list := make([]*Rule, 0, len(_ruleInsMap))
+	for _, rule := range _ruleInsMap {
+		if rule.Pipeline == pipeline {
+			list = append(list, rule)
+		}
+	}
+
+	return list
+}
+
+// PipelineRuleInsSnapshot 管道内的规则，包括已经移除的规则；
+// 落后目标的追赶流程从自己的位点重放，表在到达删除或重命名的DDL之前仍然需要同步
+func PipelineRuleInsSnapshot(pipeline string) map[string]*Rule {
+	_lockOfRuleInsMap.RLock()
+	defer _lockOfRuleInsMap.RUnlock()
+
+	snapshot := make(map[string]*Rule, len(_ruleInsMap)+len(_retiredRuleInsMap))
+	for k, rule := range _retiredRuleInsMap {
+		if rule.Pipeline == pipeline {
+			snapshot[k] = rule
+		}
+	}
+	for k, rule := range _ruleInsMap {
+		if rule.Pipeline == pipeline {
+			snapshot[k] = rule
+		}
+	}
+
+	return snapshot
+}
+
 func RuleKeyList() []string {
 	_lockOfRuleInsMap.RLock()
 	defer _lockOfRuleInsMap.RUnlock()
@@ -207,15 +311,54 @@ func RuleKeyList() []string {
 	return list
 }
 
+// 规则所属管道的配置
+func (s *Rule) config() *Config {
+	if c, ok := PipelineCfg(s.Pipeline); ok {
+		return c
+	}
+	return _config
+}
+
 func (s *Rule) Initialize() error {
+	for _, t := range s.ColumnTransforms {
+		if err := t.initialize(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.buildColumnTransforms(); err != nil {
+		return err
+	}
+
 	if err := s.buildPaddingMap(); err != nil {
 		return err
 	}
 
+	if err := s.buildWatchColumns(); err != nil {
+		return err
+	}
+
 	if s.ValueEncoder == "" {
 		s.ValueEncoder = ValEncoderJson
 	}
 
+	switch s.MessageFormat {
+	case "":
+		s.MessageFormat = MessageFormatNative
+	case MessageFormatNative, MessageFormatDebezium, MessageFormatCanal:
+	default:
+		return errors.Errorf("unsupported message_format %s", s.MessageFormat)
+	}
+
+	if s.ValueEncoder == ValEncoderAvro || s.ValueEncoder == ValEncoderProtobuf {
+		if s.MessageFormat != MessageFormatNative {
+			return errors.Errorf("value_encoder %s only supports native message_format", s.ValueEncoder)
+		}
+		if s.config().SchemaRegistryUrl == "" {
+			return errors.Errorf("empty schema_registry_url not allowed when value_encoder is %s", s.ValueEncoder)
+		}
+	}
+
 	if s.ValueFormatter != "" {
 		tmpl, err := template.New(s.TableInfo.Name).Parse(s.ValueFormatter)
 		if err != nil {
@@ -243,49 +386,60 @@ func (s *Rule) Initialize() error {
 		s.DateFormatter = dates.ConvertGoFormat(s.DateFormatter)
 	}
 
+	if s.Filter != "" {
+		if err := s.initFilter(); err != nil {
+			return err
+		}
+	}
+
 	if s.DatetimeFormatter != "" {
 		s.DatetimeFormatter = dates.ConvertGoFormat(s.DatetimeFormatter)
 	}
 
-	if _config.IsRedis() {
-		if err := s.initRedisConfig(); err != nil {
-			return err
+	for _, c := range s.config().TargetCfgs() {
+		if c.IsRedis() {
+			if s.ChangedColumnsOnly {
+				return errors.New("changed_columns_only not supported by redis")
+			}
+			if err := s.initRedisConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsRocketmq() {
-		if err := s.initRocketConfig(); err != nil {
-			return err
+		if c.IsRocketmq() {
+			if err := s.initRocketConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsMongodb() {
-		if err := s.initMongoConfig(); err != nil {
-			return err
+		if c.IsMongodb() {
+			if err := s.initMongoConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsRabbitmq() {
-		if err := s.initRabbitmqConfig(); err != nil {
-			return err
+		if c.IsRabbitmq() {
+			if err := s.initRabbitmqConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsKafka() {
-		if err := s.initKafkaConfig(); err != nil {
-			return err
+		if c.IsKafka() {
+			if err := s.initKafkaConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsEls() {
-		if err := s.initElsConfig(); err != nil {
-			return err
+		if c.IsEls() {
+			if err := s.initElsConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsScript() {
-		if s.LuaScript == "" && s.LuaFilePath == "" {
-			return errors.New("empty lua script not allowed")
+		if c.IsScript() {
+			if s.LuaScript == "" && s.LuaFilePath == "" {
+				return errors.New("empty lua script not allowed")
+			}
 		}
 	}
 
@@ -293,49 +447,69 @@ func (s *Rule) Initialize() error {
 }
 
 func (s *Rule) AfterUpdateTableInfo() error {
+	if err := s.buildColumnTransforms(); err != nil {
+		return err
+	}
+
 	if err := s.buildPaddingMap(); err != nil {
 		return err
 	}
 
-	if _config.IsRedis() {
-		if err := s.initRedisConfig(); err != nil {
-			return err
-		}
+	if err := s.buildWatchColumns(); err != nil {
+		return err
 	}
 
-	if _config.IsRocketmq() {
-		if err := s.initRocketConfig(); err != nil {
+	// 表结构变更后重新检查过滤表达式中的列，列被删除时报错
+	if s.Filter != "" {
+		if err := s.initFilter(); err != nil {
 			return err
 		}
 	}
 
-	if _config.IsMongodb() {
-		if err := s.initMongoConfig(); err != nil {
-			return err
+	for _, c := range s.config().TargetCfgs() {
+		if c.IsRedis() {
+			if s.ChangedColumnsOnly {
+				return errors.New("changed_columns_only not supported by redis")
+			}
+			if err := s.initRedisConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsRabbitmq() {
-		if err := s.initRabbitmqConfig(); err != nil {
-			return err
+		if c.IsRocketmq() {
+			if err := s.initRocketConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsKafka() {
-		if err := s.initKafkaConfig(); err != nil {
-			return err
+		if c.IsMongodb() {
+			if err := s.initMongoConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsEls() {
-		if err := s.initElsConfig(); err != nil {
-			return err
+		if c.IsRabbitmq() {
+			if err := s.initRabbitmqConfig(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if _config.IsScript() {
-		if s.LuaScript == "" || s.LuaFilePath == "" {
-			return errors.New("empty lua script not allowed")
+		if c.IsKafka() {
+			if err := s.initKafkaConfig(); err != nil {
+				return err
+			}
+		}
+
+		if c.IsEls() {
+			if err := s.initElsConfig(); err != nil {
+				return err
+			}
+		}
+
+		if c.IsScript() {
+			if s.LuaScript == "" || s.LuaFilePath == "" {
+				return errors.New("empty lua script not allowed")
+			}
 		}
 	}
 
@@ -406,6 +580,48 @@ func (s *Rule) buildPaddingMap() error {
 	return nil
 }
 
+// buildWatchColumns 表结构变化后列的位置可能变化，需要重新计算
+// buildColumnTransforms 按照当前的表结构绑定列值转换，配置的列不存在时报错
+func (s *Rule) buildColumnTransforms() error {
+	transforms := make(map[int]*ColumnTransform, len(s.ColumnTransforms))
+	for _, t := range s.ColumnTransforms {
+		_, index := s.TableColumn(t.Column)
+		if index < 0 {
+			return errors.Errorf("column_transforms of %s.%s: column %s not found", s.Schema, s.Table, t.Column)
+		}
+		transforms[index] = t
+	}
+	s.ColumnTransformMap = transforms
+	return nil
+}
+
+func (s *Rule) buildWatchColumns() error {
+	if s.WatchColumnConfig == "" {
+		return nil
+	}
+
+	var indexs []int
+	for _, c := range strings.Split(s.WatchColumnConfig, ",") {
+		_, index := s.TableColumn(strings.TrimSpace(c))
+		if index < 0 {
+			return errors.New("watch_columns must be table column")
+		}
+		indexs = append(indexs, index)
+	}
+	s.WatchColumnIndexs = indexs
+	return nil
+}
+
+// IsPKColumn 是否主键列
+func (s *Rule) IsPKColumn(index int) bool {
+	for _, pk := range s.TableInfo.PKColumns {
+		if pk == index {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Rule) newPadding(mappings map[string]string, columnName string) *model.Padding {
 	column, index := s.TableColumn(columnName)
 
@@ -415,7 +631,7 @@ func (s *Rule) newPadding(mappings map[string]string, columnName string) *model.
 		wrapName = mapped
 	}
 
-	return &model.Padding{
+	padding := &model.Padding{
 		WrapName: wrapName,
 
 		ColumnIndex:    index,
@@ -423,6 +639,10 @@ func (s *Rule) newPadding(mappings map[string]string, columnName string) *model.
 		ColumnType:     column.Type,
 		ColumnMetadata: column,
 	}
+	if t, ok := s.ColumnTransformMap[index]; ok {
+		padding.Transform = t.Apply
+	}
+	return padding
 }
 
 func (s *Rule) TableColumn(field string) (*schema.TableColumn, int) {
@@ -455,6 +675,41 @@ func (s *Rule) LuaEnable() bool {
 	return true
 }
 
+func (s *Rule) initFilter() error {
+	expr, err := exprs.Compile(s.Filter)
+	if err != nil {
+		return errors.Annotatef(err, "filter of %s.%s", s.Schema, s.Table)
+	}
+	for _, ident := range expr.Idents() {
+		if ident == FilterIdentAction {
+			continue
+		}
+		if _, index := s.FilterColumn(ident); index < 0 {
+			return errors.Errorf("filter of %s.%s: column %s not found", s.Schema, s.Table, ident)
+		}
+	}
+	s.FilterExpr = expr
+	return nil
+}
+
+// FilterColumn 过滤表达式中的标识符对应的列，old.前缀表示update之前的值，new.前缀与列名相同；列不存在时返回-1
+func (s *Rule) FilterColumn(ident string) (bool, int) {
+	old := false
+	name := ident
+	if strings.HasPrefix(ident, FilterPrefixOld) {
+		old = true
+		name = ident[len(FilterPrefixOld):]
+	} else if strings.HasPrefix(ident, FilterPrefixNew) {
+		name = ident[len(FilterPrefixNew):]
+	}
+	for i, c := range s.TableInfo.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return old, i
+		}
+	}
+	return old, -1
+}
+
 func (s *Rule) initRedisConfig() error {
 	if s.LuaEnable() {
 		return nil
@@ -572,9 +827,48 @@ func (s *Rule) initMongoConfig() error {
 }
 
 func (s *Rule) initRabbitmqConfig() error {
-	if !s.LuaEnable() {
-		if s.RabbitmqQueue == "" {
-			s.RabbitmqQueue = s.Table
+	if s.RabbitmqExchange == "" {
+		if s.RabbitmqExchangeType != "" || s.RabbitmqRoutingKey != "" || s.RabbitmqBindingKey != "" {
+			return errors.New("rabbitmq_exchange required when rabbitmq_exchange_type, rabbitmq_routing_key or rabbitmq_binding_key is set")
+		}
+		if !s.LuaEnable() {
+			if s.RabbitmqQueue == "" {
+				s.RabbitmqQueue = s.Table
+			}
+		}
+		return nil
+	}
+
+	s.RabbitmqExchangeType = strings.ToLower(s.RabbitmqExchangeType)
+	switch s.RabbitmqExchangeType {
+	case "":
+		s.RabbitmqExchangeType = RabbitmqExchangeDirect
+	case RabbitmqExchangeDirect, RabbitmqExchangeTopic, RabbitmqExchangeFanout:
+	default:
+		return errors.Errorf("unsupported rabbitmq_exchange_type: %s", s.RabbitmqExchangeType)
+	}
+
+	if s.RabbitmqRoutingKey == "" {
+		s.RabbitmqRoutingKey = s.Table
+	}
+	s.RabbitmqRoutingKeyTmpl = nil
+	if strings.Contains(s.RabbitmqRoutingKey, "{{") {
+		tmpl, err := template.New(s.TableInfo.Name).Parse(s.RabbitmqRoutingKey)
+		if err != nil {
+			return err
+		}
+		s.RabbitmqRoutingKeyTmpl = tmpl
+	}
+
+	if s.RabbitmqQueue != "" && s.RabbitmqBindingKey == "" {
+		switch {
+		case s.RabbitmqExchangeType == RabbitmqExchangeFanout:
+		case s.RabbitmqRoutingKeyTmpl == nil:
+			s.RabbitmqBindingKey = s.RabbitmqRoutingKey
+		case s.RabbitmqExchangeType == RabbitmqExchangeTopic:
+			s.RabbitmqBindingKey = "#"
+		default:
+			return errors.New("rabbitmq_binding_key required when rabbitmq_routing_key is template")
 		}
 	}
 
@@ -614,6 +908,27 @@ func (s *Rule) initKafkaConfig() error {
 		}
 	}
 
+	s.KafkaKeyColumnIndex = -1
+	if s.KafkaKeyColumn != "" {
+		_, index := s.TableColumn(s.KafkaKeyColumn)
+		if index < 0 {
+			return errors.New("kafka_key_column must be table column")
+		}
+		s.KafkaKeyColumnIndex = index
+	}
+
+	if s.KafkaKeyFormatter != "" {
+		tmpl, err := template.New(s.TableInfo.Name).Parse(s.KafkaKeyFormatter)
+		if err != nil {
+			return err
+		}
+		s.KafkaKeyTmpl = tmpl
+	}
+
+	if s.KafkaPartition != nil && *s.KafkaPartition < 0 {
+		return errors.New("kafka_partition must not be negative")
+	}
+
 	return nil
 }
 
@@ -640,7 +955,11 @@ func (s *Rule) CompileLuaScript(dataDir string) error {
 
 	s.LuaScript = script
 
-	if _config.IsRedis() {
+	if s.config().IsComposite() {
+		return errors.New("lua script not allowed in multiple targets")
+	}
+
+	if s.config().IsRedis() {
 		if !strings.Contains(script, `require("redisOps")`) {
 			return errors.New("lua script incorrect format")
 		}
@@ -660,7 +979,7 @@ func (s *Rule) CompileLuaScript(dataDir string) error {
 		}
 	}
 
-	if _config.IsRocketmq() {
+	if s.config().IsRocketmq() {
 		if !strings.Contains(script, `require("mqOps")`) {
 			return errors.New("lua script incorrect format")
 		}
@@ -670,7 +989,7 @@ func (s *Rule) CompileLuaScript(dataDir string) error {
 		}
 	}
 
-	if _config.IsEls() {
+	if s.config().IsEls() {
 		if !strings.Contains(script, `require("esOps")`) {
 			return errors.New("lua script incorrect format")
 		}
@@ -0,0 +1,85 @@
+package global
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// newTestTableRule 指定列的规则，管道没有目标，只检查与表结构有关的配置
+func newTestTableRule(t *testing.T, columns ...string) *Rule {
+	_pipelines = append(_pipelines, &Config{Name: "rule_test"})
+	t.Cleanup(func() { _pipelines = _pipelines[:len(_pipelines)-1] })
+
+	rule := &Rule{Schema: "eseap", Table: "t_user", Pipeline: "rule_test"}
+	setTestTable(rule, columns...)
+	return rule
+}
+
+func setTestTable(rule *Rule, columns ...string) {
+	table := &schema.Table{Schema: rule.Schema, Name: rule.Table, PKColumns: []int{0}}
+	for _, c := range columns {
+		table.AddColumn(c, "varchar(20)", "", "")
+	}
+	rule.TableInfo = table
+	rule.TableColumnSize = len(columns)
+}
+
+func TestAfterUpdateTableInfoFilter(t *testing.T) {
+	rule := newTestTableRule(t, "id", "status")
+	rule.Filter = "status = 'active'"
+	if err := rule.AfterUpdateTableInfo(); err != nil {
+		t.Fatal(err)
+	}
+	first := rule.FilterExpr
+
+	// 新增列后重新编译，过滤列的位置按照新的表结构
+	setTestTable(rule, "id", "name", "status")
+	if err := rule.AfterUpdateTableInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.FilterExpr == first {
+		t.Fatal("filter should be recompiled after table changed")
+	}
+	if _, index := rule.FilterColumn("status"); index != 2 {
+		t.Fatalf("expect status at 2, got %d", index)
+	}
+
+	// 过滤列被删除时报错
+	setTestTable(rule, "id", "name")
+	if err := rule.AfterUpdateTableInfo(); err == nil {
+		t.Fatal("expect error when filter column dropped")
+	}
+}
+
+func TestAfterUpdateTableInfoTransforms(t *testing.T) {
+	rule := newTestTableRule(t, "id", "phone")
+	rule.ColumnTransforms = []*ColumnTransform{{Column: "phone", Type: TransformMask, Mask: MaskPhone}}
+	if err := rule.ColumnTransforms[0].initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rule.AfterUpdateTableInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.ColumnTransformMap[1] == nil || rule.PaddingMap["phone"].Transform == nil {
+		t.Fatal("expect phone transform bound at 1")
+	}
+
+	// 在前面新增列后，转换按照列名重新绑定到新的位置
+	setTestTable(rule, "id", "name", "phone")
+	if err := rule.AfterUpdateTableInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if rule.ColumnTransformMap[1] != nil || rule.ColumnTransformMap[2] == nil {
+		t.Fatalf("expect phone transform moved to 2, got %v", rule.ColumnTransformMap)
+	}
+	if rule.PaddingMap["name"].Transform != nil || rule.PaddingMap["phone"].Transform == nil {
+		t.Fatal("expect only phone transformed")
+	}
+
+	// 配置的列被删除时报错
+	setTestTable(rule, "id", "name")
+	if err := rule.AfterUpdateTableInfo(); err == nil {
+		t.Fatal("expect error when transform column dropped")
+	}
+}
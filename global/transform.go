@@ -0,0 +1,165 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package global
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/util/stringutil"
+)
+
+const (
+	TransformHash     = "hash"     // 哈希
+	TransformMask     = "mask"     // 部分掩码
+	TransformTruncate = "truncate" // 截断
+	TransformCast     = "cast"     // 类型转换
+	TransformConst    = "const"    // 固定值
+
+	HashSha256 = "sha256"
+	HashMd5    = "md5"
+
+	MaskPhone  = "phone"   // 手机号，保留前3位后4位
+	MaskIdCard = "id_card" // 身份证号，保留前6位后4位
+
+	CastString = "string"
+	CastNumber = "number"
+
+	_maskChar = "*"
+)
+
+// ColumnTransform 列值转换，在发送到接收端之前处理，如：手机号掩码、身份证号哈希
+type ColumnTransform struct {
+	Column     string `yaml:"column"`      // 数据库列名称
+	Type       string `yaml:"type"`        // 转换类型，支持hash、mask、truncate、cast、const
+	Algorithm  string `yaml:"algorithm"`   // hash算法，支持sha256、md5，默认sha256
+	Salt       string `yaml:"salt"`        // hash的盐值
+	Mask       string `yaml:"mask"`        // 掩码预设，支持phone、id_card；也可以使用keep_prefix、keep_suffix自定义
+	KeepPrefix int    `yaml:"keep_prefix"` // 掩码保留的前缀字符数
+	KeepSuffix int    `yaml:"keep_suffix"` // 掩码保留的后缀字符数
+	Length     int    `yaml:"length"`      // 截断后的最大字符数
+	To         string `yaml:"to"`          // 转换的类型，支持string、number
+	Value      string `yaml:"value"`       // 固定值
+}
+
+func (s *ColumnTransform) initialize() error {
+	switch s.Type {
+	case TransformHash:
+		if s.Algorithm == "" {
+			s.Algorithm = HashSha256
+		}
+		if s.Algorithm != HashSha256 && s.Algorithm != HashMd5 {
+			return errors.Errorf("column_transforms: unsupported hash algorithm %s", s.Algorithm)
+		}
+	case TransformMask:
+		switch s.Mask {
+		case MaskPhone:
+			s.KeepPrefix, s.KeepSuffix = 3, 4
+		case MaskIdCard:
+			s.KeepPrefix, s.KeepSuffix = 6, 4
+		case "":
+			if s.KeepPrefix < 0 || s.KeepSuffix < 0 {
+				return errors.Errorf("column_transforms: keep_prefix and keep_suffix must not be negative")
+			}
+		default:
+			return errors.Errorf("column_transforms: unsupported mask %s", s.Mask)
+		}
+	case TransformTruncate:
+		if s.Length <= 0 {
+			return errors.Errorf("column_transforms: truncate length must be greater than 0")
+		}
+	case TransformCast:
+		if s.To != CastString && s.To != CastNumber {
+			return errors.Errorf("column_transforms: unsupported cast type %s", s.To)
+		}
+	case TransformConst:
+	default:
+		return errors.Errorf("column_transforms: unsupported type %s", s.Type)
+	}
+	return nil
+}
+
+// Apply 转换列值，null只有const转换
+func (s *ColumnTransform) Apply(value interface{}) interface{} {
+	if s.Type == TransformConst {
+		return s.Value
+	}
+	if value == nil {
+		return nil
+	}
+
+	switch s.Type {
+	case TransformHash:
+		plain := s.Salt + stringutil.ToString(value)
+		if s.Algorithm == HashMd5 {
+			sum := md5.Sum([]byte(plain))
+			return hex.EncodeToString(sum[:])
+		}
+		sum := sha256.Sum256([]byte(plain))
+		return hex.EncodeToString(sum[:])
+	case TransformMask:
+		return maskString(stringutil.ToString(value), s.KeepPrefix, s.KeepSuffix)
+	case TransformTruncate:
+		runes := []rune(stringutil.ToString(value))
+		if len(runes) > s.Length {
+			return string(runes[:s.Length])
+		}
+		return string(runes)
+	case TransformCast:
+		if s.To == CastString {
+			return stringutil.ToString(value)
+		}
+		return castNumber(value)
+	}
+	return value
+}
+
+// maskString 长度不足时全部掩码
+func maskString(str string, prefix, suffix int) string {
+	runes := []rune(str)
+	if len(runes) <= prefix+suffix {
+		return strings.Repeat(_maskChar, len(runes))
+	}
+	return string(runes[:prefix]) + strings.Repeat(_maskChar, len(runes)-prefix-suffix) + string(runes[len(runes)-suffix:])
+}
+
+// castNumber 整数转为int64，小数转为float64，无法转换时为null
+func castNumber(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	str := strings.TrimSpace(stringutil.ToString(value))
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(str, 64); err == nil {
+		return f
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package global
+
+import (
+	"testing"
+)
+
+func TestColumnTransform(t *testing.T) {
+	cases := []struct {
+		transform *ColumnTransform
+		value     interface{}
+		expect    interface{}
+	}{
+		{&ColumnTransform{Type: TransformMask, Mask: MaskPhone}, "13812345678", "138****5678"},
+		{&ColumnTransform{Type: TransformMask, Mask: MaskIdCard}, "340104199001011234", "340104********1234"},
+		{&ColumnTransform{Type: TransformMask, KeepPrefix: 1}, "王小明", "王**"},
+		{&ColumnTransform{Type: TransformMask, KeepPrefix: 3, KeepSuffix: 4}, "1234", "****"},
+		{&ColumnTransform{Type: TransformHash, Algorithm: HashMd5}, "abc", "900150983cd24fb0d6963f7d28e17f72"},
+		{&ColumnTransform{Type: TransformHash, Salt: "a"}, "bc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{&ColumnTransform{Type: TransformTruncate, Length: 2}, "合肥市", "合肥"},
+		{&ColumnTransform{Type: TransformCast, To: CastString}, int64(12), "12"},
+		{&ColumnTransform{Type: TransformCast, To: CastNumber}, "12", int64(12)},
+		{&ColumnTransform{Type: TransformCast, To: CastNumber}, "1.5", 1.5},
+		{&ColumnTransform{Type: TransformCast, To: CastNumber}, "abc", nil},
+		{&ColumnTransform{Type: TransformConst, Value: "***"}, nil, "***"},
+		{&ColumnTransform{Type: TransformHash}, nil, nil},
+	}
+
+	for i, c := range cases {
+		if err := c.transform.initialize(); err != nil {
+			t.Fatalf("case %d initialize err %s", i, err.Error())
+		}
+		if got := c.transform.Apply(c.value); got != c.expect {
+			t.Fatalf("case %d expect %v, got %v", i, c.expect, got)
+		}
+	}
+
+	for _, invalid := range []*ColumnTransform{
+		{Type: "encrypt"},
+		{Type: TransformHash, Algorithm: "sha1"},
+		{Type: TransformMask, Mask: "email"},
+		{Type: TransformTruncate},
+		{Type: TransformCast, To: "date"},
+	} {
+		if err := invalid.initialize(); err == nil {
+			t.Fatalf("%+v expect initialize error", invalid)
+		}
+	}
+}
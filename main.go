@@ -18,12 +18,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
 	"syscall"
 
 	"github.com/juju/errors"
@@ -38,11 +40,13 @@ import (
 )
 
 var (
-	helpFlag     bool
-	cfgPath      string
-	stockFlag    bool
-	positionFlag bool
-	statusFlag   bool
+	helpFlag       bool
+	cfgPath        string
+	stockFlag      bool
+	positionFlag   bool
+	statusFlag     bool
+	deadLetterFlag bool
+	pipelineName   string
 )
 
 func init() {
@@ -51,6 +55,8 @@ func init() {
 	flag.BoolVar(&stockFlag, "stock", false, "stock data import")
 	flag.BoolVar(&positionFlag, "position", false, "set dump position")
 	flag.BoolVar(&statusFlag, "status", false, "display application status")
+	flag.BoolVar(&deadLetterFlag, "deadletter", false, "dead letter admin: list [offset] [limit] | show <id> | replay <id...|all>")
+	flag.StringVar(&pipelineName, "pipeline", "", "pipeline name for stock and position, default pipeline if empty")
 	flag.Usage = usage
 }
 
@@ -118,6 +124,11 @@ func main() {
 		return
 	}
 
+	if deadLetterFlag {
+		doDeadLetter()
+		return
+	}
+
 	err = service.Initialize()
 	if err != nil {
 		println(errors.ErrorStack(err))
@@ -146,7 +157,12 @@ func main() {
 }
 
 func doStock() {
-	stock := service.NewStockService()
+	cfg, ok := global.PipelineCfg(pipelineName)
+	if !ok {
+		println(fmt.Sprintf("error: pipeline '%s' not found", pipelineName))
+		return
+	}
+	stock := service.NewStockService(cfg)
 	if err := stock.Run(); err != nil {
 		println(errors.ErrorStack(err))
 	}
@@ -154,9 +170,23 @@ func doStock() {
 }
 
 func doStatus() {
-	ps := storage.NewPositionStorage()
-	pos, _ := ps.Get()
-	fmt.Printf("The current dump position is : %s %d \n", pos.Name, pos.Pos)
+	for _, cfg := range global.PipelineCfgs() {
+		if !cfg.IsDefaultPipeline() {
+			fmt.Printf("Pipeline %s \n", cfg.Name)
+		}
+		ps := storage.NewPositionStorage(cfg.PositionKey())
+		pos, _ := ps.Get()
+		fmt.Printf("The current dump position is : %s %d \n", pos.Name, pos.Pos)
+		if gtid, _ := ps.GetGTID(); gtid != "" {
+			fmt.Printf("The current dump GTID set is : %s \n", gtid)
+		}
+		if cfg.IsComposite() {
+			for _, t := range cfg.TargetCfgs() {
+				tp, _ := storage.NewPositionStorage(cfg.TargetPositionKey(t.Target)).Get()
+				fmt.Printf("The position of target %s is : %s %d \n", t.Target, tp.Name, tp.Pos)
+			}
+		}
+	}
 }
 
 func doPosition() {
@@ -179,7 +209,16 @@ func doPosition() {
 		println("error: The parameter Position must be number")
 		return
 	}
-	ps := storage.NewPositionStorage()
+	cfg, ok := global.PipelineCfg(pipelineName)
+	if !ok {
+		println(fmt.Sprintf("error: pipeline '%s' not found", pipelineName))
+		return
+	}
+	ps := storage.NewPositionStorage(cfg.PositionKey())
+	if err := ps.Initialize(); err != nil {
+		println(errors.ErrorStack(err))
+		return
+	}
 	pos := mysql.Position{
 		Name: f,
 		Pos:  pp,
@@ -188,6 +227,94 @@ func doPosition() {
 	fmt.Printf("The current dump position is : %s %d \n", f, pp)
 }
 
+func doDeadLetter() {
+	others := flag.Args()
+	if len(others) == 0 {
+		println("error: please input the command: list, show or replay")
+		return
+	}
+	cfg, ok := global.PipelineCfg(pipelineName)
+	if !ok {
+		println(fmt.Sprintf("error: pipeline '%s' not found", pipelineName))
+		return
+	}
+	dls, err := service.NewDeadLetterService(cfg)
+	if err != nil {
+		println(errors.ErrorStack(err))
+		return
+	}
+	defer dls.Close()
+
+	switch others[0] {
+	case "list":
+		offset, limit := 0, 20
+		if len(others) > 1 {
+			if offset, err = strconv.Atoi(others[1]); err != nil {
+				println("error: The parameter offset must be number")
+				return
+			}
+		}
+		if len(others) > 2 {
+			if limit, err = strconv.Atoi(others[2]); err != nil {
+				println("error: The parameter limit must be number")
+				return
+			}
+		}
+		ls, err := dls.List(offset, limit)
+		if err != nil {
+			println(errors.ErrorStack(err))
+			return
+		}
+		for _, l := range ls {
+			fmt.Printf("%d  %s  %s  %s %d  %s \n", l.Id, l.RuleKey, l.Action, l.PosName, l.Pos, l.Error)
+		}
+	case "show":
+		if len(others) != 2 {
+			println("error: please input the dead letter id")
+			return
+		}
+		id, err := strconv.ParseUint(others[1], 10, 64)
+		if err != nil {
+			println("error: The parameter id must be number")
+			return
+		}
+		l, err := dls.Get(id)
+		if err != nil {
+			println(errors.ErrorStack(err))
+			return
+		}
+		if l == nil {
+			println(fmt.Sprintf("error: dead letter %d not found", id))
+			return
+		}
+		data, _ := json.MarshalIndent(l, "", "  ")
+		fmt.Println(string(data))
+	case "replay":
+		if len(others) < 2 {
+			println("error: please input the dead letter ids or all")
+			return
+		}
+		var ids []uint64
+		if others[1] != "all" {
+			for _, v := range others[1:] {
+				id, err := strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					println("error: The parameter id must be number")
+					return
+				}
+				ids = append(ids, id)
+			}
+		}
+		n, err := dls.Replay(ids)
+		fmt.Printf("%d dead letters replayed \n", n)
+		if err != nil {
+			println(errors.ErrorStack(err))
+		}
+	default:
+		println(fmt.Sprintf("error: unknown command '%s'", others[0]))
+	}
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, `version: 1.0.0
 Usage: transfer [-c filename] [-s stock]
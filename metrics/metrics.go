@@ -20,6 +20,7 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -40,7 +41,7 @@ const (
 
 var (
 	leaderState  atomic.Bool
-	destState    atomic.Bool
+	destState    sync.Map // pipeline -> bool
 	delay        atomic.Uint32
 	insertRecord map[string]*atomic.Uint64
 	updateRecord map[string]*atomic.Uint64
@@ -55,11 +56,11 @@ var (
 		},
 	)
 
-	destStateGauge = promauto.NewGauge(
+	destStateGauge = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "transfer_destination_state",
 			Help: "The destination running state: 0=stopped, 1=ok",
-		},
+		}, []string{"pipeline"},
 	)
 
 	delayGauge = promauto.NewGauge(
@@ -89,6 +90,27 @@ var (
 			Help: "The number of data deleted from destination",
 		}, []string{"table"},
 	)
+
+	queueRowsGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "transfer_queue_rows",
+			Help: "The number of rows waiting in the event queue",
+		}, []string{"pipeline"},
+	)
+
+	queueBytesGauge = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "transfer_queue_bytes",
+			Help: "The estimated bytes of rows waiting in the event queue",
+		}, []string{"pipeline"},
+	)
+
+	deadLetterCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transfer_dead_letter_num",
+			Help: "The number of data written to dead letter",
+		}, []string{"table"},
+	)
 )
 
 func Initialize() error {
@@ -120,17 +142,19 @@ func SetLeaderState(state int) {
 	}
 }
 
-func SetDestState(state int) {
+// SetDestState 每个管道单独的接收端状态
+func SetDestState(pipeline string, state int) {
 	if global.Cfg().EnableExporter {
-		destStateGauge.Set(float64(state))
+		destStateGauge.WithLabelValues(pipeline).Set(float64(state))
 	}
 	if global.Cfg().EnableWebAdmin {
-		destState.Store(DestStateOK == state)
+		destState.Store(pipeline, DestStateOK == state)
 	}
 }
 
-func DestState() bool {
-	return destState.Load()
+func DestState(pipeline string) bool {
+	v, ok := destState.Load(pipeline)
+	return ok && v.(bool)
 }
 
 func SetTransferDelay(d uint32) {
@@ -171,6 +195,19 @@ func UpdateActionNum(action, lab string) {
 	}
 }
 
+func UpdateDeadLetterNum(lab string) {
+	if global.Cfg().EnableExporter {
+		deadLetterCounter.WithLabelValues(lab).Inc()
+	}
+}
+
+func SetQueueDepth(pipeline string, rows, bytes int64) {
+	if global.Cfg().EnableExporter {
+		queueRowsGauge.WithLabelValues(pipeline).Set(float64(rows))
+		queueBytesGauge.WithLabelValues(pipeline).Set(float64(bytes))
+	}
+}
+
 func InsertAmount() uint64 {
 	var amount uint64
 	for _, v := range insertRecord {
@@ -0,0 +1,32 @@
+package model
+
+const (
+	DDLAction = "ddl" // DDL消息的action
+
+	DDLCreate   = "create"
+	DDLAlter    = "alter"
+	DDLDrop     = "drop"
+	DDLRename   = "rename"
+	DDLTruncate = "truncate"
+)
+
+// DDLRequest 表结构变更
+type DDLRequest struct {
+	Action       string   `json:"action"` // 固定为ddl，与行数据的消息区分
+	Type         string   `json:"type"`   // create、alter、drop、rename、truncate
+	Schema       string   `json:"schema"`
+	Table        string   `json:"table"`
+	NewSchema    string   `json:"new_schema,omitempty"`    // rename之后的库名
+	NewTable     string   `json:"new_table,omitempty"`     // rename之后的表名
+	AddedColumns []string `json:"added_columns,omitempty"` // alter新增的列
+	Query        string   `json:"query"`
+	PosName      string   `json:"pos_name"` // DDL之后的binlog位点
+	Pos          uint32   `json:"pos"`
+	Timestamp    uint32   `json:"-"` // binlog事件的时间，秒
+	RuleKey      string   `json:"-"`
+}
+
+// Retire 删除或重命名表之后原表名对应的规则不再有效
+func (s *DDLRequest) Retire() bool {
+	return s.Type == DDLDrop || s.Type == DDLRename
+}
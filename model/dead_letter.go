@@ -0,0 +1,28 @@
+package model
+
+// DeadLetter 处理失败的行
+type DeadLetter struct {
+	Id         uint64        `json:"id"`
+	Pipeline   string        `json:"pipeline,omitempty"`
+	RuleKey    string        `json:"rule_key"`
+	Action     string        `json:"action"`
+	Timestamp  uint32        `json:"timestamp"`
+	Row        []interface{} `json:"row"`
+	Old        []interface{} `json:"old,omitempty"`
+	Error      string        `json:"error"`
+	PosName    string        `json:"pos_name"` // 所在批次的起始binlog位点
+	Pos        uint32        `json:"pos"`
+	TxId       string        `json:"tx_id,omitempty"` // 事务模式下所在事务的ID，重放时同一事务的行一起处理
+	CreateTime int64         `json:"create_time"`
+}
+
+// RowRequest 还原为请求，用于重放
+func (s *DeadLetter) RowRequest() *RowRequest {
+	return &RowRequest{
+		RuleKey:   s.RuleKey,
+		Action:    s.Action,
+		Timestamp: s.Timestamp,
+		Old:       s.Old,
+		Row:       s.Row,
+	}
+}
@@ -9,4 +9,6 @@ type Padding struct {
 	ColumnIndex    int
 	ColumnType     int
 	ColumnMetadata *schema.TableColumn
+
+	Transform func(value interface{}) interface{} `msgpack:"-"` // 列值转换，没有配置时为nil
 }
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// ComparePosition 比较binlog位点；文件名按照后缀的序号比较，序号位数增加(mysql-bin.999999之后为mysql-bin.1000000)时仍然有序
+func ComparePosition(a, b mysql.Position) int {
+	if c := compareBinlogName(a.Name, b.Name); c != 0 {
+		return c
+	}
+	switch {
+	case a.Pos > b.Pos:
+		return 1
+	case a.Pos < b.Pos:
+		return -1
+	}
+	return 0
+}
+
+func compareBinlogName(a, b string) int {
+	na, okA := BinlogIndex(a)
+	nb, okB := BinlogIndex(b)
+	if !okA || !okB || a[:strings.LastIndexByte(a, '.')] != b[:strings.LastIndexByte(b, '.')] {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case na > nb:
+		return 1
+	case na < nb:
+		return -1
+	}
+	return 0
+}
+
+// BinlogIndex binlog文件名后缀的序号，如mysql-bin.000012为12
+func BinlogIndex(name string) (uint64, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(name[i+1:], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
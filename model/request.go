@@ -14,14 +14,43 @@ type RowRequest struct {
 	Timestamp uint32
 	Old       []interface{}
 	Row       []interface{}
+	Tx        *TxInfo // 事务信息，只在事务模式下有值
+	ServerId  uint32  // 产生binlog的MySQL server_id
+	PosName   string  // 行所在的binlog位点，全量导入的行为空
+	Pos       uint32
+	RowIndex  int // 行在binlog事件中的序号
+}
+
+// TxInfo 行所属的事务
+type TxInfo struct {
+	Id    string `json:"id"`    // 事务ID，开启GTID时为事务的GTID，否则为事务结束的binlog位点
+	Index int    `json:"index"` // 在事务中的序号，从0开始
+	Total int    `json:"total"` // 事务中的总行数
+	// 在事务中同一个表的行之间的序号，从0开始；Debezium格式的data_collection_order
+	TableIndex int `json:"-"`
 }
 
 type PosRequest struct {
 	Name  string
 	Pos   uint32
+	GTID  string // 位点对应的GTID集合，可以为空
 	Force bool
 }
 
+// TagTx 为同一个事务的行设置事务信息
+func TagTx(requests []*RowRequest, txId string) {
+	tables := make(map[string]int)
+	for i, r := range requests {
+		r.Tx = &TxInfo{
+			Id:         txId,
+			Index:      i,
+			Total:      len(requests),
+			TableIndex: tables[r.RuleKey],
+		}
+		tables[r.RuleKey]++
+	}
+}
+
 func BuildRowRequest() *RowRequest {
 	return RowRequestPool.Get().(*RowRequest)
 }
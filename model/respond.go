@@ -27,12 +27,15 @@ var redisRespondPool = sync.Pool{
 }
 
 type MQRespond struct {
-	Topic     string      `json:"-"`
-	Action    string      `json:"action"`
-	Timestamp uint32      `json:"timestamp"`
-	Raw       interface{} `json:"raw,omitempty"`
-	Date      interface{} `json:"date"`
-	ByteArray []byte      `json:"-"`
+	Topic     string            `json:"-"`
+	Action    string            `json:"action"`
+	Timestamp uint32            `json:"timestamp"`
+	Raw       interface{}       `json:"raw,omitempty"`
+	Date      interface{}       `json:"date"`
+	Tx        *TxInfo           `json:"tx,omitempty"`
+	ByteArray []byte            `json:"-"`
+	Key       string            `json:"-"` // 消息的key，lua脚本中通过SEND的第三个参数指定
+	Headers   map[string]string `json:"-"` // 自定义的消息头，lua脚本中通过SEND的第四个参数指定
 }
 
 type ESRespond struct {
@@ -0,0 +1,10 @@
+package model
+
+import "github.com/siddontang/go-mysql/schema"
+
+// SchemaVersion 表结构的一个版本，从binlog位点(PosName, Pos)之后生效
+type SchemaVersion struct {
+	PosName string        `json:"pos_name"`
+	Pos     uint32        `json:"pos"`
+	Table   *schema.Table `json:"table"`
+}
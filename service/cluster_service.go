@@ -49,10 +49,16 @@ func (s *ClusterService) startElectListener() {
 				global.SetLeaderFlag(selected)
 				if selected {
 					metrics.SetLeaderState(metrics.LeaderState)
-					_transferService.StartUp()
+					for _, s := range _transferServices {
+						if !s.disabled.Load() {
+							s.StartUp()
+						}
+					}
 				} else {
 					metrics.SetLeaderState(metrics.FollowerState)
-					_transferService.stopDump()
+					for _, s := range _transferServices {
+						s.stopDump()
+					}
 				}
 			}
 		}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/storage"
+	"go-mysql-transfer/util/logs"
+)
+
+// DeadLetterService 死信的查看与重放，需要在程序停止时使用
+type DeadLetterService struct {
+	cfg     *global.Config
+	storage storage.DeadLetterStorage
+}
+
+func NewDeadLetterService(cfg *global.Config) (*DeadLetterService, error) {
+	dls := storage.NewDeadLetterStorage(cfg)
+	if dls == nil {
+		return nil, errors.NotFoundf("dead_letter config")
+	}
+	if strings.ToUpper(cfg.DeadLetter.Type) == global.DeadLetterKafka {
+		return nil, errors.NotSupportedf("dead letter admin for kafka type, consume topic %s instead", cfg.DeadLetter.KafkaTopic)
+	}
+	if err := dls.Initialize(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &DeadLetterService{
+		cfg:     cfg,
+		storage: dls,
+	}, nil
+}
+
+func (s *DeadLetterService) List(offset, limit int) ([]*model.DeadLetter, error) {
+	return s.storage.List(offset, limit)
+}
+
+func (s *DeadLetterService) Get(id uint64) (*model.DeadLetter, error) {
+	return s.storage.Get(id)
+}
+
+// Replay 重新写入接收端，成功后删除；ids为空时重放全部
+func (s *DeadLetterService) Replay(ids []uint64) (int, error) {
+	var letters []*model.DeadLetter
+	if len(ids) == 0 {
+		ls, err := s.storage.List(0, int(^uint(0)>>1))
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		letters = ls
+	} else {
+		for _, id := range ids {
+			letter, err := s.storage.Get(id)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+			if letter == nil {
+				return 0, errors.NotFoundf("dead letter %d", id)
+			}
+			letters = append(letters, letter)
+		}
+	}
+	if len(letters) == 0 {
+		return 0, nil
+	}
+
+	// 借用存量服务准备规则与接收端
+	stock := NewStockService(s.cfg)
+	if err := stock.prepare(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer stock.Close()
+	defer stock.endpoint.Close()
+
+	var replayed int
+	for _, group := range groupDeadLetters(letters) {
+		requests := make([]*model.RowRequest, 0, len(group))
+		for _, letter := range group {
+			if _, ok := global.RuleIns(letter.RuleKey); !ok {
+				return replayed, errors.NotFoundf("rule %s", letter.RuleKey)
+			}
+			requests = append(requests, letter.RowRequest())
+		}
+		from := mysql.Position{Name: group[0].PosName, Pos: group[0].Pos}
+		if err := stock.endpoint.Consume(from, requests); err != nil {
+			return replayed, errors.Annotatef(err, "replay dead letter %d", group[0].Id)
+		}
+		for _, letter := range group {
+			if err := s.storage.Delete(letter.Id); err != nil {
+				return replayed, errors.Trace(err)
+			}
+			logs.Infof("dead letter %d replayed", letter.Id)
+			replayed++
+		}
+	}
+	return replayed, nil
+}
+
+// groupDeadLetters 同一事务的连续死信作为一组重放，其他死信逐条重放
+func groupDeadLetters(letters []*model.DeadLetter) [][]*model.DeadLetter {
+	var groups [][]*model.DeadLetter
+	for _, letter := range letters {
+		if n := len(groups); n > 0 && letter.TxId != "" {
+			last := groups[n-1]
+			if last[0].TxId == letter.TxId && last[0].Pipeline == letter.Pipeline {
+				groups[n-1] = append(last, letter)
+				continue
+			}
+		}
+		groups = append(groups, []*model.DeadLetter{letter})
+	}
+	return groups
+}
+
+func (s *DeadLetterService) Close() {
+	s.storage.Close()
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"testing"
+
+	"go-mysql-transfer/model"
+)
+
+func TestGroupDeadLetters(t *testing.T) {
+	letters := []*model.DeadLetter{
+		{Id: 1, TxId: "tx1"},
+		{Id: 2, TxId: "tx1"},
+		{Id: 3},
+		{Id: 4},
+		{Id: 5, TxId: "tx2"},
+		{Id: 6, TxId: "tx2", Pipeline: "p1"}, // 不同管道的事务不合并
+		{Id: 7, TxId: "tx2", Pipeline: "p1"},
+	}
+	groups := groupDeadLetters(letters)
+	expect := [][]uint64{{1, 2}, {3}, {4}, {5}, {6, 7}}
+	if len(groups) != len(expect) {
+		t.Fatalf("expect %d groups, got %d", len(expect), len(groups))
+	}
+	for i, group := range groups {
+		if len(group) != len(expect[i]) {
+			t.Fatalf("group %d: expect %v, got %d letters", i, expect[i], len(group))
+		}
+		for j, letter := range group {
+			if letter.Id != expect[i][j] {
+				t.Fatalf("group %d: expect %v, got id %d", i, expect[i], letter.Id)
+			}
+		}
+	}
+}
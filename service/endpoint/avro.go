@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"encoding/binary"
+	"math"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+var _avroNull = jsoniter.RawMessage("null")
+
+type avroRecord struct {
+	Type      string       `json:"type"`
+	Name      string       `json:"name"`
+	Namespace string       `json:"namespace,omitempty"`
+	Fields    []*avroField `json:"fields"`
+}
+
+type avroField struct {
+	Name    string              `json:"name"`
+	Type    interface{}         `json:"type"`
+	Default jsoniter.RawMessage `json:"default,omitempty"`
+}
+
+// avroSchema 字段与json格式的消息一致：action、timestamp、date、raw、tx；列均可以为null
+func avroSchema(rule *global.Rule, fields []*valueField) string {
+	value := &avroRecord{
+		Type:   "record",
+		Name:   "Value",
+		Fields: make([]*avroField, 0, len(fields)),
+	}
+	for _, f := range fields {
+		value.Fields = append(value.Fields, &avroField{
+			Name:    fieldName(f.name),
+			Type:    []interface{}{"null", avroType(f.kind)},
+			Default: _avroNull,
+		})
+	}
+
+	tx := &avroRecord{
+		Type: "record",
+		Name: "TxInfo",
+		Fields: []*avroField{
+			{Name: "id", Type: "string"},
+			{Name: "index", Type: "int"},
+			{Name: "total", Type: "int"},
+		},
+	}
+
+	root := &avroRecord{
+		Type:      "record",
+		Name:      fieldName(rule.Table),
+		Namespace: fieldName(rule.Schema),
+		Fields: []*avroField{
+			{Name: "action", Type: "string"},
+			{Name: "timestamp", Type: "long"},
+			{Name: "date", Type: value},
+			{Name: "raw", Type: []interface{}{"null", "Value"}, Default: _avroNull},
+			{Name: "tx", Type: []interface{}{"null", tx}, Default: _avroNull},
+		},
+	}
+
+	data, _ := json.Marshal(root)
+	return string(data)
+}
+
+func avroType(kind int) string {
+	switch kind {
+	case _fieldLong:
+		return "long"
+	case _fieldDouble:
+		return "double"
+	default:
+		return "string"
+	}
+}
+
+// encodeAvro 按照avroSchema的字段顺序进行二进制编码
+func encodeAvro(row *model.RowRequest, fields []*valueField, data, raw map[string]interface{}) []byte {
+	buf := make([]byte, 0, 64+16*len(fields))
+	buf = appendAvroString(buf, row.Action)
+	buf = appendAvroLong(buf, int64(row.Timestamp))
+	buf = appendAvroValue(buf, fields, data)
+
+	if raw == nil {
+		buf = appendAvroLong(buf, 0)
+	} else {
+		buf = appendAvroLong(buf, 1)
+		buf = appendAvroValue(buf, fields, raw)
+	}
+
+	if row.Tx == nil {
+		buf = appendAvroLong(buf, 0)
+	} else {
+		buf = appendAvroLong(buf, 1)
+		buf = appendAvroString(buf, row.Tx.Id)
+		buf = appendAvroLong(buf, int64(row.Tx.Index))
+		buf = appendAvroLong(buf, int64(row.Tx.Total))
+	}
+	return buf
+}
+
+// appendAvroValue 列为["null", T]的union，先写入分支的序号
+func appendAvroValue(buf []byte, fields []*valueField, kv map[string]interface{}) []byte {
+	for _, f := range fields {
+		v, ok := fieldValue(f, kv)
+		if !ok {
+			buf = appendAvroLong(buf, 0)
+			continue
+		}
+		buf = appendAvroLong(buf, 1)
+		switch v := v.(type) {
+		case int64:
+			buf = appendAvroLong(buf, v)
+		case float64:
+			buf = appendAvroDouble(buf, v)
+		case string:
+			buf = appendAvroString(buf, v)
+		}
+	}
+	return buf
+}
+
+// appendAvroLong zigzag编码的变长整数，int和long相同
+func appendAvroLong(buf []byte, v int64) []byte {
+	return appendVarint(buf, uint64((v<<1)^(v>>63)))
+}
+
+func appendAvroDouble(buf []byte, v float64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	return append(buf, b[:]...)
+}
+
+func appendAvroString(buf []byte, v string) []byte {
+	buf = appendAvroLong(buf, int64(len(v)))
+	return append(buf, v...)
+}
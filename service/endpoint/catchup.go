@@ -0,0 +1,260 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"go.uber.org/atomic"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+// 追赶使用的slave_id为: slave_id + (目标序号+1)*_catchupSlaveIdStep
+const _catchupSlaveIdStep = 1000
+
+// catchup 落后目标的追赶流程，使用独立的canal从目标自己的位点开始重放
+type catchup struct {
+	canal.DummyEventHandler
+
+	cfg    *global.Config
+	target *compositeTarget
+	canal  *canal.Canal
+	closed atomic.Bool
+
+	history   *SchemaHistory
+	ddl       *DDLParser
+	rules     map[string]*global.Rule // 追赶流程自己的规则，到达删除或重命名表的DDL时才移除
+	pos       mysql.Position          // 目标已经确认的位点，在target.lock内读写
+	from      mysql.Position
+	requests  []*model.RowRequest
+	lastFlush time.Time
+	txStart   int    // 事务模式下当前事务在requests中的起始下标
+	txGTID    string // 事务模式下当前事务的GTID
+}
+
+func newCatchup(cfg *global.Config, t *compositeTarget, from mysql.Position) (*catchup, error) {
+	canalCfg := canal.NewDefaultConfig()
+	canalCfg.Addr = cfg.Addr
+	canalCfg.User = cfg.User
+	canalCfg.Password = cfg.Password
+	canalCfg.Charset = cfg.Charset
+	canalCfg.Flavor = cfg.Flavor
+	canalCfg.ServerID = cfg.SlaveID + uint32((t.index+1)*_catchupSlaveIdStep)
+	canalCfg.Dump.ExecutionPath = ""
+	for _, rc := range cfg.RuleConfigs {
+		canalCfg.IncludeTableRegex = append(canalCfg.IncludeTableRegex, rc.Schema+"\\."+rc.Table)
+	}
+
+	history, err := SchemaHistoryOf(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ds, err := canal.NewCanal(canalCfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	c := &catchup{
+		cfg:       cfg,
+		target:    t,
+		canal:     ds,
+		history:   history,
+		ddl:       NewDDLParser(cfg),
+		rules:     global.PipelineRuleInsSnapshot(cfg.Name),
+		pos:       from,
+		from:      from,
+		requests:  make([]*model.RowRequest, 0, cfg.BulkSize),
+		lastFlush: time.Now(),
+	}
+	ds.SetEventHandler(c)
+	return c, nil
+}
+
+func (s *catchup) run() {
+	logs.Infof("target %s catch up from position(%s %d)", s.target.cfg.Target, s.from.Name, s.from.Pos)
+	go func() {
+		if err := s.canal.RunFrom(s.from); err != nil && !s.closed.Load() {
+			logs.Errorf("target %s catch up err %s", s.target.cfg.Target, errors.ErrorStack(err))
+		}
+
+		s.target.lock.Lock()
+		if s.target.catchup == s {
+			s.target.catchup = nil
+		}
+		s.target.lock.Unlock()
+		if !s.closed.Load() {
+			s.close()
+		}
+	}()
+}
+
+// close 在target.lock内调用
+func (s *catchup) close() {
+	s.closed.Store(true)
+	if s.canal != nil {
+		s.canal.Close()
+	}
+}
+
+// rule 表在追赶流程中生效的规则；追赶开始之后新加入的表使用主流程的规则
+func (s *catchup) rule(schema, table string) (*global.Rule, bool) {
+	ruleKey := s.cfg.RuleKey(schema, table)
+	if rule, ok := s.rules[ruleKey]; ok {
+		return rule, true
+	}
+	rule, ok := global.RuleIns(ruleKey)
+	if ok {
+		s.rules[ruleKey] = rule
+	}
+	return rule, ok
+}
+
+func (s *catchup) OnRow(e *canal.RowsEvent) error {
+	rule, ok := s.rule(e.Table.Schema, e.Table.Name)
+	if !ok {
+		return nil
+	}
+
+	pos := mysql.Position{Name: s.canal.SyncedPosition().Name, Pos: e.Header.LogPos}
+	if s.history != nil {
+		if err := s.history.decodeRule(rule, pos, e); err != nil {
+			logs.Errorf("decode %s.%s with schema history err %s", e.Table.Schema, e.Table.Name, errors.ErrorStack(err))
+		}
+	}
+	requests := newRuleRowRequests(s.cfg, rule, e, pos.Name)
+	if requests != nil {
+		s.requests = append(s.requests, requests...)
+	}
+	return nil
+}
+
+func (s *catchup) OnGTID(gtid mysql.GTIDSet) error {
+	s.txGTID = gtid.String()
+	return nil
+}
+
+func (s *catchup) OnXID(nextPos mysql.Position) error {
+	if s.cfg.TransactionMode && len(s.requests) > s.txStart {
+		txId := s.txGTID
+		if txId == "" {
+			txId = fmt.Sprintf("%s:%d", nextPos.Name, nextPos.Pos)
+		}
+		model.TagTx(s.requests[s.txStart:], txId)
+	}
+	s.txStart = len(s.requests)
+	s.txGTID = ""
+
+	force := time.Now().Sub(s.lastFlush) > time.Duration(s.cfg.FlushBulkInterval)*time.Millisecond
+	return s.flush(nextPos, force || int64(len(s.requests)) >= s.cfg.BulkSize)
+}
+
+func (s *catchup) OnRotate(e *replication.RotateEvent) error {
+	return s.flush(mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)}, true)
+}
+
+func (s *catchup) OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	ddls, err := s.ddl.Parse(nextPos, e)
+	if err != nil {
+		logs.Warnf("parse ddl err %s, query: %s", err.Error(), string(e.Query))
+	}
+	// 与主流程一致，没有开启DDL同步时只通知表的删除和重命名
+	timestamp := EventTimestamp(s.canal)
+	n := 0
+	for _, ddl := range ddls {
+		ddl.Timestamp = timestamp
+		if s.cfg.EnableDDL || ddl.Retire() {
+			ddls[n] = ddl
+			n++
+		}
+	}
+	ddls = ddls[:n]
+	if len(ddls) == 0 {
+		return s.flush(nextPos, true)
+	}
+
+	// DDL之前的数据先写入，再处理DDL，最后保存DDL之后的位点
+	if err := s.flush(s.pos, true); err != nil {
+		return err
+	}
+	if c, ok := s.target.endpoint.(DDLConsumer); ok {
+		s.target.lock.Lock()
+		for _, ddl := range ddls {
+			if err = c.ConsumeDDL(ddl); err != nil {
+				break
+			}
+		}
+		s.target.lock.Unlock()
+		if err != nil {
+			s.target.failures.Inc()
+			return errors.Trace(err)
+		}
+	}
+	s.retire(ddls)
+	return s.flush(nextPos, true)
+}
+
+// retire 追赶到表的删除或重命名之后移除规则，之后同名的表使用主流程的规则
+func (s *catchup) retire(ddls []*model.DDLRequest) {
+	for _, ddl := range ddls {
+		if ddl.Retire() {
+			delete(s.rules, ddl.RuleKey)
+		}
+	}
+}
+
+// flush 写入目标并保存目标的位点；没有待写入的数据时只在内存中推进位点
+func (s *catchup) flush(pos mysql.Position, force bool) error {
+	if !force && len(s.requests) > 0 {
+		return nil
+	}
+
+	s.target.lock.Lock()
+	defer s.target.lock.Unlock()
+
+	if s.closed.Load() {
+		return errors.New("catch up closed")
+	}
+
+	if len(s.requests) > 0 {
+		if err := s.target.endpoint.Consume(s.pos, s.requests); err != nil {
+			s.target.failures.Inc()
+			return errors.Trace(err)
+		}
+		s.requests = s.requests[0:0]
+		s.txStart = 0
+	}
+
+	s.pos = pos
+	if !force {
+		return nil
+	}
+	s.lastFlush = time.Now()
+	return s.target.position.Save(pos)
+}
+
+func (s *catchup) String() string {
+	return "CatchupHandler"
+}
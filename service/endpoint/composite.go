@@ -0,0 +1,445 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"go.uber.org/atomic"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/storage"
+	"go-mysql-transfer/util/logs"
+)
+
+// Checkpointer 每个目标单独保存位点
+type Checkpointer interface {
+	Restore(main mysql.Position) error   // 启动时根据主流程位点恢复每个目标的状态
+	Checkpoint(pos mysql.Position) error // 主流程保存位点之后回调
+}
+
+// CompositeEndpoint 多目标，同一批数据分发到每个目标。
+// 每个目标单独保存位点，失败的目标被摘除后从自己的位点追赶，追上主流程后重新加入，不影响其他目标
+type CompositeEndpoint struct {
+	cfg     *global.Config
+	targets []*compositeTarget
+	stop    chan struct{}
+
+	joinLock     sync.RWMutex   // 写入期间持有读锁，目标重新加入时持有写锁，等待进行中的批次完成
+	dispatchLock sync.Mutex     // 并行处理时保护dispatched
+	dispatched   mysql.Position // 已经分发的数据中最大的binlog位点，不健康的目标需要追赶过这个位点才能重新加入
+}
+
+type compositeTarget struct {
+	index     int
+	cfg       *global.Config
+	endpoint  Endpoint
+	position  storage.PositionStorage
+	retries   int          // 主流程中失败的重试次数，配置了retry时由子目标按照重试策略重试，此处为0
+	healthy   atomic.Bool  // 健康状态，不健康的目标不参与主流程
+	connected atomic.Bool  // 是否连接过，启动时连接失败的目标恢复后需要重新连接
+	failures  atomic.Int64 // 累计失败次数
+	catching  atomic.Bool  // 是否有追赶协程
+
+	lock    sync.Mutex // 保护catchup，主流程与追赶流程不会同时向目标写入
+	catchup *catchup
+}
+
+func newCompositeEndpoint(cfg *global.Config, ds *canal.Canal) *CompositeEndpoint {
+	r := &CompositeEndpoint{}
+	r.cfg = cfg
+	r.stop = make(chan struct{})
+	for i, c := range cfg.TargetCfgs() {
+		t := &compositeTarget{
+			index:    i,
+			cfg:      c,
+			endpoint: NewEndpoint(c, ds),
+			position: storage.NewPositionStorage(cfg.TargetPositionKey(c.Target)),
+			retries:  cfg.TargetRetries,
+		}
+		if _, ok := t.endpoint.(*retryEndpoint); ok {
+			t.retries = 0
+		}
+		r.targets = append(r.targets, t)
+	}
+	return r
+}
+
+// Connect 至少一个目标连接成功即可
+func (s *CompositeEndpoint) Connect() error {
+	for _, t := range s.targets {
+		if err := s.connectTarget(t); err != nil {
+			logs.Errorf("target %s connect err %s", t.cfg.Target, err.Error())
+			continue
+		}
+		t.healthy.Store(true)
+	}
+
+	if !s.anyHealthy() {
+		return errors.Errorf("no target available")
+	}
+	return nil
+}
+
+// Restore 连接失败或者位点落后于主流程的目标标记为不健康，在后台追赶
+func (s *CompositeEndpoint) Restore(main mysql.Position) error {
+	for _, t := range s.targets {
+		if err := t.position.Initialize(); err != nil {
+			return errors.Trace(err)
+		}
+		pos, err := t.position.Get()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if pos.Name == "" && main.Name != "" {
+			pos = main
+			if err := t.position.Save(pos); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if !t.healthy.Load() {
+			s.markLagging(t)
+			continue
+		}
+		if pos.Compare(main) < 0 {
+			logs.Infof("target %s position(%s %d) behind, catch up", t.cfg.Target, pos.Name, pos.Pos)
+			s.markLagging(t)
+		}
+	}
+
+	if !s.anyHealthy() {
+		return errors.Errorf("no target available")
+	}
+	return nil
+}
+
+func (s *CompositeEndpoint) connectTarget(t *compositeTarget) error {
+	if err := t.endpoint.Connect(); err != nil {
+		return err
+	}
+	// 异步，必须要ping下才能确定连接成功
+	if t.cfg.IsMongodb() {
+		if err := t.endpoint.Ping(); err != nil {
+			return err
+		}
+	}
+	t.connected.Store(true)
+	return nil
+}
+
+// reconnectTarget 检查目标是否恢复
+func (s *CompositeEndpoint) reconnectTarget(t *compositeTarget) error {
+	if !t.connected.Load() {
+		return s.connectTarget(t)
+	}
+	return t.endpoint.Ping()
+}
+
+// Ping 全部目标都不可用时主流程会停止，有目标追上主流程的位点即可恢复
+func (s *CompositeEndpoint) Ping() error {
+	main, err := storage.NewPositionStorage(s.cfg.PositionKey()).Get()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, t := range s.targets {
+		if !t.healthy.Load() {
+			s.tryJoin(t, main)
+		}
+	}
+
+	if !s.anyHealthy() {
+		return errors.Errorf("no target available")
+	}
+	return nil
+}
+
+// Consume 只向健康的目标写入，单个目标失败时摘除该目标，全部目标失败才返回错误。
+// 主流程位点在至少一个目标成功后推进，摘除的目标不保存新的位点，由追赶流程从自己的位点补齐
+func (s *CompositeEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	s.joinLock.RLock()
+	defer s.joinLock.RUnlock()
+
+	for _, row := range rows {
+		if row.PosName != "" {
+			s.dispatch(mysql.Position{Name: row.PosName, Pos: row.Pos})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range s.targets {
+		if !t.healthy.Load() {
+			continue
+		}
+		wg.Add(1)
+		go func(t *compositeTarget) {
+			defer wg.Done()
+			if err := s.consumeWithRetry(t, from, rows); err != nil {
+				s.markLagging(t)
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	if !s.anyHealthy() {
+		return errors.Errorf("no target available")
+	}
+	return nil
+}
+
+// ConsumeDDL 只向健康的目标发送，失败的目标被摘除后在追赶流程中重新处理
+func (s *CompositeEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	s.joinLock.RLock()
+	defer s.joinLock.RUnlock()
+
+	if ddl.PosName != "" {
+		s.dispatch(mysql.Position{Name: ddl.PosName, Pos: ddl.Pos})
+	}
+
+	for _, t := range s.targets {
+		if !t.healthy.Load() {
+			continue
+		}
+		c, ok := t.endpoint.(DDLConsumer)
+		if !ok {
+			continue
+		}
+		if err := c.ConsumeDDL(ddl); err != nil {
+			t.failures.Inc()
+			logs.Errorf("target %s consume ddl err %s", t.cfg.Target, err.Error())
+			s.markLagging(t)
+		}
+	}
+
+	if !s.anyHealthy() {
+		return errors.Errorf("no target available")
+	}
+	return nil
+}
+
+// PrepareRule 未连接的目标在重新连接时处理
+func (s *CompositeEndpoint) PrepareRule(rule *global.Rule) error {
+	for _, t := range s.targets {
+		if !t.connected.Load() {
+			continue
+		}
+		if p, ok := t.endpoint.(RulePreparer); ok {
+			if err := p.PrepareRule(rule); err != nil {
+				logs.Errorf("target %s prepare rule err %s", t.cfg.Target, err.Error())
+				s.markLagging(t)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *CompositeEndpoint) dispatch(pos mysql.Position) {
+	s.dispatchLock.Lock()
+	if pos.Compare(s.dispatched) > 0 {
+		s.dispatched = pos
+	}
+	s.dispatchLock.Unlock()
+}
+
+// consumeWithRetry 单个目标失败时只对该目标重试，不影响已经成功的目标
+func (s *CompositeEndpoint) consumeWithRetry(t *compositeTarget, from mysql.Position, rows []*model.RowRequest) error {
+	var err error
+	for i := 0; i <= t.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(s.cfg.TargetRetryInterval) * time.Millisecond)
+			logs.Warnf("target %s retry %d", t.cfg.Target, i)
+		}
+		if err = t.endpoint.Consume(from, rows); err == nil {
+			return nil
+		}
+		t.failures.Inc()
+		logs.Errorf("target %s consume err %s", t.cfg.Target, err.Error())
+	}
+
+	return errors.Annotatef(err, "target %s", t.cfg.Target)
+}
+
+// Checkpoint 健康的目标保存主流程的位点，追赶中的目标追上后在此处重新加入
+func (s *CompositeEndpoint) Checkpoint(pos mysql.Position) error {
+	for _, t := range s.targets {
+		if t.healthy.Load() {
+			if err := t.position.Save(pos); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		s.tryJoin(t, pos)
+	}
+	return nil
+}
+
+// tryJoin 追赶位点不小于主流程位点以及已经分发的最大位点时停止追赶，重新加入主流程；
+// 并行处理时保存的位点之后可能已经分发了其他批次，这些批次没有写入该目标，只能由追赶流程写入
+func (s *CompositeEndpoint) tryJoin(t *compositeTarget, pos mysql.Position) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// 等待进行中的批次完成，之后的批次都会写入该目标
+	s.joinLock.Lock()
+	defer s.joinLock.Unlock()
+
+	target := pos
+	s.dispatchLock.Lock()
+	if s.dispatched.Compare(target) > 0 {
+		target = s.dispatched
+	}
+	s.dispatchLock.Unlock()
+
+	if t.catchup != nil {
+		if t.catchup.pos.Compare(target) < 0 {
+			return
+		}
+		t.catchup.close()
+		t.catchup = nil
+	} else {
+		current, err := t.position.Get()
+		if err != nil || current.Compare(target) < 0 {
+			return
+		}
+		if err := s.reconnectTarget(t); err != nil {
+			return
+		}
+	}
+
+	if err := t.position.Save(pos); err != nil {
+		logs.Errorf("target %s save position err %s", t.cfg.Target, err.Error())
+		return
+	}
+	logs.Infof("target %s caught up at position(%s %d)", t.cfg.Target, pos.Name, pos.Pos)
+	t.healthy.Store(true)
+}
+
+// markLagging 摘除目标，启动追赶协程
+func (s *CompositeEndpoint) markLagging(t *compositeTarget) {
+	t.healthy.Store(false)
+	if !t.catching.CAS(false, true) {
+		return
+	}
+
+	logs.Warnf("target %s removed, waiting for catch up", t.cfg.Target)
+	go func() {
+		defer t.catching.Store(false)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if t.healthy.Load() {
+					return
+				}
+				s.startCatchup(t)
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// startCatchup 目标可用时从目标自己的位点启动追赶
+func (s *CompositeEndpoint) startCatchup(t *compositeTarget) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.catchup != nil || t.healthy.Load() {
+		return
+	}
+
+	if err := s.reconnectTarget(t); err != nil {
+		return
+	}
+
+	pos, err := t.position.Get()
+	if err != nil || pos.Name == "" {
+		return
+	}
+
+	c, err := newCatchup(s.cfg, t, pos)
+	if err != nil {
+		logs.Errorf("target %s catch up err %s", t.cfg.Target, errors.ErrorStack(err))
+		return
+	}
+	t.catchup = c
+	c.run()
+}
+
+func (s *CompositeEndpoint) anyHealthy() bool {
+	for _, t := range s.targets {
+		if t.healthy.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// Stock 返回全部目标中成功条数最少的值
+func (s *CompositeEndpoint) Stock(rows []*model.RowRequest) int64 {
+	var wg sync.WaitGroup
+	counts := make([]int64, len(s.targets))
+	for i, t := range s.targets {
+		if !t.connected.Load() {
+			continue // 未连接的目标导入条数为0
+		}
+		wg.Add(1)
+		go func(i int, t *compositeTarget) {
+			defer wg.Done()
+			counts[i] = t.endpoint.Stock(rows)
+		}(i, t)
+	}
+	wg.Wait()
+
+	min := int64(len(rows))
+	for _, c := range counts {
+		if c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// Health 每个目标的健康状态
+func (s *CompositeEndpoint) Health() map[string]bool {
+	ret := make(map[string]bool, len(s.targets))
+	for _, t := range s.targets {
+		ret[t.cfg.Target] = t.healthy.Load()
+	}
+	return ret
+}
+
+func (s *CompositeEndpoint) Close() {
+	close(s.stop)
+	for _, t := range s.targets {
+		t.lock.Lock()
+		if t.catchup != nil {
+			t.catchup.close()
+			t.catchup = nil
+		}
+		t.lock.Unlock()
+		t.endpoint.Close()
+	}
+}
@@ -0,0 +1,320 @@
+package endpoint
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"go.uber.org/atomic"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+type fakeEndpoint struct {
+	down     atomic.Bool
+	consumes atomic.Int64
+
+	lock sync.Mutex
+	rows []*model.RowRequest
+}
+
+func (s *fakeEndpoint) Connect() error {
+	return s.Ping()
+}
+
+func (s *fakeEndpoint) Ping() error {
+	if s.down.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (s *fakeEndpoint) Consume(_ mysql.Position, rows []*model.RowRequest) error {
+	s.consumes.Inc()
+	if s.down.Load() {
+		return errors.New("connection refused")
+	}
+	s.lock.Lock()
+	s.rows = append(s.rows, rows...)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *fakeEndpoint) Stock(rows []*model.RowRequest) int64 {
+	return int64(len(rows))
+}
+
+func (s *fakeEndpoint) Close() {}
+
+func (s *fakeEndpoint) received() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.rows)
+}
+
+type memPositionStorage struct {
+	lock sync.Mutex
+	pos  mysql.Position
+}
+
+func (s *memPositionStorage) Initialize() error {
+	return nil
+}
+
+func (s *memPositionStorage) Save(pos mysql.Position) error {
+	s.lock.Lock()
+	s.pos = pos
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memPositionStorage) Get() (mysql.Position, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.pos, nil
+}
+
+func (s *memPositionStorage) SaveWithGTID(pos mysql.Position, _ string) error {
+	return s.Save(pos)
+}
+
+func (s *memPositionStorage) GetGTID() (string, error) {
+	return "", nil
+}
+
+func newTestComposite(endpoints ...Endpoint) *CompositeEndpoint {
+	r := &CompositeEndpoint{
+		cfg:  &global.Config{},
+		stop: make(chan struct{}),
+	}
+	for i, e := range endpoints {
+		t := &compositeTarget{
+			index:    i,
+			cfg:      &global.Config{Target: "fake"},
+			endpoint: e,
+			position: &memPositionStorage{},
+		}
+		t.connected.Store(true)
+		t.healthy.Store(true)
+		r.targets = append(r.targets, t)
+	}
+	return r
+}
+
+func testRows(name string, positions ...uint32) []*model.RowRequest {
+	rows := make([]*model.RowRequest, 0, len(positions))
+	for _, p := range positions {
+		rows = append(rows, &model.RowRequest{PosName: name, Pos: p})
+	}
+	return rows
+}
+
+func TestCompositeFanOut(t *testing.T) {
+	a, b := &fakeEndpoint{}, &fakeEndpoint{}
+	c := newTestComposite(a, b)
+	defer c.Close()
+
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 100, 200)); err != nil {
+		t.Fatal(err)
+	}
+	if a.received() != 2 || b.received() != 2 {
+		t.Fatalf("expect every target receive 2 rows, got %d %d", a.received(), b.received())
+	}
+
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 200}
+	if err := c.Checkpoint(pos); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range c.targets {
+		if saved, _ := target.position.Get(); saved.Compare(pos) != 0 {
+			t.Errorf("target %d position %v, expect %v", target.index, saved, pos)
+		}
+	}
+}
+
+func TestCompositeTargetFailure(t *testing.T) {
+	a, b := &fakeEndpoint{}, &fakeEndpoint{}
+	b.down.Store(true)
+	c := newTestComposite(a, b)
+	defer c.Close()
+
+	// 一个目标失败时摘除该目标，其他目标继续写入
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if a.received() != 1 || b.received() != 0 {
+		t.Fatalf("expect rows only in healthy target, got %d %d", a.received(), b.received())
+	}
+	if health := c.targets[1].healthy.Load(); health {
+		t.Fatal("failed target should be removed")
+	}
+
+	// 摘除的目标不再参与主流程，位点也不再推进
+	consumes := b.consumes.Load()
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 200)); err != nil {
+		t.Fatal(err)
+	}
+	if b.consumes.Load() != consumes {
+		t.Fatal("lagging target should be skipped")
+	}
+	if err := c.Checkpoint(mysql.Position{Name: "mysql-bin.000001", Pos: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := c.targets[1].position.Get(); saved.Name != "" {
+		t.Fatalf("lagging target position should not advance, got %v", saved)
+	}
+
+	// 全部目标失败时返回错误，主流程停止
+	a.down.Store(true)
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 300)); err == nil {
+		t.Fatal("expect error when no target available")
+	}
+}
+
+func TestCompositeRejoin(t *testing.T) {
+	a, b := &fakeEndpoint{}, &fakeEndpoint{}
+	b.down.Store(true)
+	c := newTestComposite(a, b)
+	defer c.Close()
+
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 100)); err != nil {
+		t.Fatal(err)
+	}
+	// 并行处理时保存位点之前已经分发了之后的批次
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 300)); err != nil {
+		t.Fatal(err)
+	}
+
+	lagging := c.targets[1]
+	b.down.Store(false)
+	checkpoint := mysql.Position{Name: "mysql-bin.000001", Pos: 100}
+
+	// 追赶到主流程的位点，但是没有追赶过已经分发的位点，不能重新加入
+	lagging.position.Save(checkpoint)
+	c.Checkpoint(checkpoint)
+	if lagging.healthy.Load() {
+		t.Fatal("target should not rejoin before passing dispatched position")
+	}
+
+	lagging.position.Save(mysql.Position{Name: "mysql-bin.000001", Pos: 300})
+	c.Checkpoint(checkpoint)
+	if !lagging.healthy.Load() {
+		t.Fatal("target should rejoin after passing dispatched position")
+	}
+	if saved, _ := lagging.position.Get(); saved.Compare(checkpoint) != 0 {
+		t.Fatalf("rejoined target position %v, expect %v", saved, checkpoint)
+	}
+
+	if err := c.Consume(mysql.Position{}, testRows("mysql-bin.000001", 400)); err != nil {
+		t.Fatal(err)
+	}
+	if b.received() != 1 {
+		t.Fatalf("rejoined target expect 1 row, got %d", b.received())
+	}
+}
+
+func TestCatchupFlush(t *testing.T) {
+	e := &fakeEndpoint{}
+	c := newTestComposite(&fakeEndpoint{}, e)
+	defer c.Close()
+
+	target := c.targets[1]
+	from := mysql.Position{Name: "mysql-bin.000001", Pos: 100}
+	s := &catchup{
+		cfg:       &global.Config{BulkSize: 10, FlushBulkInterval: 60000, TransactionMode: true},
+		target:    target,
+		pos:       from,
+		from:      from,
+		lastFlush: time.Now(),
+	}
+
+	// 未达到批量大小时只在内存中推进位点，同一事务的行打上事务标记
+	s.requests = append(s.requests, testRows("mysql-bin.000001", 150, 150)...)
+	if err := s.OnXID(mysql.Position{Name: "mysql-bin.000001", Pos: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if e.received() != 0 {
+		t.Fatalf("expect rows buffered, got %d", e.received())
+	}
+	if s.requests[1].Tx == nil || s.requests[1].Tx.Id != "mysql-bin.000001:200" || s.requests[1].Tx.Total != 2 {
+		t.Fatalf("unexpected tx %+v", s.requests[1].Tx)
+	}
+
+	// 强制写入后保存目标的位点
+	next := mysql.Position{Name: "mysql-bin.000002", Pos: 4}
+	if err := s.OnRotate(&replication.RotateEvent{NextLogName: []byte(next.Name), Position: uint64(next.Pos)}); err != nil {
+		t.Fatal(err)
+	}
+	if e.received() != 2 || len(s.requests) != 0 {
+		t.Fatalf("expect 2 rows flushed, got %d", e.received())
+	}
+	if saved, _ := target.position.Get(); saved.Compare(next) != 0 {
+		t.Fatalf("target position %v, expect %v", saved, next)
+	}
+
+	// 追赶过主流程位点后重新加入，关闭追赶流程
+	target.healthy.Store(false)
+	target.catchup = s
+	c.Checkpoint(mysql.Position{Name: "mysql-bin.000001", Pos: 300})
+	if !target.healthy.Load() || target.catchup != nil || !s.closed.Load() {
+		t.Fatal("target should rejoin and close catch up")
+	}
+	if err := s.flush(next, true); err == nil {
+		t.Fatal("expect error after catch up closed")
+	}
+}
+
+func TestCatchupRetireRule(t *testing.T) {
+	cfg := &global.Config{BulkSize: 10, FlushBulkInterval: 60000}
+	ruleKey := cfg.RuleKey("test", "t_catchup_drop")
+	global.AddRuleIns(ruleKey, &global.Rule{Schema: "test", Table: "t_catchup_drop"})
+
+	c := newTestComposite(&fakeEndpoint{})
+	defer c.Close()
+	from := mysql.Position{Name: "mysql-bin.000001", Pos: 100}
+	s := &catchup{
+		cfg:       cfg,
+		target:    c.targets[0],
+		ddl:       NewDDLParser(cfg),
+		rules:     global.PipelineRuleInsSnapshot(cfg.Name),
+		pos:       from,
+		from:      from,
+		lastFlush: time.Now(),
+	}
+
+	// 主流程已经处理了删除表的DDL，追赶流程到达DDL之前仍然同步该表，目标写入时也能取得规则
+	global.RemoveRuleIns(ruleKey)
+	if _, ok := s.rule("test", "t_catchup_drop"); !ok {
+		t.Fatal("catch up should keep rule before reaching drop")
+	}
+	if _, ok := rowRule(ruleKey); !ok {
+		t.Fatal("retired rule should be resolved for lagging target")
+	}
+	if snapshot := global.PipelineRuleInsSnapshot(cfg.Name); snapshot[ruleKey] == nil {
+		t.Fatal("snapshot should include retired rule")
+	}
+
+	// 追赶到删除表的DDL之后移除规则
+	next := mysql.Position{Name: "mysql-bin.000001", Pos: 300}
+	if err := s.OnDDL(next, &replication.QueryEvent{Schema: []byte("test"), Query: []byte("drop table t_catchup_drop")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.rule("test", "t_catchup_drop"); ok {
+		t.Fatal("catch up should retire rule after drop")
+	}
+
+	// 同名的表重新创建后使用主流程的规则
+	recreated := &global.Rule{Schema: "test", Table: "t_catchup_drop"}
+	global.AddRuleIns(ruleKey, recreated)
+	defer global.RemoveRuleIns(ruleKey)
+	if rule, ok := s.rule("test", "t_catchup_drop"); !ok || rule != recreated {
+		t.Fatal("recreated table should use current rule")
+	}
+	if _, ok := global.RetiredRuleIns(ruleKey); ok {
+		t.Fatal("retired rule should be dropped after table recreated")
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// DDLConsumer 支持表结构变更的接收端
+type DDLConsumer interface {
+	ConsumeDDL(ddl *model.DDLRequest) error
+}
+
+// EventTimestamp OnDDL中QueryEvent的时间，秒；canal不向OnDDL传入事件头，
+// 但在回调之前按照事件头的时间更新了复制延迟，由当前时间减去延迟得到
+func EventTimestamp(c *canal.Canal) uint32 {
+	now := uint32(time.Now().Unix())
+	if c == nil {
+		return now
+	}
+	return now - c.GetDelay()
+}
+
+// ParseDDL 解析query中全部的CREATE、ALTER、DROP、RENAME、TRUNCATE TABLE语句，其他语句忽略
+func ParseDDL(cfg *global.Config, nextPos mysql.Position, e *replication.QueryEvent) ([]*model.DDLRequest, error) {
+	stmts, _, err := parser.New().Parse(string(e.Query), "", "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ls []*model.DDLRequest
+	for _, stmt := range stmts {
+		ls = append(ls, parseDDLStmt(cfg, nextPos, e, stmt)...)
+	}
+	return ls, nil
+}
+
+// DDLParser canal对一个QueryEvent中的每条表结构语句各回调一次OnDDL，传入的都是整个query；
+// 按照同一个事件的回调次数只解析当前语句，多条语句的query不会重复产生DDL
+type DDLParser struct {
+	cfg   *global.Config
+	event *replication.QueryEvent
+	stmts []ast.StmtNode // 事件中会触发OnDDL的语句
+	index int
+}
+
+func NewDDLParser(cfg *global.Config) *DDLParser {
+	return &DDLParser{cfg: cfg}
+}
+
+// Parse 在OnDDL中调用，返回当前语句的DDL
+func (s *DDLParser) Parse(nextPos mysql.Position, e *replication.QueryEvent) ([]*model.DDLRequest, error) {
+	if s.event != e {
+		stmts, _, err := parser.New().Parse(string(e.Query), "", "")
+		if err != nil {
+			s.event = nil
+			return nil, errors.Trace(err)
+		}
+		s.event = e
+		s.stmts = s.stmts[:0]
+		s.index = 0
+		for _, stmt := range stmts {
+			if tableChanged(stmt) {
+				s.stmts = append(s.stmts, stmt)
+			}
+		}
+	}
+
+	if s.index >= len(s.stmts) {
+		return nil, nil
+	}
+	stmt := s.stmts[s.index]
+	s.index++
+	return parseDDLStmt(s.cfg, nextPos, e, stmt), nil
+}
+
+// tableChanged 与canal一致，这些语句会触发OnDDL
+func tableChanged(stmt ast.StmtNode) bool {
+	switch t := stmt.(type) {
+	case *ast.RenameTableStmt:
+		return len(t.TableToTables) > 0
+	case *ast.DropTableStmt:
+		return len(t.Tables) > 0
+	case *ast.AlterTableStmt, *ast.CreateTableStmt, *ast.TruncateTableStmt:
+		return true
+	}
+	return false
+}
+
+func parseDDLStmt(cfg *global.Config, nextPos mysql.Position, e *replication.QueryEvent, stmt ast.StmtNode) []*model.DDLRequest {
+	query := strings.TrimSuffix(strings.TrimSpace(stmt.Text()), ";")
+	if query == "" {
+		query = string(e.Query)
+	}
+
+	var ls []*model.DDLRequest
+	add := func(tp string, table *ast.TableName) *model.DDLRequest {
+		ddl := &model.DDLRequest{
+			Action:  model.DDLAction,
+			Type:    tp,
+			Schema:  table.Schema.O,
+			Table:   table.Name.O,
+			Query:   query,
+			PosName: nextPos.Name,
+			Pos:     nextPos.Pos,
+		}
+		if ddl.Schema == "" {
+			ddl.Schema = string(e.Schema)
+		}
+		ddl.RuleKey = cfg.RuleKey(ddl.Schema, ddl.Table)
+		ls = append(ls, ddl)
+		return ddl
+	}
+	rename := func(ddl *model.DDLRequest, table *ast.TableName) {
+		ddl.NewSchema = table.Schema.O
+		if ddl.NewSchema == "" {
+			ddl.NewSchema = string(e.Schema)
+		}
+		ddl.NewTable = table.Name.O
+	}
+
+	switch t := stmt.(type) {
+	case *ast.CreateTableStmt:
+		add(model.DDLCreate, t.Table)
+	case *ast.AlterTableStmt:
+		var alter *model.DDLRequest
+		for _, spec := range t.Specs {
+			switch spec.Tp {
+			case ast.AlterTableRenameTable:
+				rename(add(model.DDLRename, t.Table), spec.NewTable)
+			case ast.AlterTableAddColumns:
+				if alter == nil {
+					alter = add(model.DDLAlter, t.Table)
+				}
+				for _, c := range spec.NewColumns {
+					alter.AddedColumns = append(alter.AddedColumns, c.Name.Name.O)
+				}
+			default:
+				if alter == nil {
+					alter = add(model.DDLAlter, t.Table)
+				}
+			}
+		}
+	case *ast.DropTableStmt:
+		if t.IsView {
+			return nil
+		}
+		for _, table := range t.Tables {
+			add(model.DDLDrop, table)
+		}
+	case *ast.RenameTableStmt:
+		for _, tt := range t.TableToTables {
+			rename(add(model.DDLRename, tt.OldTable), tt.NewTable)
+		}
+	case *ast.TruncateTableStmt:
+		add(model.DDLTruncate, t.Table)
+	}
+	return ls
+}
+
+// ddlRule DDL对应的规则，没有规则的表以及Lua脚本处理的表返回false；Lua脚本自行决定目标，没有可以写入DDL的默认目标
+func ddlRule(ddl *model.DDLRequest) (*global.Rule, bool) {
+	if ddl.RuleKey == "" {
+		return nil, false
+	}
+	rule, ok := rowRule(ddl.RuleKey)
+	if !ok || rule.LuaEnable() {
+		return nil, false
+	}
+	return rule, true
+}
+
+// isDropDDL 删除或者清空表
+func isDropDDL(ddl *model.DDLRequest) bool {
+	return ddl.Type == model.DDLDrop || ddl.Type == model.DDLTruncate
+}
@@ -0,0 +1,143 @@
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestParseDDL(t *testing.T) {
+	cfg := &global.Config{}
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+
+	cases := []struct {
+		query  string
+		expect []model.DDLRequest
+	}{
+		{
+			query:  "create table t_user (id int primary key, name varchar(20))",
+			expect: []model.DDLRequest{{Type: model.DDLCreate, Schema: "test", Table: "t_user"}},
+		},
+		{
+			query: "alter table eseap.t_user add column age int, add column sex int",
+			expect: []model.DDLRequest{
+				{Type: model.DDLAlter, Schema: "eseap", Table: "t_user", AddedColumns: []string{"age", "sex"}},
+			},
+		},
+		{
+			query:  "alter table t_user rename to t_user_bak",
+			expect: []model.DDLRequest{{Type: model.DDLRename, Schema: "test", Table: "t_user", NewSchema: "test", NewTable: "t_user_bak"}},
+		},
+		{
+			query: "rename table t_a to t_b, t_c to other.t_d",
+			expect: []model.DDLRequest{
+				{Type: model.DDLRename, Schema: "test", Table: "t_a", NewSchema: "test", NewTable: "t_b"},
+				{Type: model.DDLRename, Schema: "test", Table: "t_c", NewSchema: "other", NewTable: "t_d"},
+			},
+		},
+		{
+			query: "drop table if exists t_a, t_b",
+			expect: []model.DDLRequest{
+				{Type: model.DDLDrop, Schema: "test", Table: "t_a"},
+				{Type: model.DDLDrop, Schema: "test", Table: "t_b"},
+			},
+		},
+		{
+			query:  "truncate table t_a",
+			expect: []model.DDLRequest{{Type: model.DDLTruncate, Schema: "test", Table: "t_a"}},
+		},
+		{
+			query: "create index idx_name on t_a (name)",
+		},
+	}
+
+	for _, c := range cases {
+		e := &replication.QueryEvent{Schema: []byte("test"), Query: []byte(c.query)}
+		ls, err := ParseDDL(cfg, pos, e)
+		if err != nil {
+			t.Fatalf("%s: %s", c.query, err.Error())
+		}
+		if len(ls) != len(c.expect) {
+			t.Fatalf("%s: expect %d ddl, got %d", c.query, len(c.expect), len(ls))
+		}
+		for i, ddl := range ls {
+			expect := c.expect[i]
+			expect.Action = model.DDLAction
+			expect.Query = c.query
+			expect.PosName = pos.Name
+			expect.Pos = pos.Pos
+			expect.RuleKey = cfg.RuleKey(expect.Schema, expect.Table)
+			if !reflect.DeepEqual(*ddl, expect) {
+				t.Errorf("%s: expect %+v, got %+v", c.query, expect, *ddl)
+			}
+		}
+	}
+}
+
+func TestDDLParser(t *testing.T) {
+	cfg := &global.Config{}
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 4}
+	p := NewDDLParser(cfg)
+
+	// canal对其中的create table、drop table各回调一次，create index不回调
+	e := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("create table t_a (id int); create index idx_id on t_a (id); drop table t_b")}
+	expects := []struct {
+		tp    string
+		table string
+		query string
+	}{
+		{model.DDLCreate, "t_a", "create table t_a (id int)"},
+		{model.DDLDrop, "t_b", "drop table t_b"},
+	}
+	for _, expect := range expects {
+		ls, err := p.Parse(pos, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ls) != 1 || ls[0].Type != expect.tp || ls[0].Table != expect.table || ls[0].Query != expect.query {
+			t.Fatalf("expect %s %s, got %+v", expect.tp, expect.table, ls)
+		}
+	}
+	if ls, _ := p.Parse(pos, e); len(ls) != 0 {
+		t.Fatalf("expect no more ddl, got %+v", ls)
+	}
+
+	// 新的事件重新解析
+	e = &replication.QueryEvent{Schema: []byte("test"), Query: []byte("truncate table t_a")}
+	if ls, _ := p.Parse(pos, e); len(ls) != 1 || ls[0].Type != model.DDLTruncate || ls[0].Query != "truncate table t_a" {
+		t.Fatalf("expect truncate t_a, got %+v", ls)
+	}
+}
+
+func TestDDLSkipLuaRule(t *testing.T) {
+	cfg := &global.Config{}
+	ruleKey := cfg.RuleKey("test", "t_lua")
+	global.AddRuleIns(ruleKey, &global.Rule{Schema: "test", Table: "t_lua", LuaScript: "local ops = require(\"mqOps\")"})
+	defer global.RemoveRuleIns(ruleKey)
+
+	ls, err := ParseDDL(cfg, mysql.Position{Name: "mysql-bin.000001", Pos: 4},
+		&replication.QueryEvent{Schema: []byte("test"), Query: []byte("drop table t_lua")})
+	if err != nil || len(ls) != 1 || ls[0].RuleKey != ruleKey {
+		t.Fatalf("expect drop of %s, got %+v %v", ruleKey, ls, err)
+	}
+	if _, ok := ddlRule(ls[0]); ok {
+		t.Fatal("lua rule should not receive ddl")
+	}
+
+	// Lua规则没有默认的topic和队列，DDL不发送，不会因为发送失败而反复重启
+	endpoints := map[string]interface{ ConsumeDDL(*model.DDLRequest) error }{
+		"kafka":  &KafkaEndpoint{},
+		"rocket": &RocketEndpoint{},
+		"rabbit": &RabbitEndpoint{},
+	}
+	for name, e := range endpoints {
+		if err := e.ConsumeDDL(ls[0]); err != nil {
+			t.Errorf("%s: expect lua rule ddl skipped, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+const (
+	_debeziumVersion     = "go-mysql-transfer"
+	_debeziumConnector   = "mysql"
+	_debeziumDefaultName = "go-mysql-transfer" // 默认管道的逻辑名称
+)
+
+// debeziumEvent Debezium的变更事件，与Kafka Connect JsonConverter(schemas.enable=true)的格式一致
+type debeziumEvent struct {
+	Schema  *debeziumSchema  `json:"schema"`
+	Payload *debeziumPayload `json:"payload"`
+}
+
+type debeziumPayload struct {
+	Before      map[string]interface{} `json:"before"`
+	After       map[string]interface{} `json:"after"`
+	Source      *debeziumSource        `json:"source"`
+	Op          string                 `json:"op"` // c:insert、u:update、d:delete、r:全量导入
+	TsMs        int64                  `json:"ts_ms"`
+	Transaction *debeziumTransaction   `json:"transaction"`
+}
+
+type debeziumSource struct {
+	Version   string `json:"version"`
+	Connector string `json:"connector"`
+	Name      string `json:"name"`
+	TsMs      int64  `json:"ts_ms"`
+	Snapshot  string `json:"snapshot"`
+	Db        string `json:"db"`
+	Table     string `json:"table"`
+	ServerId  uint32 `json:"server_id"`
+	File      string `json:"file"`
+	Pos       uint32 `json:"pos"`
+	Row       int    `json:"row"`
+}
+
+type debeziumTransaction struct {
+	Id                  string `json:"id"`
+	TotalOrder          int    `json:"total_order"`
+	DataCollectionOrder int    `json:"data_collection_order"`
+}
+
+type debeziumSchema struct {
+	Type     string            `json:"type"`
+	Fields   []*debeziumSchema `json:"fields,omitempty"`
+	Optional bool              `json:"optional"`
+	Name     string            `json:"name,omitempty"`
+	Field    string            `json:"field,omitempty"`
+}
+
+func newDebeziumEvent(row *model.RowRequest, rule *global.Rule) *debeziumEvent {
+	payload := &debeziumPayload{
+		Source: &debeziumSource{
+			Version:   _debeziumVersion,
+			Connector: _debeziumConnector,
+			Name:      debeziumName(rule),
+			TsMs:      int64(row.Timestamp) * 1000,
+			Snapshot:  "false",
+			Db:        rule.Schema,
+			Table:     rule.Table,
+			ServerId:  row.ServerId,
+			File:      row.PosName,
+			Pos:       row.Pos,
+			Row:       row.RowIndex,
+		},
+		TsMs: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	switch row.Action {
+	case canal.InsertAction:
+		payload.Op = "c"
+		payload.After = debeziumRow(rowMap(row, rule, false), rule)
+		if row.PosName == "" {
+			payload.Op = "r"
+			payload.Source.Snapshot = "true"
+		}
+	case canal.UpdateAction:
+		payload.Op = "u"
+		payload.After = debeziumRow(rowMap(row, rule, false), rule)
+		if row.Old != nil {
+			payload.Before = debeziumRow(oldRowMap(row, rule, false), rule)
+		}
+	case canal.DeleteAction:
+		payload.Op = "d"
+		payload.Before = debeziumRow(rowMap(row, rule, false), rule)
+	}
+
+	if row.Tx != nil {
+		payload.Transaction = &debeziumTransaction{
+			Id:                  row.Tx.Id,
+			TotalOrder:          row.Tx.Index + 1,
+			DataCollectionOrder: row.Tx.TableIndex + 1,
+		}
+	}
+
+	return &debeziumEvent{
+		Schema:  debeziumEnvelopeSchema(rule),
+		Payload: payload,
+	}
+}
+
+func debeziumName(rule *global.Rule) string {
+	if rule.Pipeline == "" {
+		return _debeziumDefaultName
+	}
+	return rule.Pipeline
+}
+
+// debeziumRow JSON列按照io.debezium.data.Json以字符串发送
+func debeziumRow(kv map[string]interface{}, rule *global.Rule) map[string]interface{} {
+	for _, padding := range rule.PaddingMap {
+		if padding.ColumnType != schema.TYPE_JSON || padding.Transform != nil {
+			continue
+		}
+		if v, ok := kv[padding.WrapName]; ok && v != nil {
+			if _, ok := v.(string); !ok {
+				data, _ := json.Marshal(v)
+				kv[padding.WrapName] = string(data)
+			}
+		}
+	}
+	return kv
+}
+
+func debeziumEnvelopeSchema(rule *global.Rule) *debeziumSchema {
+	prefix := debeziumName(rule) + "." + rule.Schema + "." + rule.Table
+	value := debeziumValueSchema(rule, prefix+".Value")
+
+	before := *value
+	before.Field = "before"
+	after := *value
+	after.Field = "after"
+
+	return &debeziumSchema{
+		Type: "struct",
+		Fields: []*debeziumSchema{
+			&before,
+			&after,
+			{
+				Type: "struct",
+				Fields: []*debeziumSchema{
+					{Type: "string", Field: "version"},
+					{Type: "string", Field: "connector"},
+					{Type: "string", Field: "name"},
+					{Type: "int64", Field: "ts_ms"},
+					{Type: "string", Optional: true, Field: "snapshot"},
+					{Type: "string", Field: "db"},
+					{Type: "string", Optional: true, Field: "table"},
+					{Type: "int64", Field: "server_id"},
+					{Type: "string", Field: "file"},
+					{Type: "int64", Field: "pos"},
+					{Type: "int32", Field: "row"},
+				},
+				Name:  "io.debezium.connector.mysql.Source",
+				Field: "source",
+			},
+			{Type: "string", Field: "op"},
+			{Type: "int64", Optional: true, Field: "ts_ms"},
+			{
+				Type: "struct",
+				Fields: []*debeziumSchema{
+					{Type: "string", Field: "id"},
+					{Type: "int64", Field: "total_order"},
+					{Type: "int64", Field: "data_collection_order"},
+				},
+				Optional: true,
+				Field:    "transaction",
+			},
+		},
+		Name: prefix + ".Envelope",
+	}
+}
+
+// debeziumValueSchema 按照列的顺序，默认列在最后
+func debeziumValueSchema(rule *global.Rule, name string) *debeziumSchema {
+	paddings := sortedPaddings(rule)
+	defaults := sortedDefaultColumns(rule)
+
+	fields := make([]*debeziumSchema, 0, len(paddings)+len(defaults))
+	for _, padding := range paddings {
+		field := &debeziumSchema{
+			Type:     debeziumFieldType(rule, padding),
+			Optional: !rule.IsPKColumn(padding.ColumnIndex),
+			Field:    padding.WrapName,
+		}
+		if padding.ColumnType == schema.TYPE_JSON && padding.Transform == nil {
+			field.Name = "io.debezium.data.Json"
+		}
+		fields = append(fields, field)
+	}
+
+	for _, k := range defaults {
+		fields = append(fields, &debeziumSchema{Type: "string", Optional: true, Field: rule.WrapName(k)})
+	}
+
+	return &debeziumSchema{
+		Type:     "struct",
+		Fields:   fields,
+		Optional: true,
+		Name:     name,
+	}
+}
+
+func debeziumFieldType(rule *global.Rule, padding *model.Padding) string {
+	switch fieldKind(rule, padding) {
+	case _fieldLong:
+		return "int64"
+	case _fieldDouble:
+		return "double"
+	default:
+		return "string"
+	}
+}
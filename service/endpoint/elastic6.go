@@ -38,6 +38,7 @@ import (
 )
 
 type Elastic6Endpoint struct {
+	cfg    *global.Config
 	first  string
 	hosts  []string
 	client *elastic.Client
@@ -45,9 +46,10 @@ type Elastic6Endpoint struct {
 	retryLock sync.Mutex
 }
 
-func newElastic6Endpoint() *Elastic6Endpoint {
+func newElastic6Endpoint(cfg *global.Config) *Elastic6Endpoint {
 	r := &Elastic6Endpoint{}
-	r.hosts = strings.Split(global.Cfg().ElsAddr, ",")
+	r.hosts = strings.Split(cfg.ElsAddr, ",")
+	r.cfg = cfg
 	r.first = r.hosts[0]
 	return r
 }
@@ -56,8 +58,8 @@ func (s *Elastic6Endpoint) Connect() error {
 	var options []elastic.ClientOptionFunc
 	options = append(options, elastic.SetErrorLog(logagent.NewElsLoggerAgent()))
 	options = append(options, elastic.SetURL(s.hosts...))
-	if global.Cfg().ElsUser != "" && global.Cfg().ElsPassword != "" {
-		options = append(options, elastic.SetBasicAuth(global.Cfg().ElsUser, global.Cfg().Password))
+	if s.cfg.ElsUser != "" && s.cfg.ElsPassword != "" {
+		options = append(options, elastic.SetBasicAuth(s.cfg.ElsUser, s.cfg.ElsPassword))
 	}
 
 	client, err := elastic.NewClient(options...)
@@ -70,7 +72,7 @@ func (s *Elastic6Endpoint) Connect() error {
 }
 
 func (s *Elastic6Endpoint) indexMapping() error {
-	for _, rule := range global.RuleInsList() {
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
 		exists, err := s.client.IndexExists(rule.ElsIndex).Do(context.Background())
 		if err != nil {
 			return err
@@ -191,7 +193,7 @@ func (s *Elastic6Endpoint) Ping() error {
 func (s *Elastic6Endpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
 	bulk := s.client.Bulk()
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -255,7 +257,7 @@ func (s *Elastic6Endpoint) Stock(rows []*model.RowRequest) int64 {
 
 	bulk := s.client.Bulk()
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -308,3 +310,27 @@ func (s *Elastic6Endpoint) Close() {
 		s.client.Stop()
 	}
 }
+
+// ConsumeDDL 新建表或者新增列时更新索引的mapping
+func (s *Elastic6Endpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	rule, ok := ddlRule(ddl)
+	if !ok {
+		return nil
+	}
+	if ddl.Type != model.DDLCreate && len(ddl.AddedColumns) == 0 {
+		return nil
+	}
+	return s.PrepareRule(rule)
+}
+
+// PrepareRule 创建或者更新新规则的索引
+func (s *Elastic6Endpoint) PrepareRule(rule *global.Rule) error {
+	exists, err := s.client.IndexExists(rule.ElsIndex).Do(context.Background())
+	if err != nil {
+		return err
+	}
+	if exists {
+		return s.updateIndexMapping(rule)
+	}
+	return s.insertIndexMapping(rule)
+}
@@ -19,6 +19,7 @@ package endpoint
 
 import (
 	"bytes"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -47,36 +48,51 @@ type Endpoint interface {
 	Close()
 }
 
-func NewEndpoint(ds *canal.Canal) Endpoint {
-	cfg := global.Cfg()
-	luaengine.InitActuator(ds)
+// RulePreparer 运行中新增规则时，接收端需要做的准备，如创建索引、声明队列
+type RulePreparer interface {
+	PrepareRule(rule *global.Rule) error
+}
+
+func NewEndpoint(cfg *global.Config, ds *canal.Canal) Endpoint {
+	luaengine.InitActuator(cfg.Name, ds)
+
+	if cfg.IsComposite() {
+		return newCompositeEndpoint(cfg, ds)
+	}
+
+	if ep := newEndpoint(cfg); ep != nil {
+		return newRetryEndpoint(cfg, ep)
+	}
+	return nil
+}
 
+func newEndpoint(cfg *global.Config) Endpoint {
 	if cfg.IsRedis() {
-		return newRedisEndpoint()
+		return newRedisEndpoint(cfg)
 	}
 
 	if cfg.IsMongodb() {
-		return newMongoEndpoint()
+		return newMongoEndpoint(cfg)
 	}
 
 	if cfg.IsRocketmq() {
-		return newRocketEndpoint()
+		return newRocketEndpoint(cfg)
 	}
 
 	if cfg.IsRabbitmq() {
-		return newRabbitEndpoint()
+		return newRabbitEndpoint(cfg)
 	}
 
 	if cfg.IsKafka() {
-		return newKafkaEndpoint()
+		return newKafkaEndpoint(cfg)
 	}
 
 	if cfg.IsEls() {
 		if cfg.ElsVersion == 6 {
-			return newElastic6Endpoint()
+			return newElastic6Endpoint(cfg)
 		}
 		if cfg.ElsVersion == 7 {
-			return newElastic7Endpoint()
+			return newElastic7Endpoint(cfg)
 		}
 	}
 
@@ -87,6 +103,98 @@ func NewEndpoint(ds *canal.Canal) Endpoint {
 	return nil
 }
 
+// NewRowRequests 将canal的行事件转换为请求，posName为事件所在的binlog文件；表没有对应的规则时返回nil
+func NewRowRequests(cfg *global.Config, e *canal.RowsEvent, posName string) []*model.RowRequest {
+	rule, ok := global.RuleIns(cfg.RuleKey(e.Table.Schema, e.Table.Name))
+	if !ok {
+		return nil
+	}
+	return newRuleRowRequests(cfg, rule, e, posName)
+}
+
+// newRuleRowRequests 按照指定的规则转换行事件
+func newRuleRowRequests(cfg *global.Config, rule *global.Rule, e *canal.RowsEvent, posName string) []*model.RowRequest {
+	ruleKey := cfg.RuleKey(e.Table.Schema, e.Table.Name)
+	var requests []*model.RowRequest
+	if e.Action != canal.UpdateAction {
+		// 定长分配
+		requests = make([]*model.RowRequest, 0, len(e.Rows))
+	}
+
+	if e.Action == canal.UpdateAction {
+		for i := 0; i < len(e.Rows); i++ {
+			if (i+1)%2 == 0 {
+				if !MatchFilter(rule, e.Action, e.Rows[i], e.Rows[i-1]) {
+					continue
+				}
+				if !watchedChanged(rule, e.Rows[i-1], e.Rows[i]) {
+					continue
+				}
+				v := new(model.RowRequest)
+				v.RuleKey = ruleKey
+				v.Action = e.Action
+				v.Timestamp = e.Header.Timestamp
+				v.ServerId = e.Header.ServerID
+				v.PosName = posName
+				v.Pos = e.Header.LogPos
+				v.RowIndex = i / 2
+				if cfg.IsReserveRawData() || rule.ChangedColumnsOnly {
+					v.Old = e.Rows[i-1]
+				}
+				v.Row = e.Rows[i]
+				requests = append(requests, v)
+			}
+		}
+	} else {
+		for i, row := range e.Rows {
+			if !MatchFilter(rule, e.Action, row, nil) {
+				continue
+			}
+			v := new(model.RowRequest)
+			v.RuleKey = ruleKey
+			v.Action = e.Action
+			v.Timestamp = e.Header.Timestamp
+			v.ServerId = e.Header.ServerID
+			v.PosName = posName
+			v.Pos = e.Header.LogPos
+			v.RowIndex = i
+			v.Row = row
+			requests = append(requests, v)
+		}
+	}
+
+	return requests
+}
+
+// rowRule 行数据或DDL的规则；落后目标追赶时表可能已经在主流程中被删除，使用移除前的规则
+func rowRule(ruleKey string) (*global.Rule, bool) {
+	if rule, ok := global.RuleIns(ruleKey); ok {
+		return rule, true
+	}
+	return global.RetiredRuleIns(ruleKey)
+}
+
+// MatchFilter 行是否满足规则的过滤条件，没有配置filter时总是满足；old只在update时有值
+func MatchFilter(rule *global.Rule, action string, row, old []interface{}) bool {
+	if rule.FilterExpr == nil {
+		return true
+	}
+	return rule.FilterExpr.Eval(func(ident string) interface{} {
+		if ident == global.FilterIdentAction {
+			return action
+		}
+		isOld, index := rule.FilterColumn(ident)
+		values := row
+		if isOld {
+			values = old
+		}
+		if index < 0 || index >= len(values) {
+			return nil
+		}
+		return convertColumnData(values[index], &rule.TableInfo.Columns[index], rule)
+	})
+}
+
 func convertColumnData(value interface{}, col *schema.TableColumn, rule *global.Rule) interface{} {
 	if value == nil {
 		return nil
@@ -271,16 +379,75 @@ func rowMap(req *model.RowRequest, rule *global.Rule, primitive bool) map[string
 
 	if primitive {
 		for _, padding := range rule.PaddingMap {
-			kv[padding.ColumnName] = convertColumnData(req.Row[padding.ColumnIndex], padding.ColumnMetadata, rule)
+			if skipPadding(req, padding, rule) {
+				continue
+			}
+			kv[padding.ColumnName] = paddingValue(req.Row, padding, rule)
 		}
 	} else {
 		for _, padding := range rule.PaddingMap {
-			kv[padding.WrapName] = convertColumnData(req.Row[padding.ColumnIndex], padding.ColumnMetadata, rule)
+			if skipPadding(req, padding, rule) {
+				continue
+			}
+			kv[padding.WrapName] = paddingValue(req.Row, padding, rule)
 		}
 	}
 	return kv
 }
 
+// watchedChanged update时关注的列是否有变化，没有配置watch_columns时总是同步
+func watchedChanged(rule *global.Rule, old, row []interface{}) bool {
+	if len(rule.WatchColumnIndexs) == 0 {
+		return true
+	}
+	for _, index := range rule.WatchColumnIndexs {
+		if columnChanged(old, row, index) {
+			return true
+		}
+	}
+	return false
+}
+
+func columnChanged(old, row []interface{}, index int) bool {
+	if index >= len(old) || index >= len(row) {
+		return true
+	}
+	return !reflect.DeepEqual(old[index], row[index])
+}
+
+// skipPadding changed_columns_only时update只保留变化的列和主键
+func skipPadding(req *model.RowRequest, padding *model.Padding, rule *global.Rule) bool {
+	if !rule.ChangedColumnsOnly || req.Action != canal.UpdateAction || req.Old == nil {
+		return false
+	}
+	return !rule.IsPKColumn(padding.ColumnIndex) && !columnChanged(req.Old, req.Row, padding.ColumnIndex)
+}
+
+// paddingValue 转换列的数据类型，再按照规则的column_transforms转换列值
+func paddingValue(row []interface{}, padding *model.Padding, rule *global.Rule) interface{} {
+	value := convertColumnData(row[padding.ColumnIndex], padding.ColumnMetadata, rule)
+	if padding.Transform != nil {
+		return padding.Transform(value)
+	}
+	return value
+}
+
+// columnValue 按照column_transforms转换后的列值，与消息体中的值一致；列没有包含在消息中时也会转换
+func columnValue(row []interface{}, index int, rule *global.Rule) interface{} {
+	for _, padding := range rule.PaddingMap {
+		if padding.ColumnIndex == index {
+			return paddingValue(row, padding, rule)
+		}
+	}
+
+	column := rule.TableInfo.Columns[index]
+	value := convertColumnData(row[index], &column, rule)
+	if t, ok := rule.ColumnTransformMap[index]; ok {
+		return t.Apply(value)
+	}
+	return value
+}
+
 func oldRowMap(req *model.RowRequest, rule *global.Rule, primitive bool) map[string]interface{} {
 	kv := make(map[string]interface{}, len(rule.PaddingMap))
 
@@ -296,11 +463,17 @@ func oldRowMap(req *model.RowRequest, rule *global.Rule, primitive bool) map[str
 
 	if primitive {
 		for _, padding := range rule.PaddingMap {
-			kv[padding.ColumnName] = convertColumnData(req.Old[padding.ColumnIndex], padding.ColumnMetadata, rule)
+			if skipPadding(req, padding, rule) {
+				continue
+			}
+			kv[padding.ColumnName] = paddingValue(req.Old, padding, rule)
 		}
 	} else {
 		for _, padding := range rule.PaddingMap {
-			kv[padding.WrapName] = convertColumnData(req.Old[padding.ColumnIndex], padding.ColumnMetadata, rule)
+			if skipPadding(req, padding, rule) {
+				continue
+			}
+			kv[padding.WrapName] = paddingValue(req.Old, padding, rule)
 		}
 	}
 	return kv
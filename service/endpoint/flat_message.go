@@ -0,0 +1,216 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/stringutil"
+)
+
+// java.sql.Types
+const (
+	_sqlTypeBit       = -7
+	_sqlTypeTinyint   = -6
+	_sqlTypeSmallint  = 5
+	_sqlTypeInteger   = 4
+	_sqlTypeBigint    = -5
+	_sqlTypeReal      = 7
+	_sqlTypeDouble    = 8
+	_sqlTypeDecimal   = 3
+	_sqlTypeChar      = 1
+	_sqlTypeVarchar   = 12
+	_sqlTypeDate      = 91
+	_sqlTypeTime      = 92
+	_sqlTypeTimestamp = 93
+	_sqlTypeBinary    = -2
+	_sqlTypeVarbinary = -3
+	_sqlTypeBlob      = 2004
+	_sqlTypeClob      = 2005
+)
+
+// flatMessage 与Canal的FlatMessage格式一致，列值均为字符串
+type flatMessage struct {
+	Id        int64                `json:"id"` // binlog事件的位置，同一个事件的行相同
+	Database  string               `json:"database"`
+	Table     string               `json:"table"`
+	PkNames   []string             `json:"pkNames"`
+	IsDdl     bool                 `json:"isDdl"`
+	Type      string               `json:"type"` // INSERT、UPDATE、DELETE、CREATE、ALTER、ERASE、RENAME、TRUNCATE
+	Es        int64                `json:"es"`   // binlog事件的时间，毫秒
+	Ts        int64                `json:"ts"`   // 消息的生成时间，毫秒
+	Sql       string               `json:"sql"`
+	SqlType   map[string]int       `json:"sqlType"`
+	MysqlType map[string]string    `json:"mysqlType"`
+	Data      []map[string]*string `json:"data"`
+	Old       []map[string]*string `json:"old"` // update时变化的列在变化之前的值
+}
+
+func newFlatMessage(row *model.RowRequest, rule *global.Rule) *flatMessage {
+	msg := &flatMessage{
+		Id:        flatMessageId(row.PosName, row.Pos),
+		Database:  rule.Schema,
+		Table:     rule.Table,
+		PkNames:   make([]string, 0, len(rule.TableInfo.PKColumns)),
+		Type:      strings.ToUpper(row.Action),
+		Es:        int64(row.Timestamp) * 1000,
+		Ts:        time.Now().UnixNano() / int64(time.Millisecond),
+		SqlType:   make(map[string]int, len(rule.PaddingMap)),
+		MysqlType: make(map[string]string, len(rule.PaddingMap)),
+	}
+
+	data := make(map[string]*string, len(rule.PaddingMap))
+	var old map[string]*string
+	if row.Action == canal.UpdateAction && row.Old != nil {
+		old = make(map[string]*string)
+	}
+
+	for k, v := range rule.DefaultColumnValueMap {
+		name := rule.WrapName(k)
+		data[name] = flatValue(v)
+		msg.SqlType[name] = _sqlTypeVarchar
+		msg.MysqlType[name] = "varchar"
+	}
+
+	for _, padding := range rule.PaddingMap {
+		if skipPadding(row, padding, rule) {
+			continue
+		}
+		data[padding.WrapName] = flatValue(paddingValue(row.Row, padding, rule))
+		msg.SqlType[padding.WrapName] = flatSqlType(padding.ColumnMetadata.RawType)
+		msg.MysqlType[padding.WrapName] = padding.ColumnMetadata.RawType
+		if old != nil && columnChanged(row.Old, row.Row, padding.ColumnIndex) {
+			old[padding.WrapName] = flatValue(paddingValue(row.Old, padding, rule))
+		}
+	}
+
+	for _, index := range rule.TableInfo.PKColumns {
+		for _, padding := range rule.PaddingMap {
+			if padding.ColumnIndex == index {
+				msg.PkNames = append(msg.PkNames, padding.WrapName)
+				break
+			}
+		}
+	}
+
+	msg.Data = []map[string]*string{data}
+	if old != nil {
+		msg.Old = []map[string]*string{old}
+	}
+	return msg
+}
+
+// newDDLFlatMessage DDL的FlatMessage，data、old为空
+func newDDLFlatMessage(ddl *model.DDLRequest) *flatMessage {
+	typ := strings.ToUpper(ddl.Type)
+	if ddl.Type == model.DDLDrop {
+		typ = "ERASE"
+	}
+	return &flatMessage{
+		Id:       flatMessageId(ddl.PosName, ddl.Pos),
+		Database: ddl.Schema,
+		Table:    ddl.Table,
+		IsDdl:    true,
+		Type:     typ,
+		Es:       int64(ddl.Timestamp) * 1000,
+		Ts:       time.Now().UnixNano() / int64(time.Millisecond),
+		Sql:      ddl.Query,
+	}
+}
+
+// flatMessageId binlog文件的序号在高32位，事件的位置在低32位，重放时不变；全量导入的数据没有位置，为0
+func flatMessageId(posName string, pos uint32) int64 {
+	index, ok := model.BinlogIndex(posName)
+	if !ok {
+		return 0
+	}
+	return int64(index<<32 | uint64(pos))
+}
+
+func flatValue(v interface{}) *string {
+	if v == nil {
+		return nil
+	}
+	s := stringutil.ToString(v)
+	return &s
+}
+
+// flatSqlType 按照MySQL的列类型转换为java.sql.Types
+func flatSqlType(rawType string) int {
+	raw := strings.ToLower(rawType)
+	unsigned := strings.Contains(raw, "unsigned")
+	if i := strings.IndexAny(raw, "( "); i > 0 {
+		raw = raw[:i]
+	}
+
+	switch raw {
+	case "bit":
+		return _sqlTypeBit
+	case "tinyint":
+		if unsigned {
+			return _sqlTypeSmallint
+		}
+		return _sqlTypeTinyint
+	case "smallint":
+		if unsigned {
+			return _sqlTypeInteger
+		}
+		return _sqlTypeSmallint
+	case "mediumint":
+		return _sqlTypeInteger
+	case "int", "integer":
+		if unsigned {
+			return _sqlTypeBigint
+		}
+		return _sqlTypeInteger
+	case "bigint":
+		if unsigned {
+			return _sqlTypeDecimal
+		}
+		return _sqlTypeBigint
+	case "float":
+		return _sqlTypeReal
+	case "double", "real":
+		return _sqlTypeDouble
+	case "decimal", "numeric":
+		return _sqlTypeDecimal
+	case "char", "enum", "set":
+		return _sqlTypeChar
+	case "date":
+		return _sqlTypeDate
+	case "time":
+		return _sqlTypeTime
+	case "datetime", "timestamp":
+		return _sqlTypeTimestamp
+	case "binary":
+		return _sqlTypeBinary
+	case "varbinary":
+		return _sqlTypeVarbinary
+	case "tinyblob", "blob", "mediumblob", "longblob":
+		return _sqlTypeBlob
+	case "tinytext", "text", "mediumtext", "longtext":
+		return _sqlTypeClob
+	default: // varchar、year、json等
+		return _sqlTypeVarchar
+	}
+}
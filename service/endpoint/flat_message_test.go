@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestFlatSqlType(t *testing.T) {
+	cases := map[string]int{
+		"bigint(20)":          _sqlTypeBigint,
+		"bigint(20) unsigned": _sqlTypeDecimal,
+		"int(11)":             _sqlTypeInteger,
+		"int(10) unsigned":    _sqlTypeBigint,
+		"tinyint(1)":          _sqlTypeTinyint,
+		"decimal(10,2)":       _sqlTypeDecimal,
+		"varchar(64)":         _sqlTypeVarchar,
+		"datetime":            _sqlTypeTimestamp,
+		"longtext":            _sqlTypeClob,
+		"json":                _sqlTypeVarchar,
+	}
+	for raw, expect := range cases {
+		if got := flatSqlType(raw); got != expect {
+			t.Fatalf("%s expect %d, got %d", raw, expect, got)
+		}
+	}
+}
+
+func TestNewFlatMessage(t *testing.T) {
+	table := &schema.Table{Schema: "eseap", Name: "t_user", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint(20)", "", "")
+	table.AddColumn("name", "varchar(20)", "", "")
+	table.AddColumn("age", "int(11)", "", "")
+	rule := &global.Rule{Schema: "eseap", Table: "t_user", TableInfo: table, PaddingMap: map[string]*model.Padding{}}
+	for i := range table.Columns {
+		c := &table.Columns[i]
+		rule.PaddingMap[c.Name] = &model.Padding{WrapName: c.Name, ColumnName: c.Name, ColumnIndex: i, ColumnType: c.Type, ColumnMetadata: c}
+	}
+
+	row := &model.RowRequest{
+		Action:    canal.UpdateAction,
+		Timestamp: 1600000000,
+		PosName:   "mysql-bin.000003",
+		Pos:       1200,
+		Old:       []interface{}{int64(1), "tom", nil},
+		Row:       []interface{}{int64(1), "jerry", nil},
+	}
+	msg := newFlatMessage(row, rule)
+	if msg.Type != "UPDATE" || msg.Es != 1600000000000 || msg.IsDdl || msg.Id != 3<<32|1200 {
+		t.Fatalf("unexpected header %+v", msg)
+	}
+	if len(msg.PkNames) != 1 || msg.PkNames[0] != "id" {
+		t.Fatalf("unexpected pkNames %v", msg.PkNames)
+	}
+	if msg.MysqlType["name"] != "varchar(20)" || msg.SqlType["id"] != _sqlTypeBigint {
+		t.Fatalf("unexpected types %v %v", msg.MysqlType, msg.SqlType)
+	}
+
+	data := msg.Data[0]
+	if *data["id"] != "1" || *data["name"] != "jerry" || data["age"] != nil {
+		t.Fatalf("unexpected data %v", data)
+	}
+	old := msg.Old[0]
+	if len(old) != 1 || *old["name"] != "tom" {
+		t.Fatalf("old should only contain changed columns, got %v", old)
+	}
+}
+
+func TestNewDDLFlatMessage(t *testing.T) {
+	ddl := &model.DDLRequest{
+		Type:      model.DDLDrop,
+		Schema:    "eseap",
+		Table:     "t_user",
+		Query:     "drop table t_user",
+		PosName:   "mysql-bin.000003",
+		Pos:       1500,
+		Timestamp: 1600000000,
+	}
+	// es为事件的时间，不是消息的生成时间
+	msg := newDDLFlatMessage(ddl)
+	if msg.Type != "ERASE" || !msg.IsDdl || msg.Es != 1600000000000 || msg.Ts <= msg.Es {
+		t.Fatalf("unexpected header %+v", msg)
+	}
+	if msg.Id != 3<<32|1500 {
+		t.Fatalf("unexpected id %d", msg.Id)
+	}
+	if id := flatMessageId("", 0); id != 0 {
+		t.Fatalf("dumped rows expect id 0, got %d", id)
+	}
+}
@@ -18,6 +18,7 @@
 package endpoint
 
 import (
+	"bytes"
 	"github.com/siddontang/go-mysql/canal"
 	"log"
 	"strings"
@@ -31,39 +32,84 @@ import (
 	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/service/luaengine"
+	"go-mysql-transfer/util/kafkas"
 	"go-mysql-transfer/util/logs"
+	"go-mysql-transfer/util/stringutil"
 )
 
 type KafkaEndpoint struct {
-	client   sarama.Client
-	producer sarama.AsyncProducer
+	cfg          *global.Config
+	client       sarama.Client
+	producer     sarama.AsyncProducer
+	syncProducer sarama.SyncProducer // kafka_delivery不为async时使用
+
+	txnLock sync.Mutex
+	mark    *kafkaMark // kafka_delivery为exactly_once时最后提交的位置
+	marked  bool       // mark是否与位置topic一致
 
 	retryLock sync.Mutex
 }
 
-func newKafkaEndpoint() *KafkaEndpoint {
+func newKafkaEndpoint(cfg *global.Config) *KafkaEndpoint {
 	r := &KafkaEndpoint{}
+	r.cfg = cfg
 	return r
 }
 
 func (s *KafkaEndpoint) Connect() error {
 	cfg := sarama.NewConfig()
-	cfg.Producer.Partitioner = sarama.NewRandomPartitioner
+	cfg.Producer.Partitioner = newKafkaPartitioner
+	cfg.Version = sarama.V0_11_0_0
+	if s.cfg.KafkaVersion != "" {
+		version, err := sarama.ParseKafkaVersion(s.cfg.KafkaVersion)
+		if err != nil {
+			return errors.Errorf("invalid kafka_version: %s", s.cfg.KafkaVersion)
+		}
+		cfg.Version = version
+	}
 
-	if global.Cfg().KafkaSASLUser != "" && global.Cfg().KafkaSASLPassword != "" {
-		cfg.Net.SASL.Enable = true
-		cfg.Net.SASL.User = global.Cfg().KafkaSASLUser
-		cfg.Net.SASL.Password = global.Cfg().KafkaSASLPassword
+	synchronous := s.cfg.KafkaDelivery != "" && s.cfg.KafkaDelivery != global.KafkaDeliveryAsync
+	if synchronous {
+		cfg.Producer.Return.Successes = true
+		cfg.Producer.RequiredAcks = sarama.WaitForAll
+		if s.cfg.KafkaDelivery != global.KafkaDeliverySync {
+			cfg.Producer.Idempotent = true
+			cfg.Net.MaxOpenRequests = 1
+		}
+		if s.cfg.KafkaDelivery == global.KafkaDeliveryExactlyOnce {
+			cfg.Producer.Transaction.ID = s.cfg.KafkaTransactionalId
+			cfg.Consumer.IsolationLevel = sarama.ReadCommitted
+		}
+	}
+
+	if err := kafkas.Apply(cfg, s.cfg.KafkaSecurity()); err != nil {
+		return errors.Errorf("invalid kafka security config: %q", err)
 	}
 
 	var err error
 	var client sarama.Client
-	ls := strings.Split(global.Cfg().KafkaAddr, ",")
+	ls := strings.Split(s.cfg.KafkaAddr, ",")
 	client, err = sarama.NewClient(ls, cfg)
 	if err != nil {
 		return errors.Errorf("unable to create kafka client: %q", err)
 	}
 
+	if synchronous {
+		var producer sarama.SyncProducer
+		producer, err = sarama.NewSyncProducerFromClient(client)
+		if err != nil {
+			return errors.Errorf("unable to create kafka producer: %q", err)
+		}
+		s.syncProducer = producer
+		s.client = client
+		if s.cfg.KafkaDelivery == global.KafkaDeliveryExactlyOnce {
+			s.marked = false
+			_, err = s.committed()
+			return err
+		}
+		return nil
+	}
+
 	var producer sarama.AsyncProducer
 	producer, err = sarama.NewAsyncProducerFromClient(client)
 	if err != nil {
@@ -81,9 +127,17 @@ func (s *KafkaEndpoint) Ping() error {
 }
 
 func (s *KafkaEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	mark := rowsMark(rows)
+	if s.cfg.KafkaDelivery == global.KafkaDeliveryExactlyOnce {
+		var err error
+		if rows, err = s.uncommitted(rows); err != nil {
+			return err
+		}
+	}
+
 	var ms []*sarama.ProducerMessage
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -107,13 +161,8 @@ func (s *KafkaEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 		}
 	}
 
-	for _, m := range ms {
-		s.producer.Input() <- m
-		select {
-		case err := <-s.producer.Errors():
-			return err
-		default:
-		}
+	if err := s.send(ms, mark); err != nil {
+		return err
 	}
 
 	logs.Infof("处理完成 %d 条数据", len(rows))
@@ -121,9 +170,9 @@ func (s *KafkaEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 }
 
 func (s *KafkaEndpoint) Stock(rows []*model.RowRequest) int64 {
-	expect := true
+	var ms []*sarama.ProducerMessage
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -133,46 +182,51 @@ func (s *KafkaEndpoint) Stock(rows []*model.RowRequest) int64 {
 			ls, err := s.buildMessages(row, rule)
 			if err != nil {
 				logs.Errorf(errors.ErrorStack(err))
-				expect = false
-				break
-			}
-			for _, m := range ls {
-				s.producer.Input() <- m
-				select {
-				case err := <-s.producer.Errors():
-					logs.Error(err.Error())
-					expect = false
-					break
-				default:
-				}
-			}
-			if !expect {
-				break
+				return 0
 			}
+			ms = append(ms, ls...)
 		} else {
 			m, err := s.buildMessage(row, rule)
 			if err != nil {
 				logs.Errorf(errors.ErrorStack(err))
-				expect = false
-				break
+				return 0
 			}
+			ms = append(ms, m)
+		}
+	}
+
+	if err := s.send(ms, nil); err != nil {
+		logs.Error(err.Error())
+		return 0
+	}
+
+	return int64(len(rows))
+}
+
+// send 异步模式下只检查已经返回的错误；其他模式下等待批次中的消息全部写入，失败时返回错误，位点不会前进；
+// exactly_once时批次的消息和mark在一个事务中提交
+func (s *KafkaEndpoint) send(ms []*sarama.ProducerMessage, mark *kafkaMark) error {
+	if s.syncProducer == nil {
+		for _, m := range ms {
 			s.producer.Input() <- m
 			select {
 			case err := <-s.producer.Errors():
-				logs.Error(err.Error())
-				expect = false
-				break
+				return err
 			default:
-
 			}
 		}
+		return nil
 	}
 
-	if !expect {
-		return 0
+	if s.cfg.KafkaDelivery == global.KafkaDeliveryExactlyOnce {
+		return s.sendTxn(ms, mark)
+	}
+	if len(ms) == 0 {
+		return nil
 	}
 
-	return int64(len(rows))
+	// 批次中的部分消息可能已经写入，重试时会重复发送，消费端可以按照消息头binlog_file、binlog_pos、binlog_row去重
+	return s.syncProducer.SendMessages(ms)
 }
 
 func (s *KafkaEndpoint) buildMessages(row *model.RowRequest, rule *global.Rule) ([]*sarama.ProducerMessage, error) {
@@ -195,6 +249,11 @@ func (s *KafkaEndpoint) buildMessages(row *model.RowRequest, rule *global.Rule)
 			Topic: resp.Topic,
 			Value: sarama.ByteEncoder(resp.ByteArray),
 		}
+		s.route(m, row, rule)
+		if resp.Key != "" {
+			m.Key = sarama.StringEncoder(resp.Key)
+		}
+		m.Headers = kafkaHeaders(messageHeaders(row, rule, resp.Headers))
 		logs.Infof("topic: %s, message: %s", resp.Topic, string(resp.ByteArray))
 		ms = append(ms, m)
 	}
@@ -203,37 +262,136 @@ func (s *KafkaEndpoint) buildMessages(row *model.RowRequest, rule *global.Rule)
 }
 
 func (s *KafkaEndpoint) buildMessage(row *model.RowRequest, rule *global.Rule) (*sarama.ProducerMessage, error) {
-	kvm := rowMap(row, rule, false)
-	resp := new(model.MQRespond)
-	resp.Action = row.Action
-	resp.Timestamp = row.Timestamp
-	if rule.ValueEncoder == global.ValEncoderJson {
-		resp.Date = kvm
-	} else {
-		resp.Date = encodeValue(rule, kvm)
+	body, err := encodeMessage(s.cfg, row, rule, rule.KafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+	m := &sarama.ProducerMessage{
+		Topic:   rule.KafkaTopic,
+		Value:   sarama.ByteEncoder(body),
+		Headers: kafkaHeaders(messageHeaders(row, rule, nil)),
 	}
+	s.route(m, row, rule)
+	logs.Infof("topic: %s, message: %s", rule.KafkaTopic, string(body))
+	return m, nil
+}
 
-	if rule.ReserveRawData && canal.UpdateAction == row.Action {
-		resp.Raw = oldRowMap(row, rule, false)
+// route 设置消息的key和分区，相同key的消息发送到同一个分区，保证同一行的变更有序
+func (s *KafkaEndpoint) route(m *sarama.ProducerMessage, row *model.RowRequest, rule *global.Rule) {
+	if key := s.encodeKey(row, rule); key != "" {
+		m.Key = sarama.StringEncoder(key)
+	}
+	if rule.KafkaPartition != nil {
+		m.Partition = *rule.KafkaPartition
+		m.Metadata = _kafkaManualPartition
+	}
+}
+
+// encodeKey 依次使用kafka_key_formatter、kafka_key_column、主键；
+// 与RabbitMQ的routing key一致，使用column_transforms转换后的列值，避免明文出现在key中
+func (s *KafkaEndpoint) encodeKey(row *model.RowRequest, rule *global.Rule) string {
+	if rule.KafkaKeyTmpl != nil {
+		var tmplBytes bytes.Buffer
+		if err := rule.KafkaKeyTmpl.Execute(&tmplBytes, rowMap(row, rule, true)); err != nil {
+			logs.Errorf("rule %s execute kafka_key_formatter err %s", row.RuleKey, err.Error())
+			return ""
+		}
+		return tmplBytes.String()
+	}
+
+	if rule.KafkaKeyColumnIndex >= 0 {
+		return stringutil.ToString(columnValue(row.Row, rule.KafkaKeyColumnIndex, rule))
+	}
+
+	var key string
+	for _, index := range rule.TableInfo.PKColumns {
+		key += stringutil.ToString(columnValue(row.Row, index, rule))
+	}
+	return key
+}
+
+func kafkaHeaders(headers []messageHeader) []sarama.RecordHeader {
+	ls := make([]sarama.RecordHeader, 0, len(headers))
+	for _, h := range headers {
+		ls = append(ls, sarama.RecordHeader{Key: []byte(h.key), Value: []byte(h.value)})
+	}
+	return ls
+}
+
+// ConsumeDDL 表结构变更作为消息发送到表对应的topic
+func (s *KafkaEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	rule, ok := ddlRule(ddl)
+	if !ok {
+		return nil
+	}
+
+	var mark *kafkaMark
+	if s.cfg.KafkaDelivery == global.KafkaDeliveryExactlyOnce {
+		committed, err := s.committed()
+		if err != nil {
+			return err
+		}
+		if committed.covers(ddl.PosName, ddl.Pos, 0) {
+			logs.Infof("skip ddl committed before %s %d", committed.Name, committed.Pos)
+			return nil
+		}
+		mark = &kafkaMark{Name: ddl.PosName, Pos: ddl.Pos}
 	}
 
-	body, err := json.Marshal(resp)
+	body, err := encodeDDLMessage(ddl, rule)
 	if err != nil {
-		return nil, err
+		return errors.Trace(err)
 	}
 	m := &sarama.ProducerMessage{
-		Topic: rule.KafkaTopic,
-		Value: sarama.ByteEncoder(body),
+		Topic:   rule.KafkaTopic,
+		Value:   sarama.ByteEncoder(body),
+		Headers: kafkaHeaders(ddlHeaders(ddl, rule)),
 	}
+	if err := s.send([]*sarama.ProducerMessage{m}, mark); err != nil {
+		return err
+	}
+
 	logs.Infof("topic: %s, message: %s", rule.KafkaTopic, string(body))
-	return m, nil
+	return nil
 }
 
 func (s *KafkaEndpoint) Close() {
 	if s.producer != nil {
 		s.producer.Close()
 	}
+	if s.syncProducer != nil {
+		s.syncProducer.Close()
+	}
 	if s.client != nil {
 		s.client.Close()
 	}
 }
+
+type kafkaManualPartition struct{}
+
+var _kafkaManualPartition = kafkaManualPartition{}
+
+// kafkaPartitioner 配置了kafka_partition的消息发送到指定分区，其他消息按照key的哈希值选择分区，没有key时随机选择
+type kafkaPartitioner struct {
+	hash sarama.Partitioner
+}
+
+func newKafkaPartitioner(topic string) sarama.Partitioner {
+	return &kafkaPartitioner{
+		hash: sarama.NewHashPartitioner(topic),
+	}
+}
+
+func (p *kafkaPartitioner) Partition(message *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if message.Metadata == _kafkaManualPartition {
+		if message.Partition >= numPartitions {
+			return -1, sarama.ErrInvalidPartition
+		}
+		return message.Partition, nil
+	}
+	return p.hash.Partition(message, numPartitions)
+}
+
+func (p *kafkaPartitioner) RequiresConsistency() bool {
+	return true
+}
@@ -0,0 +1,68 @@
+package endpoint
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/Shopify/sarama"
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestKafkaRoute(t *testing.T) {
+	rule := newCodecTestRule(global.ValEncoderJson, "id", "name")
+	rule.KafkaKeyColumnIndex = -1
+	row := &model.RowRequest{Action: canal.UpdateAction, Row: []interface{}{int64(7), "tom"}}
+	s := &KafkaEndpoint{}
+
+	m := &sarama.ProducerMessage{}
+	s.route(m, row, rule)
+	if key, _ := m.Key.Encode(); string(key) != "7" || m.Metadata != nil {
+		t.Fatalf("expect primary key 7, got %s", key)
+	}
+
+	rule.KafkaKeyColumnIndex = 1
+	m = &sarama.ProducerMessage{}
+	s.route(m, row, rule)
+	if key, _ := m.Key.Encode(); string(key) != "tom" {
+		t.Fatalf("expect key column tom, got %s", key)
+	}
+
+	// key使用转换后的列值
+	truncate := &global.ColumnTransform{Column: "name", Type: global.TransformTruncate, Length: 2}
+	rule.PaddingMap["name"].Transform = truncate.Apply
+	m = &sarama.ProducerMessage{}
+	s.route(m, row, rule)
+	if key, _ := m.Key.Encode(); string(key) != "to" {
+		t.Fatalf("expect transformed key to, got %s", key)
+	}
+	rule.PaddingMap["name"].Transform = nil
+
+	rule.KafkaKeyTmpl = template.Must(template.New("key").Parse("{{.name}}-{{.id}}"))
+	partition := int32(2)
+	rule.KafkaPartition = &partition
+	m = &sarama.ProducerMessage{}
+	s.route(m, row, rule)
+	if key, _ := m.Key.Encode(); string(key) != "tom-7" {
+		t.Fatalf("expect formatted key tom-7, got %s", key)
+	}
+
+	p := newKafkaPartitioner("t_user")
+	if got, err := p.Partition(m, 4); err != nil || got != 2 {
+		t.Fatalf("expect manual partition 2, got %d %v", got, err)
+	}
+	if _, err := p.Partition(m, 2); err != sarama.ErrInvalidPartition {
+		t.Fatalf("expect invalid partition, got %v", err)
+	}
+
+	// 相同key的消息总是发送到同一个分区
+	a := &sarama.ProducerMessage{Key: sarama.StringEncoder("7")}
+	b := &sarama.ProducerMessage{Key: sarama.StringEncoder("7")}
+	pa, _ := p.Partition(a, 8)
+	pb, _ := p.Partition(b, 8)
+	if pa != pb {
+		t.Fatalf("same key routed to partition %d and %d", pa, pb)
+	}
+}
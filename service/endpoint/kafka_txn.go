@@ -0,0 +1,237 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+const (
+	_kafkaMarkWindow  = 100             // 每次向前读取位置topic的消息数
+	_kafkaMarkTimeout = 3 * time.Second // 等待位置消息的时间，分区末尾可能是事务的控制消息或被放弃的消息
+)
+
+// kafkaMark exactly_once时最后提交的数据在binlog中的位置，与批次的消息在同一个kafka事务中写入位置topic；
+// 重启或者批次重试时从保存的位点重放，位置不在mark之后的数据已经提交，不再发送
+type kafkaMark struct {
+	Name string `json:"name"`
+	Pos  uint32 `json:"pos"`
+	Row  int    `json:"row"`
+}
+
+// covers 数据是否已经提交，全量导入的数据没有位置
+func (m *kafkaMark) covers(name string, pos uint32, row int) bool {
+	if m == nil || name == "" {
+		return false
+	}
+	if c := model.ComparePosition(mysql.Position{Name: name, Pos: pos}, mysql.Position{Name: m.Name, Pos: m.Pos}); c != 0 {
+		return c < 0
+	}
+	return row <= m.Row
+}
+
+func (m *kafkaMark) position() (string, uint32, int) {
+	if m == nil {
+		return "", 0, 0
+	}
+	return m.Name, m.Pos, m.Row
+}
+
+// rowsMark 批次中最后一条增量数据的位置
+func rowsMark(rows []*model.RowRequest) *kafkaMark {
+	for i := len(rows) - 1; i >= 0; i-- {
+		if rows[i].PosName != "" {
+			return &kafkaMark{Name: rows[i].PosName, Pos: rows[i].Pos, Row: rows[i].RowIndex}
+		}
+	}
+	return nil
+}
+
+// uncommitted 过滤已经提交的行
+func (s *KafkaEndpoint) uncommitted(rows []*model.RowRequest) ([]*model.RowRequest, error) {
+	mark, err := s.committed()
+	if err != nil || mark == nil {
+		return rows, err
+	}
+	ls := make([]*model.RowRequest, 0, len(rows))
+	for _, row := range rows {
+		if !mark.covers(row.PosName, row.Pos, row.RowIndex) {
+			ls = append(ls, row)
+		}
+	}
+	if skipped := len(rows) - len(ls); skipped > 0 {
+		logs.Infof("skip %d rows committed before %s %d", skipped, mark.Name, mark.Pos)
+	}
+	return ls, nil
+}
+
+// sendTxn 在一个事务中发送批次的消息及批次的位置，提交成功后更新mark
+func (s *KafkaEndpoint) sendTxn(ms []*sarama.ProducerMessage, mark *kafkaMark) error {
+	s.txnLock.Lock()
+	defer s.txnLock.Unlock()
+
+	// 重放的批次全部已经提交时不能让位置后退
+	if s.mark.covers(mark.position()) {
+		mark = nil
+	}
+	if mark != nil {
+		body, err := json.Marshal(mark)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ms = append(ms, &sarama.ProducerMessage{
+			Topic:     s.cfg.KafkaPositionTopic,
+			Key:       sarama.StringEncoder(s.cfg.KafkaTransactionalId),
+			Value:     sarama.ByteEncoder(body),
+			Partition: 0,
+			Metadata:  _kafkaManualPartition,
+		})
+	}
+	if len(ms) == 0 {
+		return nil
+	}
+
+	if err := s.syncProducer.BeginTxn(); err != nil {
+		return s.abortTxn(err)
+	}
+	if err := s.syncProducer.SendMessages(ms); err != nil {
+		return s.abortTxn(err)
+	}
+	if err := s.syncProducer.CommitTxn(); err != nil {
+		return s.abortTxn(err)
+	}
+	if mark != nil {
+		s.mark = mark
+	}
+	return nil
+}
+
+// abortTxn 放弃事务；提交失败时事务可能已经在broker上完成，下次发送前重新读取mark；
+// 生产者出现致命错误时重新创建，新的生产者使用相同的事务ID，会隔离旧的生产者
+func (s *KafkaEndpoint) abortTxn(cause error) error {
+	s.marked = false
+	status := s.syncProducer.TxnStatus()
+	if status&sarama.ProducerTxnFlagFatalError != 0 {
+		s.syncProducer.Close()
+		producer, err := sarama.NewSyncProducerFromClient(s.client)
+		if err != nil {
+			return errors.Annotatef(cause, "recreate kafka producer err %v", err)
+		}
+		s.syncProducer = producer
+		return cause
+	}
+	if status&(sarama.ProducerTxnFlagInTransaction|sarama.ProducerTxnFlagAbortableError) != 0 {
+		if err := s.syncProducer.AbortTxn(); err != nil {
+			logs.Errorf("abort kafka transaction err %v", err)
+		}
+	}
+	return cause
+}
+
+// committed 最后提交的位置，事务失败后重新读取
+func (s *KafkaEndpoint) committed() (*kafkaMark, error) {
+	s.txnLock.Lock()
+	defer s.txnLock.Unlock()
+
+	if s.marked {
+		return s.mark, nil
+	}
+	mark, err := s.loadMark()
+	if err != nil {
+		return nil, err
+	}
+	s.mark, s.marked = mark, true
+	if mark != nil {
+		logs.Infof("kafka transaction %s committed position %s %d %d", s.cfg.KafkaTransactionalId, mark.Name, mark.Pos, mark.Row)
+	}
+	return mark, nil
+}
+
+// loadMark 从后向前读取位置topic中本事务ID最后提交的位置；
+// 事务生产者初始化时broker已经放弃了上次未完成的事务，只读取已提交的消息
+func (s *KafkaEndpoint) loadMark() (*kafkaMark, error) {
+	topic := s.cfg.KafkaPositionTopic
+	newest, err := s.client.GetOffset(topic, 0, sarama.OffsetNewest)
+	if err == sarama.ErrUnknownTopicOrPartition {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	oldest, err := s.client.GetOffset(topic, 0, sarama.OffsetOldest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(s.client)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer consumer.Close()
+
+	for end := newest; end > oldest; {
+		start := end - _kafkaMarkWindow
+		if start < oldest {
+			start = oldest
+		}
+		mark, err := s.readMark(consumer, start, end)
+		if err != nil || mark != nil {
+			return mark, err
+		}
+		end = start
+	}
+	return nil, nil
+}
+
+// readMark 读取[start, end)之间本事务ID的最后一个位置
+func (s *KafkaEndpoint) readMark(consumer sarama.Consumer, start, end int64) (*kafkaMark, error) {
+	pc, err := consumer.ConsumePartition(s.cfg.KafkaPositionTopic, 0, start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer pc.Close()
+
+	var mark *kafkaMark
+	for {
+		select {
+		case m := <-pc.Messages():
+			if m.Offset >= end {
+				return mark, nil
+			}
+			if string(m.Key) == s.cfg.KafkaTransactionalId {
+				v := &kafkaMark{}
+				if err := json.Unmarshal(m.Value, v); err != nil {
+					return nil, errors.Annotatef(err, "decode position at offset %d", m.Offset)
+				}
+				mark = v
+			}
+			if m.Offset == end-1 {
+				return mark, nil
+			}
+		case <-time.After(_kafkaMarkTimeout):
+			return mark, nil
+		}
+	}
+}
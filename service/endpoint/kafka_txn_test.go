@@ -0,0 +1,135 @@
+package endpoint
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func newTxnTestProducer(t *testing.T) *mocks.SyncProducer {
+	cfg := sarama.NewConfig()
+	cfg.Version = sarama.V0_11_0_0
+	cfg.Producer.Partitioner = newKafkaPartitioner
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Idempotent = true
+	cfg.Producer.Transaction.ID = "transfer"
+	cfg.Net.MaxOpenRequests = 1
+	return mocks.NewSyncProducer(t, cfg)
+}
+
+func expectTopic(p *mocks.SyncProducer, topic string) {
+	p.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(m *sarama.ProducerMessage) error {
+		if m.Topic != topic {
+			return errors.Errorf("expect topic %s, got %s", topic, m.Topic)
+		}
+		return nil
+	})
+}
+
+func txnTestRow(name string, pos uint32, index int) *model.RowRequest {
+	return &model.RowRequest{PosName: name, Pos: pos, RowIndex: index}
+}
+
+func txnTestMessages(rows []*model.RowRequest) []*sarama.ProducerMessage {
+	ms := make([]*sarama.ProducerMessage, 0, len(rows))
+	for range rows {
+		ms = append(ms, &sarama.ProducerMessage{Topic: "t_user", Value: sarama.StringEncoder("{}")})
+	}
+	return ms
+}
+
+func TestKafkaExactlyOnce(t *testing.T) {
+	producer := newTxnTestProducer(t)
+	defer producer.Close()
+	s := &KafkaEndpoint{
+		cfg: &global.Config{
+			KafkaDelivery:        global.KafkaDeliveryExactlyOnce,
+			KafkaTransactionalId: "transfer",
+			KafkaPositionTopic:   "transfer_position",
+		},
+		syncProducer: producer,
+		mark:         &kafkaMark{Name: "mysql-bin.000009", Pos: 200, Row: 1},
+		marked:       true,
+	}
+
+	// 重放时跳过已经提交的行，批次的消息和位置在同一个事务中提交
+	rows := []*model.RowRequest{
+		txnTestRow("mysql-bin.000009", 100, 0),
+		txnTestRow("mysql-bin.000009", 200, 1),
+		txnTestRow("mysql-bin.000009", 200, 2),
+		txnTestRow("mysql-bin.000010", 4, 0),
+	}
+	pending, err := s.uncommitted(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0] != rows[2] || pending[1] != rows[3] {
+		t.Fatalf("expect 2 rows after mark, got %d", len(pending))
+	}
+	expectTopic(producer, "t_user")
+	expectTopic(producer, "t_user")
+	expectTopic(producer, "transfer_position")
+	if err := s.send(txnTestMessages(pending), rowsMark(rows)); err != nil {
+		t.Fatal(err)
+	}
+	if *s.mark != (kafkaMark{Name: "mysql-bin.000010", Pos: 4}) {
+		t.Fatalf("unexpected mark %+v", s.mark)
+	}
+	if producer.TxnStatus() != sarama.ProducerTxnFlagReady {
+		t.Fatalf("expect transaction committed, got %s", producer.TxnStatus())
+	}
+
+	// 整个批次都已经提交时不发送，位置不后退
+	pending, _ = s.uncommitted(rows[:2])
+	if err := s.send(txnTestMessages(pending), rowsMark(rows[:2])); err != nil {
+		t.Fatal(err)
+	}
+	if s.mark.Name != "mysql-bin.000010" {
+		t.Fatalf("mark should not go back, got %+v", s.mark)
+	}
+
+	// 事务失败时放弃事务，位置不变，下次发送前重新读取
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	producer.ExpectSendMessageAndSucceed()
+	rows = []*model.RowRequest{txnTestRow("mysql-bin.000010", 100, 0)}
+	if err := s.send(txnTestMessages(rows), rowsMark(rows)); err == nil {
+		t.Fatal("expect send error")
+	}
+	if s.marked || s.mark.Pos != 4 {
+		t.Fatalf("expect mark reloaded after abort, got %+v %v", s.mark, s.marked)
+	}
+	if producer.TxnStatus() != sarama.ProducerTxnFlagReady {
+		t.Fatalf("expect transaction aborted, got %s", producer.TxnStatus())
+	}
+}
+
+func TestKafkaMarkCovers(t *testing.T) {
+	mark := &kafkaMark{Name: "mysql-bin.999999", Pos: 200, Row: 1}
+	cases := []struct {
+		name   string
+		pos    uint32
+		row    int
+		expect bool
+	}{
+		{"mysql-bin.999999", 200, 1, true},
+		{"mysql-bin.999999", 200, 2, false},
+		{"mysql-bin.999999", 100, 5, true},
+		{"mysql-bin.999998", 900, 0, true},
+		{"mysql-bin.1000000", 4, 0, false}, // 序号位数增加后仍然在之后
+		{"", 0, 0, false},                  // 全量导入的数据
+	}
+	for _, c := range cases {
+		if got := mark.covers(c.name, c.pos, c.row); got != c.expect {
+			t.Errorf("%s %d %d: expect %v, got %v", c.name, c.pos, c.row, c.expect, got)
+		}
+	}
+	if (*kafkaMark)(nil).covers("mysql-bin.000001", 4, 0) {
+		t.Error("nil mark covers nothing")
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/siddontang/go-mysql/canal"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+// 消息头的名称，kafka为record header、rocketmq为property、rabbitmq为header
+const (
+	_headerSchema     = "schema"
+	_headerTable      = "table"
+	_headerAction     = "action"
+	_headerBinlogFile = "binlog_file"
+	_headerBinlogPos  = "binlog_pos"
+	_headerBinlogRow  = "binlog_row" // 行在binlog事件中的序号
+	_headerTimestamp  = "timestamp"  // binlog事件的时间，秒
+	_headerNode       = "node"       // 发送消息的transfer节点
+	_headerPipeline   = "pipeline"
+)
+
+type messageHeader struct {
+	key   string
+	value string
+}
+
+// encodeMessage 按照规则的message_format、value_encoder编码消息队列的消息体，topic为消息发送的topic或queue
+func encodeMessage(cfg *global.Config, row *model.RowRequest, rule *global.Rule, topic string) ([]byte, error) {
+	switch rule.MessageFormat {
+	case global.MessageFormatDebezium:
+		return json.Marshal(newDebeziumEvent(row, rule))
+	case global.MessageFormatCanal:
+		return json.Marshal(newFlatMessage(row, rule))
+	}
+
+	switch rule.ValueEncoder {
+	case global.ValEncoderAvro, global.ValEncoderProtobuf:
+		return encodeRegistryMessage(cfg, row, rule, topic)
+	}
+
+	kvm := rowMap(row, rule, false)
+	resp := new(model.MQRespond)
+	resp.Action = row.Action
+	resp.Timestamp = row.Timestamp
+	resp.Tx = row.Tx
+	if rule.ValueEncoder == global.ValEncoderJson {
+		resp.Date = kvm
+	} else {
+		resp.Date = encodeValue(rule, kvm)
+	}
+
+	if rule.ReserveRawData && canal.UpdateAction == row.Action {
+		resp.Raw = oldRowMap(row, rule, false)
+	}
+
+	return json.Marshal(resp)
+}
+
+// messageContentType avro、protobuf为二进制
+func messageContentType(rule *global.Rule) string {
+	switch rule.ValueEncoder {
+	case global.ValEncoderAvro, global.ValEncoderProtobuf:
+		return "application/octet-stream"
+	}
+	return "text/plain"
+}
+
+// encodeDDLMessage 编码表结构变更的消息体，canal格式时为isDdl的FlatMessage
+func encodeDDLMessage(ddl *model.DDLRequest, rule *global.Rule) ([]byte, error) {
+	if rule.MessageFormat == global.MessageFormatCanal {
+		return json.Marshal(newDDLFlatMessage(ddl))
+	}
+	return json.Marshal(ddl)
+}
+
+// messageHeaders 行变更的元数据，custom为lua脚本中指定的消息头，同名时覆盖元数据
+func messageHeaders(row *model.RowRequest, rule *global.Rule, custom map[string]string) []messageHeader {
+	headers := make([]messageHeader, 0, 8+len(custom))
+	headers = append(headers,
+		messageHeader{_headerSchema, rule.Schema},
+		messageHeader{_headerTable, rule.Table},
+		messageHeader{_headerAction, row.Action},
+	)
+	if row.PosName != "" { // 全量导入的行没有binlog位点
+		headers = append(headers,
+			messageHeader{_headerBinlogFile, row.PosName},
+			messageHeader{_headerBinlogPos, strconv.FormatUint(uint64(row.Pos), 10)},
+			messageHeader{_headerBinlogRow, strconv.Itoa(row.RowIndex)},
+		)
+	}
+	headers = append(headers,
+		messageHeader{_headerTimestamp, strconv.FormatUint(uint64(row.Timestamp), 10)},
+		messageHeader{_headerNode, nodeName()},
+	)
+	if rule.Pipeline != "" {
+		headers = append(headers, messageHeader{_headerPipeline, rule.Pipeline})
+	}
+	return mergeHeaders(headers, custom)
+}
+
+// ddlHeaders 表结构变更的元数据，action固定为ddl
+func ddlHeaders(ddl *model.DDLRequest, rule *global.Rule) []messageHeader {
+	headers := []messageHeader{
+		{_headerSchema, ddl.Schema},
+		{_headerTable, ddl.Table},
+		{_headerAction, ddl.Action},
+		{_headerBinlogFile, ddl.PosName},
+		{_headerBinlogPos, strconv.FormatUint(uint64(ddl.Pos), 10)},
+		{_headerNode, nodeName()},
+	}
+	if rule.Pipeline != "" {
+		headers = append(headers, messageHeader{_headerPipeline, rule.Pipeline})
+	}
+	return headers
+}
+
+// mergeHeaders 自定义的消息头覆盖同名的消息头，binlog位点用于消费端去重，不能覆盖
+func mergeHeaders(headers []messageHeader, custom map[string]string) []messageHeader {
+	if len(custom) == 0 {
+		return headers
+	}
+
+	keys := make([]string, 0, len(custom))
+	for k := range custom {
+		switch k {
+		case _headerBinlogFile, _headerBinlogPos, _headerBinlogRow:
+			logs.Warnf("custom message header %s ignored", k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		replaced := false
+		for i := range headers {
+			if headers[i].key == k {
+				headers[i].value = custom[k]
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			headers = append(headers, messageHeader{k, custom[k]})
+		}
+	}
+	return headers
+}
+
+// nodeName 集群模式为当前节点，否则为主机名
+func nodeName() string {
+	if node := global.CurrentNode(); node != "" {
+		return node
+	}
+	host, _ := os.Hostname()
+	return host
+}
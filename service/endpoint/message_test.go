@@ -0,0 +1,72 @@
+package endpoint
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestMessageHeaders(t *testing.T) {
+	rule := &global.Rule{Schema: "eseap", Table: "t_user"}
+	row := &model.RowRequest{Action: canal.InsertAction, Timestamp: 1600000000, PosName: "mysql-bin.000001", Pos: 300}
+
+	headers := messageHeaders(row, rule, map[string]string{"source": "crm", "action": "create", "binlog_pos": "1"})
+	expect := []messageHeader{
+		{_headerSchema, "eseap"},
+		{_headerTable, "t_user"},
+		{_headerAction, "create"},
+		{_headerBinlogFile, "mysql-bin.000001"},
+		{_headerBinlogPos, "300"},
+		{_headerBinlogRow, "0"},
+		{_headerTimestamp, "1600000000"},
+		{_headerNode, nodeName()},
+		{"source", "crm"},
+	}
+	if len(headers) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, headers)
+	}
+	for i := range expect {
+		if headers[i] != expect[i] {
+			t.Fatalf("expect %v, got %v", expect[i], headers[i])
+		}
+	}
+
+	// 全量导入的行没有binlog位点
+	row.PosName = ""
+	for _, h := range messageHeaders(row, rule, nil) {
+		if h.key == _headerBinlogFile || h.key == _headerBinlogPos || h.key == _headerBinlogRow {
+			t.Fatalf("unexpected header %s for stock row", h.key)
+		}
+	}
+}
+
+func TestDebeziumTransaction(t *testing.T) {
+	newRule := func(name string) *global.Rule {
+		table := &schema.Table{Schema: "eseap", Name: name, PKColumns: []int{0}}
+		table.AddColumn("id", "bigint(20)", "", "")
+		rule := &global.Rule{Schema: "eseap", Table: name, TableInfo: table, PaddingMap: map[string]*model.Padding{}}
+		c := &table.Columns[0]
+		rule.PaddingMap[c.Name] = &model.Padding{WrapName: c.Name, ColumnName: c.Name, ColumnIndex: 0, ColumnType: c.Type, ColumnMetadata: c}
+		return rule
+	}
+	rules := map[string]*global.Rule{"eseap:t_user": newRule("t_user"), "eseap:t_order": newRule("t_order")}
+
+	// data_collection_order为同一个表在事务中的序号
+	rows := []*model.RowRequest{
+		{RuleKey: "eseap:t_user", Action: canal.InsertAction, PosName: "mysql-bin.000001", Row: []interface{}{int64(1)}},
+		{RuleKey: "eseap:t_order", Action: canal.InsertAction, PosName: "mysql-bin.000001", Row: []interface{}{int64(1)}},
+		{RuleKey: "eseap:t_user", Action: canal.InsertAction, PosName: "mysql-bin.000001", Row: []interface{}{int64(2)}},
+	}
+	model.TagTx(rows, "mysql-bin.000001:300")
+	expects := [][2]int{{1, 1}, {2, 1}, {3, 2}}
+	for i, row := range rows {
+		tx := newDebeziumEvent(row, rules[row.RuleKey]).Payload.Transaction
+		if tx.TotalOrder != expects[i][0] || tx.DataCollectionOrder != expects[i][1] {
+			t.Fatalf("row %d expect total_order %d data_collection_order %d, got %+v", i, expects[i][0], expects[i][1], tx)
+		}
+	}
+}
@@ -45,6 +45,8 @@ type cKey struct {
 }
 
 type MongoEndpoint struct {
+	pipeline    string
+	dropData    bool // DROP、TRUNCATE TABLE时删除或者清空集合
 	options     *options.ClientOptions
 	client      *mongo.Client
 	lock        sync.Mutex
@@ -54,20 +56,22 @@ type MongoEndpoint struct {
 	retryLock sync.Mutex
 }
 
-func newMongoEndpoint() *MongoEndpoint {
-	addrList := strings.Split(global.Cfg().MongodbAddr, ",")
+func newMongoEndpoint(cfg *global.Config) *MongoEndpoint {
+	addrList := strings.Split(cfg.MongodbAddr, ",")
 	opts := &options.ClientOptions{
 		Hosts: addrList,
 	}
 
-	if global.Cfg().MongodbUsername != "" && global.Cfg().MongodbPassword != "" {
+	if cfg.MongodbUsername != "" && cfg.MongodbPassword != "" {
 		opts.Auth = &options.Credential{
-			Username: global.Cfg().MongodbUsername,
-			Password: global.Cfg().MongodbPassword,
+			Username: cfg.MongodbUsername,
+			Password: cfg.MongodbPassword,
 		}
 	}
 
 	r := &MongoEndpoint{}
+	r.pipeline = cfg.Name
+	r.dropData = cfg.EnableDDL && cfg.DDLDropData
 	r.options = opts
 	r.collections = make(map[cKey]*mongo.Collection)
 	return r
@@ -82,7 +86,7 @@ func (s *MongoEndpoint) Connect() error {
 	s.client = client
 
 	s.collLock.Lock()
-	for _, rule := range global.RuleInsList() {
+	for _, rule := range global.PipelineRuleInsList(s.pipeline) {
 		cc := s.client.Database(rule.MongodbDatabase).Collection(rule.MongodbCollection)
 		s.collections[s.collectionKey(rule.MongodbDatabase, rule.MongodbCollection)] = cc
 	}
@@ -125,7 +129,7 @@ func (s *MongoEndpoint) collection(key cKey) *mongo.Collection {
 func (s *MongoEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
 	models := make(map[cKey][]mongo.WriteModel, 0)
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -219,7 +223,7 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 	expect := true
 	models := make(map[cKey][]mongo.WriteModel, 0)
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -295,7 +299,7 @@ func (s *MongoEndpoint) Stock(rows []*model.RowRequest) int64 {
 func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error) {
 	var sum int64
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -370,6 +374,37 @@ func (s *MongoEndpoint) doConsumeSlowly(rows []*model.RowRequest) (int64, error)
 	return sum, nil
 }
 
+// ConsumeDDL DROP TABLE时删除集合，TRUNCATE TABLE时清空集合
+func (s *MongoEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	if !s.dropData || !isDropDDL(ddl) {
+		return nil
+	}
+	rule, ok := ddlRule(ddl)
+	if !ok {
+		return nil
+	}
+
+	key := s.collectionKey(rule.MongodbDatabase, rule.MongodbCollection)
+	collection := s.collection(key)
+	if ddl.Type == model.DDLDrop {
+		if err := collection.Drop(context.Background()); err != nil {
+			return err
+		}
+		s.collLock.Lock()
+		delete(s.collections, key)
+		s.collLock.Unlock()
+		logs.Infof("drop collection %s.%s", key.database, key.collection)
+		return nil
+	}
+
+	ret, err := collection.DeleteMany(context.Background(), bson.M{})
+	if err != nil {
+		return err
+	}
+	logs.Infof("clear collection %s.%s, %d deleted", key.database, key.collection, ret.DeletedCount)
+	return nil
+}
+
 func (s *MongoEndpoint) Close() {
 	if s.client != nil {
 		s.client.Disconnect(context.Background())
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// protobuf的wire type
+const (
+	_wireVarint  = 0
+	_wireFixed64 = 1
+	_wireBytes   = 2
+)
+
+// protobufSchema 字段与json格式的消息一致：action、timestamp、date、raw、tx；
+// 列的字段编号为列的顺序，在表的末尾增加列时兼容之前的schema
+func protobufSchema(rule *global.Rule, fields []*valueField) string {
+	var b strings.Builder
+	b.WriteString("syntax = \"proto3\";\n\n")
+	b.WriteString(fmt.Sprintf("package %s;\n\n", fieldName(rule.Schema)))
+	b.WriteString(fmt.Sprintf("message %s {\n", fieldName(rule.Table)))
+	b.WriteString("  message Value {\n")
+	for i, f := range fields {
+		b.WriteString(fmt.Sprintf("    optional %s %s = %d;\n", protobufType(f.kind), fieldName(f.name), i+1))
+	}
+	b.WriteString("  }\n")
+	b.WriteString("  message TxInfo {\n")
+	b.WriteString("    string id = 1;\n")
+	b.WriteString("    int32 index = 2;\n")
+	b.WriteString("    int32 total = 3;\n")
+	b.WriteString("  }\n")
+	b.WriteString("  string action = 1;\n")
+	b.WriteString("  int64 timestamp = 2;\n")
+	b.WriteString("  Value date = 3;\n")
+	b.WriteString("  Value raw = 4;\n")
+	b.WriteString("  TxInfo tx = 5;\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func protobufType(kind int) string {
+	switch kind {
+	case _fieldLong:
+		return "int64"
+	case _fieldDouble:
+		return "double"
+	default:
+		return "string"
+	}
+}
+
+// encodeProtobuf 按照protobufSchema的字段编号进行二进制编码，null的列不写入
+func encodeProtobuf(row *model.RowRequest, fields []*valueField, data, raw map[string]interface{}) []byte {
+	buf := make([]byte, 0, 64+16*len(fields))
+	buf = appendProtobufString(buf, 1, row.Action)
+	buf = appendProtobufTag(buf, 2, _wireVarint)
+	buf = appendVarint(buf, uint64(row.Timestamp))
+	buf = appendProtobufBytes(buf, 3, encodeProtobufValue(fields, data))
+
+	if raw != nil {
+		buf = appendProtobufBytes(buf, 4, encodeProtobufValue(fields, raw))
+	}
+
+	if row.Tx != nil {
+		tx := appendProtobufString(nil, 1, row.Tx.Id)
+		tx = appendProtobufTag(tx, 2, _wireVarint)
+		tx = appendVarint(tx, uint64(row.Tx.Index))
+		tx = appendProtobufTag(tx, 3, _wireVarint)
+		tx = appendVarint(tx, uint64(row.Tx.Total))
+		buf = appendProtobufBytes(buf, 5, tx)
+	}
+	return buf
+}
+
+func encodeProtobufValue(fields []*valueField, kv map[string]interface{}) []byte {
+	buf := make([]byte, 0, 16*len(fields))
+	for i, f := range fields {
+		v, ok := fieldValue(f, kv)
+		if !ok {
+			continue
+		}
+		num := i + 1
+		switch v := v.(type) {
+		case int64:
+			buf = appendProtobufTag(buf, num, _wireVarint)
+			buf = appendVarint(buf, uint64(v))
+		case float64:
+			buf = appendProtobufTag(buf, num, _wireFixed64)
+			var b [8]byte
+			binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+			buf = append(buf, b[:]...)
+		case string:
+			buf = appendProtobufString(buf, num, v)
+		}
+	}
+	return buf
+}
+
+func appendProtobufTag(buf []byte, num int, wireType int) []byte {
+	return appendVarint(buf, uint64(num)<<3|uint64(wireType))
+}
+
+func appendProtobufString(buf []byte, num int, v string) []byte {
+	return appendProtobufBytes(buf, num, []byte(v))
+}
+
+func appendProtobufBytes(buf []byte, num int, v []byte) []byte {
+	buf = appendProtobufTag(buf, num, _wireBytes)
+	buf = appendVarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	return append(buf, b[:n]...)
+}
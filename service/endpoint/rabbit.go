@@ -18,9 +18,12 @@
 package endpoint
 
 import (
+	"bytes"
 	"github.com/siddontang/go-mysql/canal"
 	"log"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
@@ -34,79 +37,285 @@ import (
 	"go-mysql-transfer/util/nets"
 )
 
+const (
+	_rabbitConfirmBuffer  = 1024
+	_rabbitConfirmTimeout = 30 * time.Second
+)
+
 type RabbitEndpoint struct {
+	cfg       *global.Config
 	rabCon    *amqp.Connection
 	rabChl    *amqp.Channel
+	conClosed chan *amqp.Error // 连接关闭的通知
+	chlClosed chan *amqp.Error // channel关闭的通知
+	confirms  chan amqp.Confirmation
+	returns   chan amqp.Return // mandatory消息无法路由到queue时被broker退回
+	pending   int              // 已发送，等待broker确认的消息数
+	nacked    int
+	returned  int
 	queues    map[string]bool
+	exchanges map[string]bool
+	lock      sync.Mutex // 并行处理时串行发送，保护连接、queues和exchanges
 	serverUrl string
 }
 
-func newRabbitEndpoint() *RabbitEndpoint {
+func newRabbitEndpoint(cfg *global.Config) *RabbitEndpoint {
 	r := &RabbitEndpoint{}
+	r.cfg = cfg
 	r.queues = make(map[string]bool)
+	r.exchanges = make(map[string]bool)
 	return r
 }
 
 func (s *RabbitEndpoint) Connect() error {
-	if s.rabChl != nil {
-		s.rabChl.Close()
-		s.rabChl = nil
-	}
-	if s.rabCon != nil {
-		s.rabCon.Close()
-		s.rabCon = nil
+	uri, err := amqp.ParseURI(s.cfg.RabbitmqAddr)
+	if err != nil {
+		return err
 	}
+	s.serverUrl = uri.Host + ":" + strconv.Itoa(uri.Port)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.connect()
+}
 
-	con, err := amqp.Dial(global.Cfg().RabbitmqAddr)
+// connect 建立连接和channel，并声明全部规则的exchange和queue
+func (s *RabbitEndpoint) connect() error {
+	s.closeConnection()
+
+	con, err := amqp.Dial(s.cfg.RabbitmqAddr)
 	if err != nil {
 		return err
 	}
 
-	uri, _ := amqp.ParseURI(global.Cfg().RabbitmqAddr)
-	s.serverUrl = uri.Host + ":" + strconv.Itoa(uri.Port)
-
 	var chl *amqp.Channel
 	chl, err = con.Channel()
 	if err != nil {
+		con.Close()
 		return err
 	}
 
+	if s.cfg.RabbitmqConfirm {
+		if err = chl.Confirm(false); err != nil {
+			con.Close()
+			return err
+		}
+		s.confirms = chl.NotifyPublish(make(chan amqp.Confirmation, _rabbitConfirmBuffer))
+	}
+
 	s.rabCon = con
 	s.rabChl = chl
-
-	if len(s.queues) == 0 {
-		for _, rule := range global.RuleInsList() {
-			_, err := s.rabChl.QueueDeclare(
-				rule.RabbitmqQueue, false, false, false, false, nil,
-			)
-			if err != nil {
-				return err
-			}
-			s.queues[rule.RabbitmqQueue] = true
+	s.conClosed = con.NotifyClose(make(chan *amqp.Error, 1))
+	s.chlClosed = chl.NotifyClose(make(chan *amqp.Error, 1))
+	s.returns = chl.NotifyReturn(make(chan amqp.Return, _rabbitConfirmBuffer))
+	s.queues = make(map[string]bool)
+	s.exchanges = make(map[string]bool)
+
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
+		if err := s.declare(rule); err != nil {
+			s.closeConnection()
+			return err
 		}
 	}
 
 	return nil
 }
 
+// ensureConnected 连接或channel已经关闭时重新连接，替代之前由主流程在Ping成功之后调用Connect
+func (s *RabbitEndpoint) ensureConnected() error {
+	if s.rabChl != nil && !rabbitClosed(s.conClosed) && !rabbitClosed(s.chlClosed) {
+		return nil
+	}
+
+	logs.Infof("rabbitmq %s reconnecting", s.serverUrl)
+	if err := s.connect(); err != nil {
+		s.closeConnection()
+		return errors.Errorf("rabbitmq reconnect err: %s", err.Error())
+	}
+	return nil
+}
+
+func rabbitClosed(c chan *amqp.Error) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeConnection 关闭之后未确认的消息作废，下次发送前重新连接
+func (s *RabbitEndpoint) closeConnection() {
+	if s.rabChl != nil {
+		s.rabChl.Close()
+		s.rabChl = nil
+	}
+	if s.rabCon != nil {
+		s.rabCon.Close()
+		s.rabCon = nil
+	}
+	s.confirms = nil
+	s.returns = nil
+	s.pending = 0
+	s.nacked = 0
+	s.returned = 0
+}
+
 func (s *RabbitEndpoint) Ping() error {
 	_, err := nets.IsActiveTCPAddr(s.serverUrl)
 	return err
 }
 
-func (s *RabbitEndpoint) mergeQueue(name string) {
-	_, ok := s.queues[name]
-	if ok {
-		return
+// declare 声明规则的exchange和queue，配置了exchange时将queue绑定到exchange
+func (s *RabbitEndpoint) declare(rule *global.Rule) error {
+	if rule.RabbitmqExchange != "" {
+		if err := s.mergeExchange(rule.RabbitmqExchange, rule.RabbitmqExchangeType); err != nil {
+			return err
+		}
+	}
+	if rule.RabbitmqQueue == "" {
+		return nil
+	}
+	if err := s.mergeQueue(rule.RabbitmqQueue); err != nil {
+		return err
+	}
+	if rule.RabbitmqExchange != "" {
+		return s.rabChl.QueueBind(rule.RabbitmqQueue, rule.RabbitmqBindingKey, rule.RabbitmqExchange, false, nil)
+	}
+	return nil
+}
+
+func (s *RabbitEndpoint) mergeExchange(name, kind string) error {
+	if _, ok := s.exchanges[name]; ok {
+		return nil
+	}
+
+	if err := s.rabChl.ExchangeDeclare(name, kind, true, false, false, false, nil); err != nil {
+		return err
+	}
+	s.exchanges[name] = true
+	return nil
+}
+
+// mergeQueue rabbitmq_persistent为true时声明持久化的queue；已存在的非持久化queue需要先删除
+func (s *RabbitEndpoint) mergeQueue(name string) error {
+	if _, ok := s.queues[name]; ok {
+		return nil
 	}
 
-	s.rabChl.QueueDeclare(name, false, false, false, false, nil)
+	if _, err := s.rabChl.QueueDeclare(name, s.cfg.RabbitmqPersistent, false, false, false, nil); err != nil {
+		return err
+	}
 	s.queues[name] = true
+	return nil
+}
+
+// publish 发送失败时关闭连接，批次重试时重新连接；
+// 消息为mandatory，没有queue可以路由时被broker退回，在waitConfirms中使批次失败
+func (s *RabbitEndpoint) publish(exchange, key string, msg amqp.Publishing) error {
+	if s.cfg.RabbitmqPersistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	if err := s.rabChl.Publish(exchange, key, true, false, msg); err != nil {
+		s.closeConnection()
+		return errors.Trace(err)
+	}
+
+	s.drainReturns()
+	if s.confirms == nil {
+		return nil
+	}
+	s.pending++
+	// 及时取出确认，避免通知缓冲满之后阻塞连接的读取
+	for s.pending > 0 {
+		select {
+		case c, ok := <-s.confirms:
+			if !ok {
+				return nil
+			}
+			s.pending--
+			if !c.Ack {
+				s.nacked++
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// drainReturns 及时取出被退回的消息，避免通知缓冲满之后阻塞连接的读取
+func (s *RabbitEndpoint) drainReturns() {
+	for {
+		select {
+		case r, ok := <-s.returns:
+			if !ok {
+				return
+			}
+			s.returned++
+			logs.Errorf("rabbitmq returned message, exchange: %s, routing key: %s, reason: %s", r.Exchange, r.RoutingKey, r.ReplyText)
+		default:
+			return
+		}
+	}
+}
+
+// checkReturned 批次中有消息被退回时整批失败
+func (s *RabbitEndpoint) checkReturned() error {
+	s.drainReturns()
+	returned := s.returned
+	s.returned = 0
+	if returned > 0 {
+		return errors.Errorf("%d messages returned by rabbitmq, no queue bound", returned)
+	}
+	return nil
+}
+
+// waitConfirms 等待批次中的消息全部被broker确认；broker在确认之前退回无法路由的消息，
+// 未开启publisher confirms时只能检查已经收到的退回
+func (s *RabbitEndpoint) waitConfirms() error {
+	if s.confirms == nil {
+		return s.checkReturned()
+	}
+
+	timer := time.NewTimer(_rabbitConfirmTimeout)
+	defer timer.Stop()
+	for s.pending > 0 {
+		select {
+		case c, ok := <-s.confirms:
+			if !ok {
+				s.closeConnection()
+				return errors.New("rabbitmq channel closed before messages confirmed")
+			}
+			s.pending--
+			if !c.Ack {
+				s.nacked++
+			}
+		case <-timer.C:
+			s.closeConnection()
+			return errors.Errorf("wait rabbitmq confirms timeout after %s", _rabbitConfirmTimeout)
+		}
+	}
+
+	nacked := s.nacked
+	s.nacked = 0
+	if nacked > 0 {
+		return errors.Errorf("%d messages nacked by rabbitmq", nacked)
+	}
+	return s.checkReturned()
 }
 
 func (s *RabbitEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ensureConnected(); err != nil {
+		return err
+	}
+
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -127,14 +336,26 @@ func (s *RabbitEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 		}
 	}
 
+	if err := s.waitConfirms(); err != nil {
+		return err
+	}
+
 	logs.Infof("处理完成 %d 条数据", len(rows))
 	return nil
 }
 
 func (s *RabbitEndpoint) Stock(rows []*model.RowRequest) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ensureConnected(); err != nil {
+		logs.Error(err.Error())
+		return 0
+	}
+
 	var sum int64
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -156,6 +377,12 @@ func (s *RabbitEndpoint) Stock(rows []*model.RowRequest) int64 {
 		sum++
 	}
 
+	// 开启publisher confirms时，未全部确认则整批视为失败
+	if err := s.waitConfirms(); err != nil {
+		logs.Error(err.Error())
+		return 0
+	}
+
 	return sum
 }
 
@@ -175,10 +402,16 @@ func (s *RabbitEndpoint) doLuaConsume(req *model.RowRequest, rule *global.Rule)
 	}
 
 	for _, resp := range ls {
-		s.mergeQueue(resp.Topic)
-		err := s.rabChl.Publish("", resp.Topic, false, false,
+		// 配置了exchange时，脚本中的topic作为routing key
+		if rule.RabbitmqExchange == "" {
+			if err := s.mergeQueue(resp.Topic); err != nil {
+				return err
+			}
+		}
+		err := s.publish(rule.RabbitmqExchange, resp.Topic,
 			amqp.Publishing{
 				ContentType: "text/plain",
+				Headers:     amqpHeaders(messageHeaders(req, rule, resp.Headers)),
 				Body:        resp.ByteArray,
 			})
 
@@ -192,41 +425,119 @@ func (s *RabbitEndpoint) doLuaConsume(req *model.RowRequest, rule *global.Rule)
 }
 
 func (s *RabbitEndpoint) doRuleConsume(req *model.RowRequest, rule *global.Rule) error {
-	kvm := rowMap(req, rule, false)
+	exchange, key, err := rabbitRoute(req, rule)
+	if err != nil {
+		return err
+	}
+	body, err := encodeMessage(s.cfg, req, rule, rabbitSubject(rule))
+	if err != nil {
+		return err
+	}
+	err = s.publish(exchange, key,
+		amqp.Publishing{
+			ContentType: messageContentType(rule),
+			Headers:     amqpHeaders(messageHeaders(req, rule, nil)),
+			Body:        body,
+		})
 
-	resp := new(model.MQRespond)
-	resp.Action = req.Action
-	resp.Timestamp = req.Timestamp
-	if rule.ValueEncoder == global.ValEncoderJson {
-		resp.Date = kvm
-	} else {
-		resp.Date = encodeValue(rule, kvm)
+	logs.Infof("topic: %s, message: %s", key, string(body))
+
+	return err
+}
+
+// rabbitRoute 未配置exchange时发送到默认exchange，routing key为queue名称
+func rabbitRoute(req *model.RowRequest, rule *global.Rule) (string, string, error) {
+	if rule.RabbitmqExchange == "" {
+		return "", rule.RabbitmqQueue, nil
+	}
+	if rule.RabbitmqRoutingKeyTmpl == nil {
+		return rule.RabbitmqExchange, rule.RabbitmqRoutingKey, nil
+	}
+
+	var tmplBytes bytes.Buffer
+	if err := rule.RabbitmqRoutingKeyTmpl.Execute(&tmplBytes, rowMap(req, rule, true)); err != nil {
+		return "", "", errors.Errorf("rule %s execute rabbitmq_routing_key err %s", req.RuleKey, err.Error())
+	}
+	return rule.RabbitmqExchange, tmplBytes.String(), nil
+}
+
+// rabbitSubject avro、protobuf的schema注册使用的名称，只配置了exchange时使用表名称
+func rabbitSubject(rule *global.Rule) string {
+	if rule.RabbitmqQueue != "" {
+		return rule.RabbitmqQueue
+	}
+	return rule.Table
+}
+
+// PrepareRule 声明新规则的exchange和queue
+func (s *RabbitEndpoint) PrepareRule(rule *global.Rule) error {
+	if rule.LuaEnable() && rule.RabbitmqExchange == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ensureConnected(); err != nil {
+		return err
 	}
+	return s.declare(rule)
+}
 
-	if rule.ReserveRawData && canal.UpdateAction == req.Action {
-		resp.Raw = oldRowMap(req, rule, false)
+// ConsumeDDL 表结构变更作为消息发送到表对应的queue；routing key为模板时使用表名称
+func (s *RabbitEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	rule, ok := ddlRule(ddl)
+	if !ok {
+		return nil
 	}
 
-	body, err := json.Marshal(resp)
+	body, err := encodeDDLMessage(ddl, rule)
 	if err != nil {
+		return errors.Trace(err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := s.ensureConnected(); err != nil {
 		return err
 	}
-	err = s.rabChl.Publish("", rule.RabbitmqQueue, false, false,
+
+	exchange, key := rule.RabbitmqExchange, rule.RabbitmqRoutingKey
+	if exchange == "" {
+		if err := s.mergeQueue(rule.RabbitmqQueue); err != nil {
+			return err
+		}
+		key = rule.RabbitmqQueue
+	} else if rule.RabbitmqRoutingKeyTmpl != nil {
+		key = rule.Table
+	}
+	err = s.publish(exchange, key,
 		amqp.Publishing{
 			ContentType: "text/plain",
+			Headers:     amqpHeaders(ddlHeaders(ddl, rule)),
 			Body:        body,
 		})
+	if err != nil {
+		return err
+	}
 
-	logs.Infof("topic: %s, message: %s", rule.RabbitmqQueue, string(body))
+	logs.Infof("topic: %s, message: %s", key, string(body))
 
-	return err
+	return s.waitConfirms()
 }
 
-func (s *RabbitEndpoint) Close() {
-	if s.rabChl != nil {
-		s.rabChl.Close()
-	}
-	if s.rabCon != nil {
-		s.rabCon.Close()
+func amqpHeaders(headers []messageHeader) amqp.Table {
+	table := make(amqp.Table, len(headers))
+	for _, h := range headers {
+		table[h.key] = h.value
 	}
+	return table
+}
+
+func (s *RabbitEndpoint) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closeConnection()
 }
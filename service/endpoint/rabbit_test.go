@@ -0,0 +1,80 @@
+package endpoint
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/streadway/amqp"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestRabbitRoute(t *testing.T) {
+	rule := newCodecTestRule(global.ValEncoderJson, "id", "tenant_id")
+	rule.RabbitmqQueue = "t_user"
+	row := &model.RowRequest{Action: canal.InsertAction, Row: []interface{}{int64(7), "t1"}}
+
+	// 默认exchange，routing key为queue名称
+	exchange, key, err := rabbitRoute(row, rule)
+	if err != nil || exchange != "" || key != "t_user" {
+		t.Fatalf("expect default exchange, got %q %q %v", exchange, key, err)
+	}
+
+	rule.RabbitmqExchange = "transfer"
+	rule.RabbitmqRoutingKey = "user.changed"
+	exchange, key, err = rabbitRoute(row, rule)
+	if err != nil || exchange != "transfer" || key != "user.changed" {
+		t.Fatalf("expect static routing key, got %q %q %v", exchange, key, err)
+	}
+
+	rule.RabbitmqRoutingKeyTmpl = template.Must(template.New("key").Parse("{{.tenant_id}}.user.{{.id}}"))
+	_, key, err = rabbitRoute(row, rule)
+	if err != nil || key != "t1.user.7" {
+		t.Fatalf("expect formatted routing key t1.user.7, got %q %v", key, err)
+	}
+
+	rule.RabbitmqRoutingKeyTmpl = template.Must(template.New("key").Option("missingkey=error").Parse("{{.name}}"))
+	if _, _, err = rabbitRoute(row, rule); err == nil {
+		t.Fatalf("expect template error")
+	}
+
+	if rabbitSubject(rule) != "t_user" {
+		t.Fatalf("expect subject t_user")
+	}
+	rule.RabbitmqQueue = ""
+	rule.Table = "t_order"
+	if rabbitSubject(rule) != "t_order" {
+		t.Fatalf("expect subject table name")
+	}
+}
+
+func TestRabbitReturned(t *testing.T) {
+	// broker先退回无法路由的消息，再确认
+	s := &RabbitEndpoint{
+		confirms: make(chan amqp.Confirmation, 2),
+		returns:  make(chan amqp.Return, 2),
+		pending:  2,
+	}
+	s.returns <- amqp.Return{Exchange: "transfer", RoutingKey: "user.unbound", ReplyText: "NO_ROUTE"}
+	s.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	s.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	if err := s.waitConfirms(); err == nil {
+		t.Fatal("expect batch failed when message returned")
+	}
+
+	// 下一个批次重新计数
+	s.pending = 1
+	s.confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	if err := s.waitConfirms(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未开启publisher confirms时检查已经收到的退回
+	s = &RabbitEndpoint{returns: make(chan amqp.Return, 1)}
+	s.returns <- amqp.Return{RoutingKey: "t_missing", ReplyText: "NO_ROUTE"}
+	if err := s.waitConfirms(); err == nil {
+		t.Fatal("expect batch failed when message returned without confirms")
+	}
+}
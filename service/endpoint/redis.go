@@ -38,14 +38,15 @@ import (
 
 type RedisEndpoint struct {
 	isCluster bool
+	dropData  bool // DROP、TRUNCATE TABLE时删除表对应的key
 	client    *redis.Client
 	cluster   *redis.ClusterClient
 	retryLock sync.Mutex
 }
 
-func newRedisEndpoint() *RedisEndpoint {
-	cfg := global.Cfg()
+func newRedisEndpoint(cfg *global.Config) *RedisEndpoint {
 	r := &RedisEndpoint{}
+	r.dropData = cfg.EnableDDL && cfg.DDLDropData
 
 	list := strings.Split(cfg.RedisAddr, ",")
 	if len(list) == 1 {
@@ -102,7 +103,7 @@ func (s *RedisEndpoint) pipe() redis.Pipeliner {
 func (s *RedisEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
 	pipe := s.pipe()
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -148,7 +149,7 @@ func (s *RedisEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) e
 func (s *RedisEndpoint) Stock(rows []*model.RowRequest) int64 {
 	pipe := s.pipe()
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -326,6 +327,71 @@ func (s *RedisEndpoint) encodeSortedSetScoreField(req *model.RowRequest, rule *g
 	return stringutil.ToFloat64Safe(str)
 }
 
+// ConsumeDDL DROP、TRUNCATE TABLE时删除表对应的key：
+// 配置了redis_key_value的删除该key；string结构配置了redis_key_prefix的删除该前缀的全部key；其他情况无法确定key，忽略
+func (s *RedisEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	if !s.dropData || !isDropDDL(ddl) {
+		return nil
+	}
+	rule, ok := ddlRule(ddl)
+	if !ok {
+		return nil
+	}
+
+	if rule.RedisKeyValue != "" {
+		var err error
+		if s.isCluster {
+			err = s.cluster.Del(rule.RedisKeyValue).Err()
+		} else {
+			err = s.client.Del(rule.RedisKeyValue).Err()
+		}
+		if err == nil {
+			logs.Infof("delete key %s", rule.RedisKeyValue)
+		}
+		return err
+	}
+
+	if rule.RedisStructure == global.RedisStructureString && rule.RedisKeyPrefix != "" && rule.RedisKeyFormatter == "" {
+		if s.isCluster {
+			return s.cluster.ForEachMaster(func(client *redis.Client) error {
+				return s.deleteByPrefix(client, rule.RedisKeyPrefix)
+			})
+		}
+		return s.deleteByPrefix(s.client, rule.RedisKeyPrefix)
+	}
+
+	logs.Warnf("%s %s table, unable to determine the redis keys", ddl.Type, ddl.RuleKey)
+	return nil
+}
+
+func (s *RedisEndpoint) deleteByPrefix(client *redis.Client, prefix string) error {
+	var cursor uint64
+	var count int
+	for {
+		keys, next, err := client.Scan(cursor, prefix+"*", 1000).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			// 集群模式下多个key可能不在同一个slot，逐个删除
+			pipe := client.Pipeline()
+			for _, key := range keys {
+				pipe.Del(key)
+			}
+			if _, err := pipe.Exec(); err != nil {
+				return err
+			}
+			count += len(keys)
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	logs.Infof("delete %d keys with prefix %s", count, prefix)
+	return nil
+}
+
 func (s *RedisEndpoint) Close() {
 	if s.client != nil {
 		s.client.Close()
@@ -0,0 +1,351 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+	"go-mysql-transfer/util/registry"
+	"go-mysql-transfer/util/stringutil"
+)
+
+// 列在avro、protobuf中的类型
+const (
+	_fieldString = iota
+	_fieldLong
+	_fieldDouble
+	_fieldDecimal // 按照列的小数位数格式化为字符串
+)
+
+type valueField struct {
+	name  string // 消息中的字段名，与json格式的key一致
+	kind  int
+	scale int // DECIMAL列的小数位数
+}
+
+// registryCodec 一个subject下当前表结构对应的schema
+type registryCodec struct {
+	table  *schema.Table
+	fields []*valueField
+	id     int
+}
+
+var (
+	_registryLock    sync.Mutex
+	_registryClients = make(map[string]*registry.Client) // schema_registry_url -> client
+	_registryCodecs  = make(map[string]*registryCodec)   // subject + value_encoder -> codec
+)
+
+func registryClient(cfg *global.Config) *registry.Client {
+	client, ok := _registryClients[cfg.SchemaRegistryUrl]
+	if !ok {
+		client = registry.NewClient(cfg.SchemaRegistryUrl, cfg.SchemaRegistryUser, cfg.SchemaRegistryPassword)
+		_registryClients[cfg.SchemaRegistryUrl] = client
+	}
+	return client
+}
+
+// codecOf 获取subject当前的schema；表结构变更(OnTableChanged)之后rule.TableInfo被替换，重新生成schema并注册
+func codecOf(cfg *global.Config, rule *global.Rule, subject string) (*registryCodec, error) {
+	_registryLock.Lock()
+	defer _registryLock.Unlock()
+
+	key := subject + "#" + rule.ValueEncoder
+	codec, ok := _registryCodecs[key]
+	if ok && codec.table == rule.TableInfo {
+		return codec, nil
+	}
+
+	fields := valueFields(rule)
+	if err := checkFieldNames(rule, fields); err != nil {
+		return nil, err
+	}
+	schemaType := registry.SchemaTypeAvro
+	text := avroSchema(rule, fields)
+	if rule.ValueEncoder == global.ValEncoderProtobuf {
+		schemaType = registry.SchemaTypeProtobuf
+		text = protobufSchema(rule, fields)
+	}
+
+	id, err := registryClient(cfg).Register(subject, schemaType, text)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if ok {
+		logs.Infof("table %s.%s changed, subject %s schema id %d -> %d", rule.Schema, rule.Table, subject, codec.id, id)
+	}
+
+	codec = &registryCodec{
+		table:  rule.TableInfo,
+		fields: fields,
+		id:     id,
+	}
+	_registryCodecs[key] = codec
+	return codec, nil
+}
+
+// encodeRegistryMessage 按照avro或protobuf编码消息，并在消息体前加上schema id；
+// 多个表可以发送到同一个topic，subject使用Confluent的TopicRecordNameStrategy，即topic-库名.表名
+func encodeRegistryMessage(cfg *global.Config, row *model.RowRequest, rule *global.Rule, topic string) ([]byte, error) {
+	codec, err := codecOf(cfg, rule, registrySubject(rule, topic))
+	if err != nil {
+		return nil, err
+	}
+
+	data := rowMap(row, rule, false)
+	var raw map[string]interface{}
+	if rule.ReserveRawData && canal.UpdateAction == row.Action && row.Old != nil {
+		raw = oldRowMap(row, rule, false)
+	}
+
+	if rule.ValueEncoder == global.ValEncoderProtobuf {
+		// 消息索引，顶层的第一个消息为单个0
+		payload := append([]byte{0}, encodeProtobuf(row, codec.fields, data, raw)...)
+		return registry.Frame(codec.id, payload), nil
+	}
+	return registry.Frame(codec.id, encodeAvro(row, codec.fields, data, raw)), nil
+}
+
+// registrySubject 与avro、protobuf schema中的全限定名一致
+func registrySubject(rule *global.Rule, topic string) string {
+	return topic + "-" + fieldName(rule.Schema) + "." + fieldName(rule.Table)
+}
+
+// valueFields 按照列的顺序，默认列在最后
+func valueFields(rule *global.Rule) []*valueField {
+	paddings := sortedPaddings(rule)
+	defaults := sortedDefaultColumns(rule)
+
+	fields := make([]*valueField, 0, len(paddings)+len(defaults))
+	for _, padding := range paddings {
+		field := &valueField{
+			name: padding.WrapName,
+			kind: fieldKind(rule, padding),
+		}
+		if field.kind == _fieldDecimal {
+			field.scale = decimalScale(padding.ColumnMetadata)
+		}
+		fields = append(fields, field)
+	}
+	for _, k := range defaults {
+		fields = append(fields, &valueField{
+			name: rule.WrapName(k),
+			kind: _fieldString,
+		})
+	}
+	return fields
+}
+
+// checkFieldNames avro、protobuf的字段名替换了非法字符，替换后不能重复，如a-b与a_b
+func checkFieldNames(rule *global.Rule, fields []*valueField) error {
+	names := make(map[string]string, len(fields))
+	for _, f := range fields {
+		name := fieldName(f.name)
+		if other, ok := names[name]; ok {
+			return errors.Errorf("table %s.%s: field %s and %s are both named %s in schema", rule.Schema, rule.Table, other, f.name, name)
+		}
+		names[name] = f.name
+	}
+	return nil
+}
+
+func sortedPaddings(rule *global.Rule) []*model.Padding {
+	paddings := make([]*model.Padding, 0, len(rule.PaddingMap))
+	for _, padding := range rule.PaddingMap {
+		paddings = append(paddings, padding)
+	}
+	sort.Slice(paddings, func(i, j int) bool {
+		return paddings[i].ColumnIndex < paddings[j].ColumnIndex
+	})
+	return paddings
+}
+
+func sortedDefaultColumns(rule *global.Rule) []string {
+	defaults := make([]string, 0, len(rule.DefaultColumnValueMap))
+	for k := range rule.DefaultColumnValueMap {
+		defaults = append(defaults, k)
+	}
+	sort.Strings(defaults)
+	return defaults
+}
+
+// fieldKind 日期时间按照date_formatter、datetime_formatter格式化为字符串，JSON列为JSON字符串；
+// BIGINT UNSIGNED超出long的范围，作为字符串
+func fieldKind(rule *global.Rule, padding *model.Padding) int {
+	for _, t := range rule.ColumnTransforms {
+		if strings.EqualFold(t.Column, padding.ColumnName) {
+			if t.Type == global.TransformCast && t.To == global.CastNumber {
+				return _fieldDouble
+			}
+			return _fieldString
+		}
+	}
+
+	switch padding.ColumnType {
+	case schema.TYPE_NUMBER:
+		if c := padding.ColumnMetadata; c != nil && c.IsUnsigned && strings.HasPrefix(c.RawType, "bigint") {
+			return _fieldString
+		}
+		return _fieldLong
+	case schema.TYPE_MEDIUM_INT, schema.TYPE_BIT:
+		return _fieldLong
+	case schema.TYPE_FLOAT:
+		return _fieldDouble
+	case schema.TYPE_DECIMAL:
+		return _fieldDecimal
+	default:
+		return _fieldString
+	}
+}
+
+// decimalScale 从decimal(M,D)中取出D，没有指定时为0
+func decimalScale(column *schema.TableColumn) int {
+	if column == nil {
+		return 0
+	}
+	start := strings.Index(column.RawType, ",")
+	end := strings.Index(column.RawType, ")")
+	if start < 0 || end < start {
+		return 0
+	}
+	scale, err := strconv.Atoi(strings.TrimSpace(column.RawType[start+1 : end]))
+	if err != nil {
+		return 0
+	}
+	return scale
+}
+
+// fieldName avro、protobuf的字段名只能包含字母、数字和下划线，且不能以数字开头
+func fieldName(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func toLong(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), v <= math.MaxInt64
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), v <= math.MaxInt64
+	case float32:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	case []byte:
+		i, err := strconv.ParseInt(string(v), 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func toDouble(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	if i, ok := toLong(v); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// toDecimal 按照列的小数位数格式化；canal没有开启UseDecimal，binlog中的DECIMAL已经解析为float64，
+// 有效数字超过15位的值在解析时已经丢失精度，这里只保证小数位数与列定义一致
+func toDecimal(v interface{}, scale int) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', scale, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', scale, 32), true
+	}
+	return stringutil.ToString(v), true
+}
+
+// fieldValue 按照字段类型转换列值，无法转换时作为null
+func fieldValue(field *valueField, kv map[string]interface{}) (interface{}, bool) {
+	v, ok := kv[field.name]
+	if !ok || v == nil {
+		return nil, false
+	}
+	switch field.kind {
+	case _fieldLong:
+		return toLong(v)
+	case _fieldDouble:
+		return toDouble(v)
+	case _fieldDecimal:
+		return toDecimal(v, field.scale)
+	default:
+		return stringutil.ToString(v), true
+	}
+}
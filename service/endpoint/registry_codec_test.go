@@ -0,0 +1,172 @@
+package endpoint
+
+import (
+	stdjson "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// fakeSchemaRegistry 本地的schema registry替身，记录每个subject注册的schema
+type fakeSchemaRegistry struct {
+	lock    sync.Mutex
+	schemas []string
+}
+
+func (f *fakeSchemaRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var req struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := stdjson.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	for i, s := range f.schemas {
+		if s == req.Schema {
+			w.Write([]byte(`{"id":` + strconv.Itoa(i+1) + `}`))
+			return
+		}
+	}
+	f.schemas = append(f.schemas, req.Schema)
+	w.Write([]byte(`{"id":` + strconv.Itoa(len(f.schemas)) + `}`))
+}
+
+func newCodecTestRule(encoder string, columns ...string) *global.Rule {
+	table := &schema.Table{Schema: "eseap", Name: "t_user", PKColumns: []int{0}}
+	rule := &global.Rule{Schema: "eseap", Table: "t_user", ValueEncoder: encoder}
+	setCodecTestTable(rule, table, columns...)
+	return rule
+}
+
+func setCodecTestTable(rule *global.Rule, table *schema.Table, columns ...string) {
+	for _, c := range columns {
+		tp := "varchar(20)"
+		if c == "id" || c == "age" {
+			tp = "bigint(20)"
+		}
+		table.AddColumn(c, tp, "", "")
+	}
+	rule.TableInfo = table
+	rule.PaddingMap = map[string]*model.Padding{}
+	for i := range table.Columns {
+		c := &table.Columns[i]
+		rule.PaddingMap[c.Name] = &model.Padding{WrapName: c.Name, ColumnName: c.Name, ColumnIndex: i, ColumnType: c.Type, ColumnMetadata: c}
+	}
+}
+
+func TestEncodeRegistryMessage(t *testing.T) {
+	fake := &fakeSchemaRegistry{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	cfg := &global.Config{SchemaRegistryUrl: server.URL}
+
+	row := &model.RowRequest{Action: canal.InsertAction, Timestamp: 1, Row: []interface{}{int64(1), "tom"}}
+
+	rule := newCodecTestRule(global.ValEncoderAvro, "id", "name")
+	data, err := encodeRegistryMessage(cfg, row, rule, "codec_avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "\x00\x00\x00\x00\x01" + // 魔数、schema id
+		"\x0cinsert" + "\x02" + // action、timestamp
+		"\x02\x02" + "\x02\x06tom" + // date: id、name
+		"\x00" + "\x00" // raw、tx
+	if string(data) != expect {
+		t.Fatalf("unexpected avro message %q", data)
+	}
+	if !strings.Contains(fake.schemas[0], `"namespace":"eseap"`) || !strings.Contains(fake.schemas[0], `"type":["null","long"]`) {
+		t.Fatalf("unexpected avro schema %s", fake.schemas[0])
+	}
+
+	// 表结构变更之后重新注册schema
+	setCodecTestTable(rule, &schema.Table{Schema: "eseap", Name: "t_user", PKColumns: []int{0}}, "id", "name", "age")
+	row.Row = []interface{}{int64(1), "tom", nil}
+	data, err = encodeRegistryMessage(cfg, row, rule, "codec_avro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[4] != 2 || len(fake.schemas) != 2 || !strings.Contains(fake.schemas[1], `"name":"age"`) {
+		t.Fatalf("expect schema re-registered after table changed, got id %d", data[4])
+	}
+
+	rule = newCodecTestRule(global.ValEncoderProtobuf, "id", "name")
+	row.Row = []interface{}{int64(1), "tom"}
+	data, err = encodeRegistryMessage(cfg, row, rule, "codec_protobuf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = "\x00\x00\x00\x00\x03" + "\x00" + // 魔数、schema id、消息索引
+		"\x0a\x06insert" + "\x10\x01" + // action、timestamp
+		"\x1a\x07" + "\x08\x01" + "\x12\x03tom" // date: id、name
+	if string(data) != expect {
+		t.Fatalf("unexpected protobuf message %q", data)
+	}
+	if !strings.Contains(fake.schemas[2], "optional int64 id = 1;") {
+		t.Fatalf("unexpected protobuf schema %s", fake.schemas[2])
+	}
+}
+
+func TestRegistryFieldValue(t *testing.T) {
+	table := &schema.Table{Schema: "eseap", Name: "t_order", PKColumns: []int{0}}
+	table.AddColumn("id", "bigint(20) unsigned", "", "")
+	table.AddColumn("amount", "decimal(10,2)", "", "")
+	table.AddColumn("quantity", "int(10) unsigned", "", "")
+	rule := &global.Rule{Schema: "eseap", Table: "t_order"}
+	rule.TableInfo = table
+	rule.PaddingMap = map[string]*model.Padding{}
+	for i := range table.Columns {
+		c := &table.Columns[i]
+		rule.PaddingMap[c.Name] = &model.Padding{WrapName: c.Name, ColumnName: c.Name, ColumnIndex: i, ColumnType: c.Type, ColumnMetadata: c}
+	}
+
+	fields := valueFields(rule)
+	if fields[0].kind != _fieldString || fields[1].kind != _fieldDecimal || fields[1].scale != 2 || fields[2].kind != _fieldLong {
+		t.Fatalf("unexpected fields %+v %+v %+v", fields[0], fields[1], fields[2])
+	}
+
+	kv := map[string]interface{}{"id": uint64(18446744073709551615), "amount": float64(12.5), "quantity": uint32(3)}
+	expects := []interface{}{"18446744073709551615", "12.50", int64(3)}
+	for i, expect := range expects {
+		if v, ok := fieldValue(fields[i], kv); !ok || v != expect {
+			t.Errorf("field %s expect %v, got %v", fields[i].name, expect, v)
+		}
+	}
+
+	if _, ok := toLong(uint64(18446744073709551615)); ok {
+		t.Error("uint64 out of long range should be null")
+	}
+	if subject := registrySubject(rule, "orders"); subject != "orders-eseap.t_order" {
+		t.Errorf("unexpected subject %s", subject)
+	}
+}
+
+func TestRegistryFieldNameCollision(t *testing.T) {
+	fake := &fakeSchemaRegistry{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	cfg := &global.Config{SchemaRegistryUrl: server.URL}
+
+	// a-b与a_b替换非法字符后同名，生成schema时报错，不注册
+	rule := newCodecTestRule(global.ValEncoderAvro, "id", "a-b", "a_b")
+	row := &model.RowRequest{Action: canal.InsertAction, Row: []interface{}{int64(1), "x", "y"}}
+	_, err := encodeRegistryMessage(cfg, row, rule, "codec_collision")
+	if err == nil || !strings.Contains(err.Error(), "a_b") {
+		t.Fatalf("expect field name collision error, got %v", err)
+	}
+	if len(fake.schemas) != 0 {
+		t.Fatalf("schema should not be registered, got %d", len(fake.schemas))
+	}
+}
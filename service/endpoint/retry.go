@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/logs"
+)
+
+// 无法从错误类型判断时，根据错误信息判断类别
+var (
+	_timeoutMessages = []string{"timeout", "deadline exceeded"}
+	_networkMessages = []string{
+		"connection refused", "connection reset", "broken pipe", "no such host",
+		"use of closed network connection", "network is unreachable",
+		"run out of available brokers", "no available connection",
+	}
+	_luaMessages = []string{"lua 脚本执行失败"}
+)
+
+// retryEndpoint 按照重试策略包装Consume，暂时性的错误原地重试，不中断canal；
+// 重试耗尽或者不可重试的错误返回给调用方，由调用方停止同步并等待接收端恢复
+type retryEndpoint struct {
+	Endpoint
+	cfg    *global.Config
+	policy *global.Retry
+}
+
+func newRetryEndpoint(cfg *global.Config, ep Endpoint) Endpoint {
+	if cfg.Retry == nil || cfg.Retry.MaxAttempts <= 1 {
+		return ep
+	}
+	return &retryEndpoint{
+		Endpoint: ep,
+		cfg:      cfg,
+		policy:   cfg.Retry,
+	}
+}
+
+func (s *retryEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
+	return s.retry(func() error {
+		return s.Endpoint.Consume(from, rows)
+	})
+}
+
+func (s *retryEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	c, ok := s.Endpoint.(DDLConsumer)
+	if !ok {
+		return nil
+	}
+	return s.retry(func() error {
+		return c.ConsumeDDL(ddl)
+	})
+}
+
+func (s *retryEndpoint) PrepareRule(rule *global.Rule) error {
+	if p, ok := s.Endpoint.(RulePreparer); ok {
+		return p.PrepareRule(rule)
+	}
+	return nil
+}
+
+func (s *retryEndpoint) retry(fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= s.policy.MaxAttempts || !retryable(s.policy, err) {
+			return err
+		}
+		interval := backoff(s.policy, attempt)
+		logs.Warnf("target %s consume err %s, retry %d after %s", s.cfg.Target, err.Error(), attempt, interval)
+		time.Sleep(interval)
+	}
+}
+
+// backoff 第attempt次重试前的等待时间：initial*multiplier^(attempt-1)，不超过max，再叠加±jitter的随机抖动
+func backoff(policy *global.Retry, attempt int) time.Duration {
+	interval := float64(policy.InitialInterval) * math.Pow(policy.Multiplier, float64(attempt-1))
+	if interval > float64(policy.MaxInterval) {
+		interval = float64(policy.MaxInterval)
+	}
+	if policy.Jitter != nil && *policy.Jitter > 0 {
+		interval = interval * (1 + *policy.Jitter*(2*rand.Float64()-1))
+	}
+	return time.Duration(interval * float64(time.Millisecond))
+}
+
+// retryable fatal优先；类别之外的配置项按错误信息的子串匹配
+func retryable(policy *global.Retry, err error) bool {
+	if matchErrorClass(policy.Fatal, err) {
+		return false
+	}
+	return matchErrorClass(policy.Retryable, err)
+}
+
+func matchErrorClass(classes []string, err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, c := range classes {
+		switch strings.ToLower(c) {
+		case global.RetryClassNetwork:
+			if isNetworkError(err, msg) {
+				return true
+			}
+		case global.RetryClassTimeout:
+			if isTimeoutError(err, msg) {
+				return true
+			}
+		case global.RetryClassLua:
+			if containsAny(msg, _luaMessages) {
+				return true
+			}
+		default:
+			if c != "" && strings.Contains(msg, strings.ToLower(c)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isTimeoutError(err error, msg string) bool {
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return true
+	}
+	if e, ok := cause.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	return containsAny(msg, _timeoutMessages)
+}
+
+func isNetworkError(err error, msg string) bool {
+	cause := errors.Cause(err)
+	if cause == io.EOF || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := cause.(net.Error); ok {
+		return true
+	}
+	switch cause {
+	case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE:
+		return true
+	}
+	return strings.HasSuffix(msg, "eof") || containsAny(msg, _networkMessages)
+}
+
+func containsAny(msg string, subs []string) bool {
+	for _, s := range subs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package endpoint
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+)
+
+func TestBackoff(t *testing.T) {
+	jitter := 0.2
+	policy := &global.Retry{
+		InitialInterval: 100,
+		MaxInterval:     1000,
+		Multiplier:      2,
+		Jitter:          &jitter,
+	}
+
+	expects := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, expect := range expects {
+		expect = expect * time.Millisecond
+		min := time.Duration(float64(expect) * 0.8)
+		max := time.Duration(float64(expect) * 1.2)
+		for j := 0; j < 100; j++ {
+			if d := backoff(policy, i+1); d < min || d > max {
+				t.Fatalf("attempt %d backoff %s out of [%s, %s]", i+1, d, min, max)
+			}
+		}
+	}
+
+	// jitter配置为0时不抖动
+	jitter = 0
+	if d := backoff(policy, 2); d != 200*time.Millisecond {
+		t.Fatalf("expect 200ms without jitter, got %s", d)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := &global.Retry{
+		Retryable: []string{global.RetryClassNetwork, global.RetryClassTimeout, "429"},
+		Fatal:     []string{global.RetryClassLua},
+	}
+
+	cases := []struct {
+		err    error
+		expect bool
+	}{
+		{errors.Trace(io.EOF), true},
+		{errors.New("dial tcp 127.0.0.1:6379: connect: connection refused"), true},
+		{errors.New("context deadline exceeded"), true},
+		{errors.New("elastic: Error 429 (Too Many Requests)"), true},
+		{errors.Errorf("lua 脚本执行失败 : %s ", "read tcp: i/o timeout"), false},
+		{errors.New("schema mismatching"), false},
+	}
+	for _, c := range cases {
+		if retryable(policy, c.err) != c.expect {
+			t.Errorf("retryable(%s) expect %v", c.err, c.expect)
+		}
+	}
+}
@@ -42,13 +42,13 @@ import (
 const _rocketRetry = 2
 
 type RocketEndpoint struct {
+	cfg       *global.Config
 	client    rocketmq.Producer
 	retryLock sync.Mutex
 }
 
-func newRocketEndpoint() *RocketEndpoint {
+func newRocketEndpoint(cfg *global.Config) *RocketEndpoint {
 	rlog.SetLogger(logagent.NewRocketmqLoggerAgent())
-	cfg := global.Cfg()
 
 	options := make([]producer.Option, 0)
 	serverList := strings.Split(cfg.RocketmqNameServers, ",")
@@ -69,6 +69,7 @@ func newRocketEndpoint() *RocketEndpoint {
 
 	producer, _ := rocketmq.NewProducer(options...)
 	r := &RocketEndpoint{}
+	r.cfg = cfg
 	r.client = producer
 	return r
 }
@@ -89,7 +90,7 @@ func (s *RocketEndpoint) Ping() error {
 func (s *RocketEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
 	var ms []*primitive.Message
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -145,7 +146,7 @@ func (s *RocketEndpoint) Stock(rows []*model.RowRequest) int64 {
 	expect := true
 	var ms []*primitive.Message
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -222,6 +223,7 @@ func (s *RocketEndpoint) buildMessages(req *model.RowRequest, rule *global.Rule)
 			Topic: resp.Topic,
 			Body:  resp.ByteArray,
 		}
+		withRocketHeaders(m, req.Action, messageHeaders(req, rule, resp.Headers))
 		logs.Infof("topic: %s, message: %s", m.Topic, string(m.Body))
 		ms = append(ms, m)
 	}
@@ -230,21 +232,7 @@ func (s *RocketEndpoint) buildMessages(req *model.RowRequest, rule *global.Rule)
 }
 
 func (s *RocketEndpoint) buildMessage(req *model.RowRequest, rule *global.Rule) (*primitive.Message, error) {
-	kvm := rowMap(req, rule, false)
-	resp := new(model.MQRespond)
-	resp.Action = req.Action
-	resp.Timestamp = req.Timestamp
-	if rule.ValueEncoder == global.ValEncoderJson {
-		resp.Date = kvm
-	} else {
-		resp.Date = encodeValue(rule, kvm)
-	}
-
-	if rule.ReserveRawData && canal.UpdateAction == req.Action {
-		resp.Raw = oldRowMap(req, rule, false)
-	}
-
-	body, err := json.Marshal(resp)
+	body, err := encodeMessage(s.cfg, req, rule, rule.RocketmqTopic)
 	if err != nil {
 		return nil, err
 	}
@@ -253,14 +241,47 @@ func (s *RocketEndpoint) buildMessage(req *model.RowRequest, rule *global.Rule)
 		Topic: rule.RocketmqTopic,
 		Body:  body,
 	}
+	withRocketHeaders(m, req.Action, messageHeaders(req, rule, nil))
 
 	logs.Infof("topic: %s, message: %s", m.Topic, string(m.Body))
 
 	return m, nil
 }
 
+// withRocketHeaders 元数据作为消息的property，action作为消息的tag，消费者可以按照tag订阅
+func withRocketHeaders(m *primitive.Message, action string, headers []messageHeader) {
+	m.WithTag(action)
+	for _, h := range headers {
+		m.WithProperty(h.key, h.value)
+	}
+}
+
 func (s *RocketEndpoint) Close() {
 	if s.client != nil {
 		s.client.Shutdown()
 	}
 }
+
+// ConsumeDDL 表结构变更作为消息发送到表对应的topic
+func (s *RocketEndpoint) ConsumeDDL(ddl *model.DDLRequest) error {
+	rule, ok := ddlRule(ddl)
+	if !ok {
+		return nil
+	}
+
+	body, err := encodeDDLMessage(ddl, rule)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	m := &primitive.Message{
+		Topic: rule.RocketmqTopic,
+		Body:  body,
+	}
+	withRocketHeaders(m, ddl.Action, ddlHeaders(ddl, rule))
+	if _, err := s.client.SendSync(context.Background(), m); err != nil {
+		return err
+	}
+
+	logs.Infof("topic: %s, message: %s", m.Topic, string(m.Body))
+	return nil
+}
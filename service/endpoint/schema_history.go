@@ -0,0 +1,209 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package endpoint
+
+import (
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/storage"
+)
+
+var (
+	_schemaHistories       = make(map[string]*SchemaHistory)
+	_lockOfSchemaHistories sync.Mutex
+)
+
+// SchemaHistory 管道的表结构历史，全部版本缓存在内存中。
+// canal只能获取表当前的结构，从旧的位点恢复时按照历史版本把行数据转换为当前表结构的列顺序
+type SchemaHistory struct {
+	cfg      *global.Config
+	storage  storage.SchemaHistoryStorage
+	lock     sync.Mutex
+	versions map[string][]*model.SchemaVersion // key为RuleKey，按照位点升序
+}
+
+// SchemaHistoryOf 管道的表结构历史，主流程与追赶流程共用；没有开启schema_history时返回nil
+func SchemaHistoryOf(cfg *global.Config) (*SchemaHistory, error) {
+	if !cfg.SchemaHistory {
+		return nil, nil
+	}
+
+	_lockOfSchemaHistories.Lock()
+	defer _lockOfSchemaHistories.Unlock()
+
+	if h, ok := _schemaHistories[cfg.PositionKey()]; ok {
+		return h, nil
+	}
+	st := storage.NewSchemaHistoryStorage(cfg.PositionKey())
+	if err := st.Initialize(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	h := &SchemaHistory{
+		cfg:      cfg,
+		storage:  st,
+		versions: make(map[string][]*model.SchemaVersion),
+	}
+	_schemaHistories[cfg.PositionKey()] = h
+	return h, nil
+}
+
+// load 首次使用时从存储中加载，在lock内调用
+func (s *SchemaHistory) load(schemaName, table string) ([]*model.SchemaVersion, error) {
+	key := s.cfg.RuleKey(schemaName, table)
+	if list, ok := s.versions[key]; ok {
+		return list, nil
+	}
+	list, err := s.storage.List(schemaName, table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s.versions[key] = list
+	return list, nil
+}
+
+// Snapshot 表没有历史版本时，保存启动位点的表结构
+func (s *SchemaHistory) Snapshot(pos mysql.Position, table *schema.Table) error {
+	if table == nil || pos.Name == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list, err := s.load(table.Schema, table.Name)
+	if err != nil || len(list) > 0 {
+		return err
+	}
+	return s.save(list, pos, table)
+}
+
+// Record DDL之后保存新的表结构；与最新的版本相同时不保存，
+// 从旧的位点重放时，已经保存过更新版本的DDL也不保存，当前的表结构不是当时的表结构
+func (s *SchemaHistory) Record(pos mysql.Position, table *schema.Table) error {
+	if table == nil || pos.Name == "" {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list, err := s.load(table.Schema, table.Name)
+	if err != nil {
+		return err
+	}
+	if n := len(list); n > 0 {
+		last := list[n-1]
+		if versionPosition(last).Compare(pos) >= 0 || sameColumns(last.Table, table) {
+			return nil
+		}
+	}
+	return s.save(list, pos, table)
+}
+
+func (s *SchemaHistory) save(list []*model.SchemaVersion, pos mysql.Position, table *schema.Table) error {
+	version := &model.SchemaVersion{
+		PosName: pos.Name,
+		Pos:     pos.Pos,
+		Table:   table,
+	}
+	if err := s.storage.Save(table.Schema, table.Name, version); err != nil {
+		return errors.Trace(err)
+	}
+	s.versions[s.cfg.RuleKey(table.Schema, table.Name)] = append(list, version)
+	return nil
+}
+
+// Decode 行数据按照写入时生效的表结构转换为当前表结构的列顺序，新增的列为nil，删除的列丢弃
+func (s *SchemaHistory) Decode(pos mysql.Position, e *canal.RowsEvent) error {
+	rule, ok := global.RuleIns(s.cfg.RuleKey(e.Table.Schema, e.Table.Name))
+	if !ok {
+		return nil
+	}
+	return s.decodeRule(rule, pos, e)
+}
+
+// decodeRule 按照指定规则的表结构转换行数据
+func (s *SchemaHistory) decodeRule(rule *global.Rule, pos mysql.Position, e *canal.RowsEvent) error {
+	if rule.TableInfo == nil {
+		return nil
+	}
+
+	s.lock.Lock()
+	list, err := s.load(e.Table.Schema, e.Table.Name)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	version := versionAt(list, pos)
+	if version == nil || sameColumns(version.Table, rule.TableInfo) {
+		return nil
+	}
+	for i, row := range e.Rows {
+		// 与历史版本也不一致的行交给后续的校验处理
+		if len(row) == len(version.Table.Columns) {
+			e.Rows[i] = remapRow(version.Table, rule.TableInfo, row)
+		}
+	}
+	return nil
+}
+
+// versionAt 位点所在时刻生效的版本
+func versionAt(list []*model.SchemaVersion, pos mysql.Position) *model.SchemaVersion {
+	var ret *model.SchemaVersion
+	for _, v := range list {
+		if versionPosition(v).Compare(pos) > 0 {
+			break
+		}
+		ret = v
+	}
+	return ret
+}
+
+func versionPosition(v *model.SchemaVersion) mysql.Position {
+	return mysql.Position{Name: v.PosName, Pos: v.Pos}
+}
+
+func sameColumns(a, b *schema.Table) bool {
+	if len(a.Columns) != len(b.Columns) {
+		return false
+	}
+	for i := range a.Columns {
+		if a.Columns[i].Name != b.Columns[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+func remapRow(from, to *schema.Table, row []interface{}) []interface{} {
+	ret := make([]interface{}, len(to.Columns))
+	for i, c := range to.Columns {
+		if j := from.FindColumn(c.Name); j >= 0 {
+			ret[i] = row[j]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,64 @@
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/model"
+)
+
+func newTestTable(columns ...string) *schema.Table {
+	t := &schema.Table{Schema: "eseap", Name: "t_user"}
+	for _, c := range columns {
+		t.Columns = append(t.Columns, schema.TableColumn{Name: c})
+	}
+	return t
+}
+
+func TestVersionAt(t *testing.T) {
+	list := []*model.SchemaVersion{
+		{PosName: "mysql-bin.000001", Pos: 100, Table: newTestTable("id")},
+		{PosName: "mysql-bin.000001", Pos: 500, Table: newTestTable("id", "name")},
+		{PosName: "mysql-bin.000002", Pos: 4, Table: newTestTable("id", "name", "age")},
+	}
+
+	cases := []struct {
+		pos    mysql.Position
+		expect int
+	}{
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 50}, -1},
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 100}, 0},
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 499}, 0},
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 900}, 1},
+		{mysql.Position{Name: "mysql-bin.000002", Pos: 1000}, 2},
+	}
+	for _, c := range cases {
+		v := versionAt(list, c.pos)
+		if c.expect < 0 {
+			if v != nil {
+				t.Fatalf("%s expect no version, got %s %d", c.pos, v.PosName, v.Pos)
+			}
+			continue
+		}
+		if v != list[c.expect] {
+			t.Fatalf("%s expect version %d", c.pos, c.expect)
+		}
+	}
+}
+
+func TestRemapRow(t *testing.T) {
+	from := newTestTable("id", "nickname", "name")
+	to := newTestTable("id", "name", "age")
+
+	row := remapRow(from, to, []interface{}{1, "nick", "tom"})
+	if expect := []interface{}{1, "tom", nil}; !reflect.DeepEqual(row, expect) {
+		t.Fatalf("expect %v, got %v", expect, row)
+	}
+
+	if !sameColumns(to, newTestTable("id", "name", "age")) || sameColumns(from, to) {
+		t.Fatal("same columns mismatch")
+	}
+}
@@ -23,7 +23,6 @@ import (
 	"github.com/pingcap/errors"
 	"github.com/siddontang/go-mysql/mysql"
 
-	"go-mysql-transfer/global"
 	"go-mysql-transfer/metrics"
 	"go-mysql-transfer/model"
 	"go-mysql-transfer/service/luaengine"
@@ -47,7 +46,7 @@ func (s *ScriptEndpoint) Ping() error {
 
 func (s *ScriptEndpoint) Consume(from mysql.Position, rows []*model.RowRequest) error {
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -70,7 +69,7 @@ func (s *ScriptEndpoint) Consume(from mysql.Position, rows []*model.RowRequest)
 func (s *ScriptEndpoint) Stock(rows []*model.RowRequest) int64 {
 	var counter int64
 	for _, row := range rows {
-		rule, _ := global.RuleIns(row.RuleKey)
+		rule, _ := rowRule(row.RuleKey)
 		if rule.TableColumnSize != len(row.Row) {
 			logs.Warnf("%s schema mismatching", row.RuleKey)
 			continue
@@ -18,6 +18,7 @@
 package service
 
 import (
+	"fmt"
 	"go-mysql-transfer/metrics"
 	"log"
 	"time"
@@ -29,125 +30,215 @@ import (
 
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/model"
+	"go-mysql-transfer/service/endpoint"
 	"go-mysql-transfer/util/logs"
 )
 
 type handler struct {
-	queue chan interface{}
+	transfer *TransferService
+
+	queue *rowQueue
 	stop  chan struct{}
+	pool  *workerPool   // 并行处理时的工作协程池，只在listener协程中创建
+	gset  mysql.GTIDSet // 已经执行的GTID集合，只在canal的事件协程中读写
+	ddl   *endpoint.DDLParser
+
+	// 重放的预写日志中最后一行的位置，canal从保存的位点重新读取到这里的行已经处理过，只在listener协程中读写
+	replayed *replayMark
+
+	// 事务模式下未提交事务的行及其GTID，只在canal的事件协程中读写
+	txRows []*model.RowRequest
+	txGTID string
 }
 
-func newHandler() *handler {
+func newHandler(transfer *TransferService) *handler {
 	return &handler{
-		queue: make(chan interface{}, 4096),
-		stop:  make(chan struct{}, 1),
+		transfer: transfer,
+		queue:    newRowQueue(transfer.cfg.PipelineName(), transfer.cfg.QueueMaxRows, transfer.cfg.QueueMaxBytes),
+		stop:     make(chan struct{}, 1),
+		ddl:      endpoint.NewDDLParser(transfer.cfg),
 	}
 }
 
 func (s *handler) OnRotate(e *replication.RotateEvent) error {
-	s.queue <- model.PosRequest{
+	s.commitTx(mysql.Position{Name: string(e.NextLogName), Pos: uint32(e.Position)})
+	s.queue.put(model.PosRequest{
 		Name:  string(e.NextLogName),
 		Pos:   uint32(e.Position),
+		GTID:  s.gtid(),
 		Force: true,
-	}
+	})
 	return nil
 }
 
 func (s *handler) OnTableChanged(schema, table string) error {
-	err := _transferService.updateRule(schema, table)
+	err := s.transfer.updateRule(schema, table)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (s *handler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
-	s.queue <- model.PosRequest{
+func (s *handler) OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	s.commitTx(nextPos)
+	ddls, err := s.ddl.Parse(nextPos, e)
+	if err != nil {
+		logs.Warnf("parse ddl err %s, query: %s", err.Error(), string(e.Query))
+	}
+	timestamp := endpoint.EventTimestamp(s.transfer.canal)
+	for _, ddl := range ddls {
+		ddl.Timestamp = timestamp
+		if ddl.Type == model.DDLRename {
+			// canal只对原表触发OnTableChanged，新表名匹配通配符时在此处加入
+			if err := s.transfer.attachRule(ddl.NewSchema, ddl.NewTable); err != nil {
+				logs.Errorf("attach table %s.%s err %s", ddl.NewSchema, ddl.NewTable, errors.ErrorStack(err))
+			}
+		}
+		// 同步中的表被删除或重命名时总是通知接收端，并在之前的数据处理完之后移除规则
+		if global.RuleInsExist(ddl.RuleKey) && (s.transfer.cfg.EnableDDL || ddl.Retire()) {
+			s.queue.put(ddl)
+		}
+		s.recordSchema(nextPos, ddl)
+	}
+	s.queue.put(model.PosRequest{
 		Name:  nextPos.Name,
 		Pos:   nextPos.Pos,
+		GTID:  s.gtid(),
 		Force: true,
-	}
+	})
 	return nil
 }
 
+// recordSchema DDL之后的表结构保存到历史中，重命名时保存新表的结构
+func (s *handler) recordSchema(nextPos mysql.Position, ddl *model.DDLRequest) {
+	if s.transfer.history == nil || ddl.Type == model.DDLDrop {
+		return
+	}
+	ruleKey := ddl.RuleKey
+	if ddl.Type == model.DDLRename {
+		ruleKey = s.transfer.cfg.RuleKey(ddl.NewSchema, ddl.NewTable)
+	}
+	rule, ok := global.RuleIns(ruleKey)
+	if !ok {
+		return
+	}
+	if err := s.transfer.history.Record(nextPos, rule.TableInfo); err != nil {
+		logs.Errorf("record schema of %s err %s", ruleKey, errors.ErrorStack(err))
+	}
+}
+
 func (s *handler) OnXID(nextPos mysql.Position) error {
-	s.queue <- model.PosRequest{
+	s.commitTx(nextPos)
+	s.queue.put(model.PosRequest{
 		Name:  nextPos.Name,
 		Pos:   nextPos.Pos,
+		GTID:  s.gtid(),
 		Force: false,
-	}
+	})
 	return nil
 }
 
 func (s *handler) OnRow(e *canal.RowsEvent) error {
-	ruleKey := global.RuleKey(e.Table.Schema, e.Table.Name)
-	if !global.RuleInsExist(ruleKey) {
-		return nil
+	pos := mysql.Position{Name: s.transfer.canal.SyncedPosition().Name, Pos: e.Header.LogPos}
+	if s.transfer.history != nil {
+		if err := s.transfer.history.Decode(pos, e); err != nil {
+			logs.Errorf("decode %s.%s with schema history err %s", e.Table.Schema, e.Table.Name, errors.ErrorStack(err))
+		}
 	}
-
-	var requests []*model.RowRequest
-	if e.Action != canal.UpdateAction {
-		// 定长分配
-		requests = make([]*model.RowRequest, 0, len(e.Rows))
+	requests := endpoint.NewRowRequests(s.transfer.cfg, e, pos.Name)
+	if requests == nil {
+		return nil
 	}
-
-	if e.Action == canal.UpdateAction {
-		for i := 0; i < len(e.Rows); i++ {
-			if (i+1)%2 == 0 {
-				v := new(model.RowRequest)
-				v.RuleKey = ruleKey
-				v.Action = e.Action
-				v.Timestamp = e.Header.Timestamp
-				if global.Cfg().IsReserveRawData() {
-					v.Old = e.Rows[i-1]
-				}
-				v.Row = e.Rows[i]
-				requests = append(requests, v)
-			}
-		}
-	} else {
-		for _, row := range e.Rows {
-			v := new(model.RowRequest)
-			v.RuleKey = ruleKey
-			v.Action = e.Action
-			v.Timestamp = e.Header.Timestamp
-			v.Row = row
-			requests = append(requests, v)
-		}
+	if s.transfer.cfg.TransactionMode {
+		s.txRows = append(s.txRows, requests...)
+		return nil
 	}
-	s.queue <- requests
+	s.queue.put(requests)
 
 	return nil
 }
 
+// OnGTID 事务开始时触发，将事务的GTID合并到已执行集合中
 func (s *handler) OnGTID(gtid mysql.GTIDSet) error {
-	return nil
+	s.txGTID = gtid.String()
+	if s.gset == nil {
+		return nil
+	}
+	return s.gset.Update(gtid.String())
 }
 
+// OnPosSynced canal以GTID方式启动或者mysqldump完成后会带上完整的GTID集合
 func (s *handler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	if set != nil && set.String() != "" {
+		s.gset = set.Clone()
+	}
 	return nil
 }
 
+// commitTx 事务模式下，事务结束时将整个事务的行作为一个请求放入队列。
+// 非事务表没有XID事件，其数据会并入下一个事务
+func (s *handler) commitTx(pos mysql.Position) {
+	if len(s.txRows) == 0 {
+		s.txGTID = ""
+		return
+	}
+
+	txId := s.txGTID
+	if txId == "" {
+		txId = fmt.Sprintf("%s:%d", pos.Name, pos.Pos)
+	}
+	model.TagTx(s.txRows, txId)
+	s.queue.put(s.txRows)
+	s.txRows = nil
+	s.txGTID = ""
+}
+
+func (s *handler) gtid() string {
+	if s.gset == nil {
+		return ""
+	}
+	return s.gset.String()
+}
+
 func (s *handler) String() string {
 	return "TransferHandler"
 }
 
 func (s *handler) startListener() {
 	go func() {
-		interval := time.Duration(global.Cfg().FlushBulkInterval)
-		bulkSize := global.Cfg().BulkSize
+		transfer := s.transfer
+		interval := time.Duration(transfer.cfg.FlushBulkInterval)
+		bulkSize := transfer.cfg.BulkSize
+		txMode := transfer.cfg.TransactionMode
 		ticker := time.NewTicker(time.Millisecond * interval)
 		defer ticker.Stop()
 
 		lastSavedTime := time.Now()
 		requests := make([]*model.RowRequest, 0, bulkSize)
 		var current mysql.Position
-		from, _ := _transferService.positionDao.Get()
+		var currentGTID string
+		var checkpoints []checkpoint // 并行处理时等待前面的批次全部完成才能保存的位点
+		var ddls []*model.DDLRequest
+		from, _ := transfer.positionDao.Get()
+		replaySeq, err := s.replaySpool(from)
+		if err != nil {
+			s.fail(err)
+		}
+		// 越过重放的位置之后才截断预写日志，之前重启时这些行仍然需要跳过
+		var spoolSeq uint64
+		if s.replayed == nil {
+			spoolSeq = replaySeq
+		}
+		if transfer.cfg.ConsumeWorkers > 1 {
+			s.pool = newWorkerPool(s, transfer.cfg.ConsumeWorkers)
+			defer s.pool.close()
+		}
 		for {
 			needFlush := false
 			needSavePos := false
 			select {
-			case v := <-s.queue:
+			case v := <-s.queue.ch:
+				s.queue.release(v)
 				switch v := v.(type) {
 				case model.PosRequest:
 					now := time.Now()
@@ -159,10 +250,27 @@ func (s *handler) startListener() {
 							Name: v.Name,
 							Pos:  v.Pos,
 						}
+						currentGTID = v.GTID
+					} else if txMode {
+						// 事务模式下队列中的行都是完整的事务，每次批量处理后都保存最近的事务边界
+						current = mysql.Position{
+							Name: v.Name,
+							Pos:  v.Pos,
+						}
+						currentGTID = v.GTID
 					}
 				case []*model.RowRequest:
+					if s.replayed != nil {
+						if v = s.skipReplayed(v); s.replayed == nil {
+							spoolSeq = replaySeq
+						}
+					}
 					requests = append(requests, v...)
-					needFlush = int64(len(requests)) >= global.Cfg().BulkSize
+					needFlush = int64(len(requests)) >= bulkSize
+				case *model.DDLRequest:
+					// DDL之前的数据先处理
+					ddls = append(ddls, v)
+					needFlush = true
 				}
 			case <-ticker.C:
 				needFlush = true
@@ -170,30 +278,298 @@ func (s *handler) startListener() {
 				return
 			}
 
-			if needFlush && len(requests) > 0 && _transferService.endpointEnable.Load() {
-				err := _transferService.endpoint.Consume(from, requests)
+			if needFlush && len(requests) > 0 && transfer.endpointEnable.Load() {
+				seq, err := s.consume(from, requests)
+				if seq > 0 {
+					spoolSeq = seq
+				}
 				if err != nil {
-					_transferService.endpointEnable.Store(false)
-					metrics.SetDestState(metrics.DestStateFail)
-					logs.Error(err.Error())
-					go _transferService.stopDump()
+					s.fail(err)
+				} else if txMode && current.Name != "" {
+					needSavePos = true
 				}
 				requests = requests[0:0]
 			}
-			if needSavePos && _transferService.endpointEnable.Load() {
-				logs.Infof("save position %s %d", current.Name, current.Pos)
-				if err := _transferService.positionDao.Save(current); err != nil {
+			if len(ddls) > 0 && transfer.endpointEnable.Load() {
+				if err := s.consumeDDL(ddls); err != nil {
+					s.fail(err)
+				}
+				ddls = ddls[0:0]
+			}
+			if needSavePos && transfer.endpointEnable.Load() {
+				if s.pool != nil {
+					checkpoints = append(checkpoints, checkpoint{
+						pos:      current,
+						gtid:     currentGTID,
+						spoolSeq: spoolSeq,
+						batch:    s.pool.dispatched(),
+					})
+				} else if err := s.savePosition(current, currentGTID, spoolSeq); err != nil {
 					logs.Errorf("save sync position %s err %v, close sync", current, err)
-					_transferService.Close()
+					transfer.Close()
 					return
 				}
+				spoolSeq = 0
 				from = current
 			}
+
+			if s.pool != nil && transfer.endpointEnable.Load() {
+				if err := s.pool.failed(); err != nil {
+					s.fail(err)
+					continue
+				}
+				// 保存全部工作协程都已完成的最大位点
+				completed := s.pool.completed()
+				n := 0
+				for n < len(checkpoints) && checkpoints[n].batch <= completed {
+					n++
+				}
+				if n == 0 {
+					continue
+				}
+				var truncate uint64
+				for _, c := range checkpoints[:n] {
+					if c.spoolSeq > 0 {
+						truncate = c.spoolSeq
+					}
+				}
+				last := checkpoints[n-1]
+				checkpoints = checkpoints[n:]
+				if err := s.savePosition(last.pos, last.gtid, truncate); err != nil {
+					logs.Errorf("save sync position %s err %v, close sync", last.pos, err)
+					transfer.Close()
+					return
+				}
+			}
 		}
 	}()
 }
 
+// consumeDDL 并行处理时等待之前的批次全部完成后再处理DDL
+func (s *handler) consumeDDL(ddls []*model.DDLRequest) error {
+	if s.pool != nil {
+		if err := s.pool.wait(); err != nil {
+			return err
+		}
+	}
+	c, ok := s.transfer.endpoint.(endpoint.DDLConsumer)
+	for _, ddl := range ddls {
+		logs.Infof("ddl %s %s.%s", ddl.Type, ddl.Schema, ddl.Table)
+		if ok {
+			if err := c.ConsumeDDL(ddl); err != nil {
+				return errors.Annotatef(err, "consume ddl %s", ddl.Query)
+			}
+		}
+		if !ddl.Retire() {
+			continue
+		}
+		// 移除规则失败不影响同步，原表的数据不会再出现
+		if err := s.transfer.retireRule(ddl); err != nil {
+			logs.Errorf("retire table %s.%s err %s", ddl.Schema, ddl.Table, errors.ErrorStack(err))
+		}
+	}
+	return nil
+}
+
+// checkpoint 并行处理时待保存的位点，batch之前的批次全部完成后才能保存
+type checkpoint struct {
+	pos      mysql.Position
+	gtid     string
+	spoolSeq uint64
+	batch    uint64
+}
+
+// fail 接收端处理失败，停止同步，等待接收端恢复后重新启动
+func (s *handler) fail(err error) {
+	s.transfer.endpointEnable.Store(false)
+	metrics.SetDestState(s.transfer.cfg.PipelineName(), metrics.DestStateFail)
+	logs.Error(errors.ErrorStack(err))
+	go s.transfer.stopDump()
+}
+
+// savePosition 保存位点，截断已处理的预写日志，并通知多目标保存各自的位点
+func (s *handler) savePosition(pos mysql.Position, gtid string, spoolSeq uint64) error {
+	transfer := s.transfer
+	logs.Infof("save position %s %d %s", pos.Name, pos.Pos, gtid)
+	if err := transfer.positionDao.SaveWithGTID(pos, gtid); err != nil {
+		return err
+	}
+	if spoolSeq > 0 {
+		if err := transfer.spool.Truncate(spoolSeq); err != nil {
+			logs.Errorf("truncate spool err %v", err)
+		}
+	}
+	if c, ok := transfer.endpoint.(endpoint.Checkpointer); ok {
+		if err := c.Checkpoint(pos); err != nil {
+			logs.Errorf("save target position %s err %v", pos, err)
+		}
+	}
+	return nil
+}
+
+// consume 启用预写日志时先将批次落盘再处理，返回批次序号
+func (s *handler) consume(from mysql.Position, requests []*model.RowRequest) (uint64, error) {
+	var seq uint64
+	if s.transfer.spool != nil {
+		var err error
+		seq, err = s.transfer.spool.Append(requests)
+		if err != nil {
+			return 0, errors.Annotate(err, "append spool")
+		}
+	}
+	if s.pool != nil {
+		s.pool.dispatch(from, requests)
+		return seq, nil
+	}
+	return seq, s.deliver(from, requests)
+}
+
+// deliver 配置了死信时，结构不匹配的行以及处理失败的行写入死信，不中断同步；目标不可用时仍然返回错误
+func (s *handler) deliver(from mysql.Position, requests []*model.RowRequest) error {
+	transfer := s.transfer
+	if transfer.deadLetter == nil {
+		return transfer.endpoint.Consume(from, requests)
+	}
+
+	valid := make([]*model.RowRequest, 0, len(requests))
+	for _, r := range requests {
+		if rule, ok := global.RuleIns(r.RuleKey); ok && rule.TableColumnSize != len(r.Row) {
+			if err := s.saveDeadLetter(from, r, errors.New("schema mismatching")); err != nil {
+				return err
+			}
+			continue
+		}
+		valid = append(valid, r)
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+
+	err := transfer.endpoint.Consume(from, valid)
+	if err == nil {
+		return nil
+	}
+	if transfer.endpoint.Ping() != nil {
+		return err
+	}
+
+	// 事务模式下不拆分事务，整批写入死信
+	if transfer.cfg.TransactionMode {
+		logs.Warnf("consume err %s, dead letter whole batch of %d rows in transaction mode", err.Error(), len(valid))
+		for _, r := range valid {
+			if e := s.saveDeadLetter(from, r, err); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+
+	// 目标可用，逐行处理找出失败的行；无法确定批次中哪些行已经写入，这些行会再次写入
+	logs.Warnf("consume err %s, retry row by row, rows written before the failure may be duplicated", err.Error())
+	for _, r := range valid {
+		if err := transfer.endpoint.Consume(from, []*model.RowRequest{r}); err != nil {
+			if transfer.endpoint.Ping() != nil {
+				return err
+			}
+			if err := s.saveDeadLetter(from, r, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *handler) saveDeadLetter(from mysql.Position, r *model.RowRequest, cause error) error {
+	letter := &model.DeadLetter{
+		Pipeline:   s.transfer.cfg.Name,
+		RuleKey:    r.RuleKey,
+		Action:     r.Action,
+		Timestamp:  r.Timestamp,
+		Row:        r.Row,
+		Old:        r.Old,
+		Error:      cause.Error(),
+		PosName:    from.Name,
+		Pos:        from.Pos,
+		CreateTime: time.Now().Unix(),
+	}
+	if r.Tx != nil {
+		letter.TxId = r.Tx.Id
+	}
+	if err := s.transfer.deadLetter.Save(letter); err != nil {
+		return errors.Annotate(err, "save dead letter")
+	}
+	metrics.UpdateDeadLetterNum(r.RuleKey)
+	logs.Warnf("dead letter %s %s: %s", r.RuleKey, r.Action, cause.Error())
+	return nil
+}
+
+// replaySpool 重放上次未截断的批次，这些批次之后会随着位点的保存被截断
+func (s *handler) replaySpool(from mysql.Position) (uint64, error) {
+	if s.transfer.spool == nil {
+		return 0, nil
+	}
+
+	var seqs []uint64
+	var batches [][]*model.RowRequest
+	var mark *replayMark
+	err := s.transfer.spool.ForEach(func(seq uint64, requests []*model.RowRequest) error {
+		if last := len(requests) - 1; last >= 0 && requests[last].PosName != "" {
+			mark = &replayMark{name: requests[last].PosName, pos: requests[last].Pos, row: requests[last].RowIndex}
+		}
+		// 重启后规则可能已经变化，跳过没有规则的行
+		valid := requests[:0]
+		for _, r := range requests {
+			if global.RuleInsExist(r.RuleKey) {
+				valid = append(valid, r)
+			}
+		}
+		seqs = append(seqs, seq)
+		batches = append(batches, valid)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Annotate(err, "read spool")
+	}
+
+	var last uint64
+	for i, requests := range batches {
+		if len(requests) == 0 {
+			last = seqs[i]
+			continue
+		}
+		if err := s.deliver(from, requests); err != nil {
+			return last, errors.Annotatef(err, "replay spool batch %d", seqs[i])
+		}
+		last = seqs[i]
+		logs.Infof("replay spool batch %d, %d rows", seqs[i], len(requests))
+	}
+	s.replayed = mark
+	return last, nil
+}
+
+// replayMark 行在binlog中的位置
+type replayMark struct {
+	name string
+	pos  uint32
+	row  int
+}
+
+// skipReplayed 跳过重放过的行，遇到之后的行时不再检查
+func (s *handler) skipReplayed(rows []*model.RowRequest) []*model.RowRequest {
+	mark := s.replayed
+	for i, r := range rows {
+		c := model.ComparePosition(mysql.Position{Name: r.PosName, Pos: r.Pos}, mysql.Position{Name: mark.name, Pos: mark.pos})
+		if c > 0 || (c == 0 && r.RowIndex > mark.row) {
+			logs.Infof("skip %d rows replayed from spool before %s %d", i, mark.name, mark.pos)
+			s.replayed = nil
+			return rows[i:]
+		}
+	}
+	return rows[:0]
+}
+
 func (s *handler) stopListener() {
 	log.Println("transfer stop")
 	s.stop <- struct{}{}
+	s.queue.close()
 }
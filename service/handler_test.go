@@ -0,0 +1,181 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/storage"
+)
+
+func newSpoolHandler(t *testing.T, key string, e *recordEndpoint) *handler {
+	s := newTestHandler(e)
+	s.transfer.spool = storage.NewSpoolStorage(key)
+	if err := s.transfer.spool.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	s.transfer.positionDao = storage.NewPositionStorage(key)
+	if err := s.transfer.positionDao.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func spoolRow(ruleKey string, id int, pos uint32) *model.RowRequest {
+	r := testRow(ruleKey, id, 0)
+	r.PosName, r.Pos = "mysql-bin.000001", pos
+	return r
+}
+
+func TestReplaySpool(t *testing.T) {
+	addTestRule("eseap.t_spool_kept")
+	defer global.RemoveRuleIns("eseap.t_spool_kept")
+	addTestRule("eseap.t_spool_removed")
+
+	// 落盘之后未保存位点即停止
+	before := newSpoolHandler(t, "test_spool_replay", &recordEndpoint{})
+	batches := [][]*model.RowRequest{
+		{spoolRow("eseap.t_spool_kept", 1, 100), spoolRow("eseap.t_spool_removed", 1, 200)},
+		{spoolRow("eseap.t_spool_removed", 2, 300)},
+		{spoolRow("eseap.t_spool_kept", 2, 400), spoolRow("eseap.t_spool_removed", 3, 500)},
+	}
+	var last uint64
+	for _, requests := range batches {
+		seq, err := before.transfer.spool.Append(requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = seq
+	}
+
+	// 重启后规则被删除的行被跳过，只包含这些行的批次也不再写入
+	global.RemoveRuleIns("eseap.t_spool_removed")
+	e := &recordEndpoint{}
+	after := newSpoolHandler(t, "test_spool_replay", e)
+	seq, err := after.replaySpool(mysql.Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != last {
+		t.Fatalf("expect replay to seq %d, got %d", last, seq)
+	}
+	rows := e.received()
+	if len(rows) != 2 {
+		t.Fatalf("expect 2 rows replayed, got %d", len(rows))
+	}
+	for _, r := range rows {
+		if r.RuleKey != "eseap.t_spool_kept" {
+			t.Fatalf("unexpected row of %s replayed", r.RuleKey)
+		}
+	}
+
+	// canal从保存的位点重新读取，重放过的行不再处理，只处理之后的行
+	reread := []*model.RowRequest{
+		spoolRow("eseap.t_spool_kept", 1, 100),
+		spoolRow("eseap.t_spool_kept", 2, 400),
+		spoolRow("eseap.t_spool_kept", 3, 500),
+	}
+	if left := after.skipReplayed(reread[:2]); len(left) != 0 || after.replayed == nil {
+		t.Fatalf("expect replayed rows skipped, got %d", len(left))
+	}
+	next := spoolRow("eseap.t_spool_kept", 4, 600)
+	left := after.skipReplayed(append(reread[2:], next))
+	if len(left) != 1 || left[0] != next || after.replayed != nil {
+		t.Fatalf("expect only row after spool kept, got %d", len(left))
+	}
+
+	// 保存位点后截断预写日志，再次重启不再重放
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 100}
+	if err := after.savePosition(pos, "", seq); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := after.transfer.positionDao.Get(); saved.Compare(pos) != 0 {
+		t.Fatalf("position %v, expect %v", saved, pos)
+	}
+	e = &recordEndpoint{}
+	seq, err = newSpoolHandler(t, "test_spool_replay", e).replaySpool(mysql.Position{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 0 || len(e.received()) != 0 {
+		t.Fatalf("expect empty spool after truncate, got seq %d and %d rows", seq, len(e.received()))
+	}
+}
+
+func TestReplaySpoolFailure(t *testing.T) {
+	addTestRule("eseap.t_spool_fail")
+	defer global.RemoveRuleIns("eseap.t_spool_fail")
+
+	s := newSpoolHandler(t, "test_spool_fail", &recordEndpoint{})
+	first, err := s.transfer.spool.Append([]*model.RowRequest{testRow("eseap.t_spool_fail", 1, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.transfer.spool.Append([]*model.RowRequest{testRow("eseap.t_spool_fail", 2, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 写入失败时返回已经重放的最后一个批次
+	var calls int
+	e := &recordEndpoint{fail: func(r *model.RowRequest) error {
+		calls++
+		if calls > 1 {
+			return errTestConsume
+		}
+		return nil
+	}}
+	seq, err := newSpoolHandler(t, "test_spool_fail", e).replaySpool(mysql.Position{})
+	if err == nil {
+		t.Fatal("expect replay error")
+	}
+	if seq != first || len(e.received()) != 1 {
+		t.Fatalf("expect replay stopped after seq %d, got seq %d and %d rows", first, seq, len(e.received()))
+	}
+}
+
+func TestReplaySpoolDeliverOnce(t *testing.T) {
+	addTestRule("eseap.t_spool_once")
+	defer global.RemoveRuleIns("eseap.t_spool_once")
+
+	spooled := newSpoolHandler(t, "test_spool_once", &recordEndpoint{})
+	if _, err := spooled.transfer.spool.Append([]*model.RowRequest{
+		spoolRow("eseap.t_spool_once", 1, 100),
+		spoolRow("eseap.t_spool_once", 2, 200),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后先重放，canal再从保存的位点读取同样的行以及之后的行
+	e := &recordEndpoint{}
+	transfer := newSpoolHandler(t, "test_spool_once", e).transfer
+	transfer.endpointEnable.Store(true)
+	s := newHandler(transfer)
+	s.startListener()
+	defer s.stopListener()
+	s.queue.put([]*model.RowRequest{spoolRow("eseap.t_spool_once", 1, 100), spoolRow("eseap.t_spool_once", 2, 200)})
+	s.queue.put([]*model.RowRequest{spoolRow("eseap.t_spool_once", 3, 300)})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(e.received()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(2 * time.Duration(transfer.cfg.FlushBulkInterval) * time.Millisecond)
+	// 重放的行从预写日志解码，主键为int64
+	counts := make(map[int64]int)
+	for _, r := range e.received() {
+		switch id := r.Row[0].(type) {
+		case int:
+			counts[int64(id)]++
+		case int64:
+			counts[id]++
+		}
+	}
+	for id := int64(1); id <= 3; id++ {
+		if counts[id] != 1 {
+			t.Fatalf("row %d delivered %d times", id, counts[id])
+		}
+	}
+}
@@ -34,11 +34,13 @@ const (
 	_globalRET = "___RET___"
 	_globalROW = "___ROW___"
 	_globalACT = "___ACT___"
+	_globalPIP = "___PIP___"
 )
 
 var (
-	_pool *luaStatePool
-	_ds   *canal.Canal
+	_pool     *luaStatePool
+	_ds       = make(map[string]*canal.Canal) // 管道名称 -> 数据源
+	_lockOfDs sync.RWMutex
 
 	_httpClient *httpclient.HttpClient
 )
@@ -48,11 +50,25 @@ type luaStatePool struct {
 	saved []*lua.LState
 }
 
-func InitActuator(ds *canal.Canal) {
-	_ds = ds
-	_pool = &luaStatePool{
-		saved: make([]*lua.LState, 0, 3),
+func InitActuator(pipeline string, ds *canal.Canal) {
+	_lockOfDs.Lock()
+	_ds[pipeline] = ds
+	if _pool == nil {
+		_pool = &luaStatePool{
+			saved: make([]*lua.LState, 0, 3),
+		}
 	}
+	_lockOfDs.Unlock()
+}
+
+// 当前执行脚本的规则所属管道的数据源
+func datasource(L *lua.LState) *canal.Canal {
+	pipeline := lua.LVAsString(L.GetGlobal(_globalPIP))
+
+	_lockOfDs.RLock()
+	defer _lockOfDs.RUnlock()
+
+	return _ds[pipeline]
 }
 
 func (p *luaStatePool) Get() *lua.LState {
@@ -41,7 +41,7 @@ func selectOne(L *lua.LState) int {
 
 	logs.Infof("lua db module execute sql: %s", sql)
 
-	rs, err := _ds.Execute(sql)
+	rs, err := datasource(L).Execute(sql)
 	if err != nil {
 		logs.Error(err.Error())
 		L.Push(lua.LNil)
@@ -85,7 +85,7 @@ func selectList(L *lua.LState) int {
 
 	logs.Infof("lua db module execute sql: %s", sql)
 
-	rs, err := _ds.Execute(sql)
+	rs, err := datasource(L).Execute(sql)
 	if err != nil {
 		logs.Error(err.Error())
 		L.Push(lua.LNil)
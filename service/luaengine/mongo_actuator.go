@@ -114,6 +114,7 @@ func DoMongoOps(input map[string]interface{}, action string, rule *global.Rule)
 	L.SetGlobal(_globalRET, ret)
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
+	L.SetGlobal(_globalPIP, lua.LString(rule.Pipeline))
 
 	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
 	L.Push(funcFromProto)
@@ -40,12 +40,25 @@ var _mqModuleApi = map[string]lua.LGFunction{
 	"SEND": msgSend,
 }
 
+// msgSend SEND(topic, msg[, key[, headers]])，key为消息的key，如kafka按照key选择分区；
+// headers为自定义的消息头，如{source="crm"}
 func msgSend(L *lua.LState) int {
 	topic := L.CheckAny(1)
 	msg := L.CheckAny(2)
 
 	ret := L.GetGlobal(_globalRET)
-	L.SetTable(ret, msg, topic)
+	if L.GetTop() < 3 {
+		L.SetTable(ret, msg, topic)
+		return 0
+	}
+
+	val := L.NewTable()
+	val.RawSetInt(1, topic)
+	val.RawSetInt(2, L.Get(3))
+	if L.GetTop() >= 4 {
+		val.RawSetInt(3, L.CheckTable(4))
+	}
+	L.SetTable(ret, msg, val)
 	return 0
 }
 
@@ -59,6 +72,7 @@ func DoMQOps(input map[string]interface{}, previous map[string]interface{}, acti
 	L.SetGlobal(_globalRET, ret)
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
+	L.SetGlobal(_globalPIP, lua.LString(rule.Pipeline))
 
 	if action == canal.UpdateAction {
 		oldRow := L.NewTable()
@@ -77,7 +91,20 @@ func DoMQOps(input map[string]interface{}, previous map[string]interface{}, acti
 	ret.ForEach(func(k lua.LValue, v lua.LValue) {
 		resp := new(model.MQRespond)
 		resp.ByteArray = lvToByteArray(k)
-		resp.Topic = lvToString(v)
+		if t, ok := v.(*lua.LTable); ok {
+			resp.Topic = lvToString(t.RawGetInt(1))
+			if key := t.RawGetInt(2); key != lua.LNil {
+				resp.Key = lvToString(key)
+			}
+			if headers, ok := t.RawGetInt(3).(*lua.LTable); ok {
+				resp.Headers = make(map[string]string)
+				headers.ForEach(func(hk lua.LValue, hv lua.LValue) {
+					resp.Headers[lvToString(hk)] = lvToString(hv)
+				})
+			}
+		} else {
+			resp.Topic = lvToString(v)
+		}
 		list = append(list, resp)
 	})
 
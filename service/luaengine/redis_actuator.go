@@ -176,6 +176,7 @@ func DoRedisOps(input map[string]interface{}, previous map[string]interface{}, a
 	L.SetGlobal(_globalRET, ret)
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
+	L.SetGlobal(_globalPIP, lua.LString(rule.Pipeline))
 
 	if action == canal.UpdateAction {
 		oldRow := L.NewTable()
@@ -27,6 +27,7 @@ func DoScript(input map[string]interface{}, action string, rule *global.Rule) er
 
 	L.SetGlobal(_globalROW, row)
 	L.SetGlobal(_globalACT, lua.LString(action))
+	L.SetGlobal(_globalPIP, lua.LString(rule.Pipeline))
 
 	funcFromProto := L.NewFunctionFromProto(rule.LuaProto)
 	L.Push(funcFromProto)
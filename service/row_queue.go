@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"sync"
+
+	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
+)
+
+const (
+	_queueSlots       = 4096 // 队列中的消息数，位点消息不计入行数及字节数
+	_requestOverhead  = 64   // 每个请求的固定开销估算
+	_valueOverhead    = 16   // 每个字段的固定开销估算
+	_defaultValueSize = 8    // 数值等定长字段的大小估算
+)
+
+// rowQueue canal事件协程与listener之间的有界队列，按行数及字节数限制。
+// 超出限制时阻塞canal的事件协程，canal停止读取binlog，直到listener取走数据
+type rowQueue struct {
+	pipeline string
+	ch       chan interface{}
+	done     chan struct{}
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	rows     int64
+	bytes    int64
+	maxRows  int64
+	maxBytes int64
+}
+
+func newRowQueue(pipeline string, maxRows, maxBytes int64) *rowQueue {
+	q := &rowQueue{
+		pipeline: pipeline,
+		ch:       make(chan interface{}, _queueSlots),
+		done:     make(chan struct{}),
+		maxRows:  maxRows,
+		maxBytes: maxBytes,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// put 队列已满时阻塞；队列为空时超出限制的单个批次也允许放入，避免永远阻塞
+func (q *rowQueue) put(v interface{}) {
+	if requests, ok := v.([]*model.RowRequest); ok {
+		rows, bytes := int64(len(requests)), requestsSize(requests)
+		q.lock.Lock()
+		for !q.closed && q.rows > 0 && (q.rows+rows > q.maxRows || q.bytes+bytes > q.maxBytes) {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.lock.Unlock()
+			return
+		}
+		q.rows += rows
+		q.bytes += bytes
+		q.updateMetrics()
+		q.lock.Unlock()
+	}
+
+	select {
+	case q.ch <- v:
+	case <-q.done:
+	}
+}
+
+// release listener取出数据后释放占用的额度
+func (q *rowQueue) release(v interface{}) {
+	requests, ok := v.([]*model.RowRequest)
+	if !ok {
+		return
+	}
+	q.lock.Lock()
+	q.rows -= int64(len(requests))
+	q.bytes -= requestsSize(requests)
+	q.updateMetrics()
+	q.lock.Unlock()
+	q.cond.Broadcast()
+}
+
+// close listener停止后唤醒阻塞的canal事件协程，之后放入的数据被丢弃
+func (q *rowQueue) close() {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
+	q.closed = true
+	q.rows, q.bytes = 0, 0
+	q.updateMetrics()
+	q.lock.Unlock()
+	close(q.done)
+	q.cond.Broadcast()
+}
+
+// depth 当前队列中的行数及字节数
+func (q *rowQueue) depth() (int64, int64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.rows, q.bytes
+}
+
+// updateMetrics 在lock内调用
+func (q *rowQueue) updateMetrics() {
+	metrics.SetQueueDepth(q.pipeline, q.rows, q.bytes)
+}
+
+// requestsSize 估算请求占用的内存
+func requestsSize(requests []*model.RowRequest) int64 {
+	var size int64
+	for _, r := range requests {
+		size += _requestOverhead + valuesSize(r.Row) + valuesSize(r.Old)
+	}
+	return size
+}
+
+func valuesSize(values []interface{}) int64 {
+	var size int64
+	for _, v := range values {
+		size += _valueOverhead
+		switch v := v.(type) {
+		case nil:
+		case string:
+			size += int64(len(v))
+		case []byte:
+			size += int64(len(v))
+		default:
+			size += _defaultValueSize
+		}
+	}
+	return size
+}
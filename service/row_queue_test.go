@@ -0,0 +1,100 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"go-mysql-transfer/model"
+)
+
+func putAsync(q *rowQueue, v interface{}) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		q.put(v)
+		close(done)
+	}()
+	return done
+}
+
+func blocked(done chan struct{}) bool {
+	select {
+	case <-done:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+func TestRowQueueBackpressure(t *testing.T) {
+	q := newRowQueue("test", 2, 1<<20)
+	defer q.close()
+
+	// 队列为空时超出限制的单个批次也可以放入
+	first := []*model.RowRequest{testRow("t", 1, 0), testRow("t", 2, 0), testRow("t", 3, 0)}
+	if blocked(putAsync(q, first)) {
+		t.Fatal("oversized batch should be accepted by empty queue")
+	}
+	if rows, bytes := q.depth(); rows != 3 || bytes != requestsSize(first) {
+		t.Fatalf("unexpected depth %d %d", rows, bytes)
+	}
+
+	// 位点消息不受限制
+	if blocked(putAsync(q, model.PosRequest{Name: "mysql-bin.000001", Pos: 4})) {
+		t.Fatal("position should not be blocked")
+	}
+
+	second := putAsync(q, []*model.RowRequest{testRow("t", 4, 0)})
+	if !blocked(second) {
+		t.Fatal("expect put blocked when queue is full")
+	}
+
+	v := <-q.ch
+	q.release(v)
+	if blocked(second) {
+		t.Fatal("expect put resumed after release")
+	}
+	if rows, _ := q.depth(); rows != 1 {
+		t.Fatalf("expect 1 row in queue, got %d", rows)
+	}
+}
+
+func TestRowQueueByteLimit(t *testing.T) {
+	large := []*model.RowRequest{{RuleKey: "t", Row: []interface{}{string(make([]byte, 1024))}}}
+	q := newRowQueue("test", 100, requestsSize(large))
+	defer q.close()
+
+	q.put(large)
+	done := putAsync(q, []*model.RowRequest{testRow("t", 1, 0)})
+	if !blocked(done) {
+		t.Fatal("expect put blocked when bytes exceeded")
+	}
+	q.release(<-q.ch)
+	if blocked(done) {
+		t.Fatal("expect put resumed after release")
+	}
+}
+
+func TestRowQueueClose(t *testing.T) {
+	q := newRowQueue("test", 1, 1<<20)
+	q.put([]*model.RowRequest{testRow("t", 1, 0)})
+	done := putAsync(q, []*model.RowRequest{testRow("t", 2, 0)})
+	if !blocked(done) {
+		t.Fatal("expect put blocked when queue is full")
+	}
+
+	// 停止后唤醒阻塞的写入，丢弃之后的数据
+	q.close()
+	if blocked(done) {
+		t.Fatal("expect blocked put released on close")
+	}
+	if rows, bytes := q.depth(); rows != 0 || bytes != 0 {
+		t.Fatalf("expect empty depth after close, got %d %d", rows, bytes)
+	}
+	if blocked(putAsync(q, []*model.RowRequest{testRow("t", 3, 0)})) {
+		t.Fatal("put after close should not block")
+	}
+	if len(q.ch) != 1 {
+		t.Fatalf("expect rows after close dropped, got %d in channel", len(q.ch))
+	}
+	q.close()
+}
@@ -18,25 +18,30 @@
 package service
 
 import (
+	"github.com/juju/errors"
+
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/service/election"
 )
 
 var (
-	_transferService *TransferService
-	_electionService election.Service
-	_clusterService  *ClusterService
+	_transferServices []*TransferService
+	_electionService  election.Service
+	_clusterService   *ClusterService
 )
 
 func Initialize() error {
-	transferService := &TransferService{
-		loopStopSignal: make(chan struct{}, 1),
-	}
-	err := transferService.initialize()
-	if err != nil {
-		return err
+	for _, cfg := range global.PipelineCfgs() {
+		transferService := &TransferService{
+			cfg:            cfg,
+			loopStopSignal: make(chan struct{}, 1),
+		}
+		err := transferService.initialize()
+		if err != nil {
+			return err
+		}
+		_transferServices = append(_transferServices, transferService)
 	}
-	_transferService = transferService
 
 	if global.Cfg().IsCluster() {
 		_clusterService = &ClusterService{
@@ -52,16 +57,61 @@ func StartUp() {
 	if global.Cfg().IsCluster() {
 		_clusterService.boot()
 	} else {
-		_transferService.StartUp()
+		for _, s := range _transferServices {
+			s.StartUp()
+		}
 	}
 }
 
 func Close() {
-	_transferService.Close()
+	for _, s := range _transferServices {
+		s.Close()
+	}
 }
 
+// TransferServiceIns 第一个管道，只配置了一个管道时即为默认管道
 func TransferServiceIns() *TransferService {
-	return _transferService
+	return _transferServices[0]
+}
+
+func TransferServiceList() []*TransferService {
+	return _transferServices
+}
+
+// TransferServiceOf 按照名称查找管道，默认管道的名称为空或者default
+func TransferServiceOf(pipeline string) (*TransferService, bool) {
+	for _, s := range _transferServices {
+		if s.cfg.Name == pipeline || s.cfg.PipelineName() == pipeline {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// EnablePipeline 启动指定管道，集群模式下只有leader可以操作
+func EnablePipeline(pipeline string) error {
+	s, ok := TransferServiceOf(pipeline)
+	if !ok {
+		return errors.Errorf("pipeline '%s' not found", pipeline)
+	}
+	if global.Cfg().IsCluster() && !global.IsLeader() {
+		return errors.Errorf("current node is not the leader")
+	}
+	s.Enable()
+	return nil
+}
+
+// DisablePipeline 停止指定管道
+func DisablePipeline(pipeline string) error {
+	s, ok := TransferServiceOf(pipeline)
+	if !ok {
+		return errors.Errorf("pipeline '%s' not found", pipeline)
+	}
+	if global.Cfg().IsCluster() && !global.IsLeader() {
+		return errors.Errorf("current node is not the leader")
+	}
+	s.Disable()
+	return nil
 }
 
 func ClusterServiceIns() *ClusterService {
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/storage"
+)
+
+// TestMain 使用临时目录中的配置及boltdb
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		panic(err)
+	}
+
+	text := `
+addr: 127.0.0.1:3306
+user: root
+pass: 123456
+charset: utf8
+slave_id: 1001
+data_dir: ` + dir + `
+target: redis
+redis_addrs: 127.0.0.1:6379
+rule:
+  - schema: eseap
+    table: t_user
+`
+	file := filepath.Join(dir, "app.yml")
+	if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+		panic(err)
+	}
+	if err := global.Initialize(file); err != nil {
+		panic(err)
+	}
+	if err := storage.Initialize(); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	storage.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// recordEndpoint 记录接收到的行，fail返回非nil时处理失败
+type recordEndpoint struct {
+	lock  sync.Mutex
+	rows  []*model.RowRequest
+	delay time.Duration
+	fail  func(r *model.RowRequest) error
+}
+
+func (s *recordEndpoint) Connect() error {
+	return nil
+}
+
+func (s *recordEndpoint) Ping() error {
+	return nil
+}
+
+func (s *recordEndpoint) Consume(_ mysql.Position, rows []*model.RowRequest) error {
+	if s.delay > 0 {
+		time.Sleep(s.delay)
+	}
+	for _, r := range rows {
+		if s.fail != nil {
+			if err := s.fail(r); err != nil {
+				return err
+			}
+		}
+	}
+	s.lock.Lock()
+	s.rows = append(s.rows, rows...)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *recordEndpoint) Stock(rows []*model.RowRequest) int64 {
+	return int64(len(rows))
+}
+
+func (s *recordEndpoint) Close() {}
+
+func (s *recordEndpoint) received() []*model.RowRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*model.RowRequest(nil), s.rows...)
+}
+
+func newTestHandler(e *recordEndpoint) *handler {
+	return &handler{
+		transfer: &TransferService{cfg: global.Cfg(), endpoint: e},
+	}
+}
+
+// addTestRule 注册主键为第一列的规则
+func addTestRule(ruleKey string) {
+	global.AddRuleIns(ruleKey, &global.Rule{
+		TableInfo: &schema.Table{PKColumns: []int{0}},
+	})
+}
+
+func testRow(ruleKey string, id int, version int) *model.RowRequest {
+	return &model.RowRequest{RuleKey: ruleKey, Row: []interface{}{id, version}}
+}
+
+var errTestConsume = errors.New("consume failed")
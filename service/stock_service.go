@@ -36,6 +36,7 @@ import (
 
 // 存量数据
 type StockService struct {
+	cfg      *global.Config
 	canal    *canal.Canal
 	endpoint endpoint.Endpoint
 
@@ -47,9 +48,10 @@ type StockService struct {
 	shutoff       *atomic.Bool
 }
 
-func NewStockService() *StockService {
+func NewStockService(cfg *global.Config) *StockService {
 	return &StockService{
-		queueCh:   make(chan []*model.RowRequest, global.Cfg().Maxprocs),
+		cfg:       cfg,
+		queueCh:   make(chan []*model.RowRequest, cfg.Maxprocs),
 		counter:   make(map[string]int64),
 		totalRows: make(map[string]int64),
 		shutoff:   atomic.NewBool(false),
@@ -57,38 +59,13 @@ func NewStockService() *StockService {
 }
 
 func (s *StockService) Run() error {
-	canalCfg := canal.NewDefaultConfig()
-	canalCfg.Addr = global.Cfg().Addr
-	canalCfg.User = global.Cfg().User
-	canalCfg.Password = global.Cfg().Password
-	canalCfg.Charset = global.Cfg().Charset
-	canalCfg.Flavor = global.Cfg().Flavor
-	canalCfg.ServerID = global.Cfg().SlaveID
-	canalCfg.Dump.ExecutionPath = global.Cfg().DumpExec
-	canalCfg.Dump.DiscardErr = false
-	canalCfg.Dump.SkipMasterData = global.Cfg().SkipMasterData
-
-	if c, err := canal.NewCanal(canalCfg); err != nil {
-		errors.Trace(err)
-	} else {
-		s.canal = c
+	if err := s.prepare(); err != nil {
+		return err
 	}
 
-	if err := s.completeRules(); err != nil {
-		return errors.Trace(err)
-	}
-	s.addDumpDatabaseOrTable()
-
-	endpoint := endpoint.NewEndpoint(s.canal)
-	if err := endpoint.Connect(); err != nil {
-		log.Println(err.Error())
-		return errors.Trace(err)
-	}
-	s.endpoint = endpoint
-
 	startTime := dates.NowMillisecond()
-	log.Println(fmt.Sprintf("bulk size: %d", global.Cfg().BulkSize))
-	for _, rule := range global.RuleInsList() {
+	log.Println(fmt.Sprintf("bulk size: %d", s.cfg.BulkSize))
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
 		if rule.OrderByColumn == "" {
 			return errors.New("empty order_by_column not allowed")
 		}
@@ -108,7 +85,7 @@ func (s *StockService) Run() error {
 		s.counter[fullName] = 0
 
 		var batch int64
-		size := global.Cfg().BulkSize
+		size := s.cfg.BulkSize
 		if batch%size == 0 {
 			batch = totalRow / size
 		} else {
@@ -116,7 +93,7 @@ func (s *StockService) Run() error {
 		}
 
 		var processed atomic.Int64
-		for i := 0; i < global.Cfg().Maxprocs; i++ {
+		for i := 0; i < s.cfg.Maxprocs; i++ {
 			s.wg.Add(1)
 			go func(_fullName, _columns string, _rule *global.Rule) {
 				for {
@@ -128,7 +105,7 @@ func (s *StockService) Run() error {
 						break
 					}
 
-					s.imports(_fullName, requests)
+					s.imports(_fullName, _rule, requests)
 					if processed.Load() > batch {
 						break
 					}
@@ -157,6 +134,39 @@ func (s *StockService) Run() error {
 	return nil
 }
 
+// prepare 创建canal、补全规则、连接接收端
+func (s *StockService) prepare() error {
+	canalCfg := canal.NewDefaultConfig()
+	canalCfg.Addr = s.cfg.Addr
+	canalCfg.User = s.cfg.User
+	canalCfg.Password = s.cfg.Password
+	canalCfg.Charset = s.cfg.Charset
+	canalCfg.Flavor = s.cfg.Flavor
+	canalCfg.ServerID = s.cfg.SlaveID
+	canalCfg.Dump.ExecutionPath = s.cfg.DumpExec
+	canalCfg.Dump.DiscardErr = false
+	canalCfg.Dump.SkipMasterData = s.cfg.SkipMasterData
+
+	if c, err := canal.NewCanal(canalCfg); err != nil {
+		return errors.Trace(err)
+	} else {
+		s.canal = c
+	}
+
+	if err := s.completeRules(); err != nil {
+		return errors.Trace(err)
+	}
+	s.addDumpDatabaseOrTable()
+
+	endpoint := endpoint.NewEndpoint(s.cfg, s.canal)
+	if err := endpoint.Connect(); err != nil {
+		log.Println(err.Error())
+		return errors.Trace(err)
+	}
+	s.endpoint = endpoint
+	return nil
+}
+
 func (s *StockService) export(fullName, columns string, batch int64, rule *global.Rule) ([]*model.RowRequest, error) {
 	if s.shutoff.Load() {
 		return nil, errors.New("shutoff")
@@ -183,7 +193,7 @@ func (s *StockService) export(fullName, columns string, batch int64, rule *globa
 			}
 			rowValues = append(rowValues, val)
 			request.Action = canal.InsertAction
-			request.RuleKey = global.RuleKey(rule.Schema, rule.Table)
+			request.RuleKey = s.cfg.RuleKey(rule.Schema, rule.Table)
 			request.Row = rowValues
 		}
 		requests = append(requests, request)
@@ -194,7 +204,7 @@ func (s *StockService) export(fullName, columns string, batch int64, rule *globa
 
 // 构造SQL
 func (s *StockService) buildSql(fullName, columns string, offset int64, rule *global.Rule) string {
-	size := global.Cfg().BulkSize
+	size := s.cfg.BulkSize
 	if len(rule.TableInfo.PKColumns) == 0 {
 		return fmt.Sprintf("select %s from %s order by %s limit %d,%d", columns, fullName, rule.OrderByColumn, offset, size)
 	}
@@ -206,12 +216,22 @@ func (s *StockService) buildSql(fullName, columns string, offset int64, rule *gl
 	return sql
 }
 
-func (s *StockService) imports(fullName string, requests []*model.RowRequest) {
+func (s *StockService) imports(fullName string, rule *global.Rule, requests []*model.RowRequest) {
 	if s.shutoff.Load() {
 		return
 	}
 
-	succeeds := s.endpoint.Stock(requests)
+	// 不满足过滤条件的行视为已处理
+	matched := make([]*model.RowRequest, 0, len(requests))
+	for _, r := range requests {
+		if endpoint.MatchFilter(rule, r.Action, r.Row, nil) {
+			matched = append(matched, r)
+		}
+	}
+	succeeds := int64(len(requests) - len(matched))
+	if len(matched) > 0 {
+		succeeds += s.endpoint.Stock(matched)
+	}
 	count := s.incCounter(fullName, succeeds)
 	log.Println(fmt.Sprintf("%s 导入数据 %d 条", fullName, count))
 }
@@ -266,7 +286,7 @@ func (s *StockService) offset(currentPage int64) int64 {
 	var offset int64
 
 	if currentPage > 0 {
-		offset = (currentPage - 1) * global.Cfg().BulkSize
+		offset = (currentPage - 1) * s.cfg.BulkSize
 	}
 
 	return offset
@@ -291,13 +311,13 @@ func (s *StockService) incCounter(name string, n int64) int64 {
 
 func (s *StockService) completeRules() error {
 	wildcards := make(map[string]bool)
-	for _, rc := range global.Cfg().RuleConfigs {
+	for _, rc := range s.cfg.RuleConfigs {
 		if rc.Table == "*" {
 			return errors.Errorf("wildcard * is not allowed for table name")
 		}
 
 		if regexp.QuoteMeta(rc.Table) != rc.Table { //通配符
-			if _, ok := wildcards[global.RuleKey(rc.Schema, rc.Schema)]; ok {
+			if _, ok := wildcards[s.cfg.RuleKey(rc.Schema, rc.Schema)]; ok {
 				return errors.Errorf("duplicate wildcard table defined for %s.%s", rc.Schema, rc.Table)
 			}
 
@@ -318,7 +338,8 @@ func (s *StockService) completeRules() error {
 					return errors.Trace(err)
 				}
 				newRule.Table = tableName
-				ruleKey := global.RuleKey(rc.Schema, tableName)
+				newRule.Pipeline = s.cfg.Name
+				ruleKey := s.cfg.RuleKey(rc.Schema, tableName)
 				global.AddRuleIns(ruleKey, newRule)
 			}
 		} else {
@@ -326,18 +347,19 @@ func (s *StockService) completeRules() error {
 			if err != nil {
 				return errors.Trace(err)
 			}
-			ruleKey := global.RuleKey(rc.Schema, rc.Table)
+			newRule.Pipeline = s.cfg.Name
+			ruleKey := s.cfg.RuleKey(rc.Schema, rc.Table)
 			global.AddRuleIns(ruleKey, newRule)
 		}
 	}
 
-	for _, rule := range global.RuleInsList() {
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
 		tableMata, err := s.canal.GetTable(rule.Schema, rule.Table)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		if len(tableMata.PKColumns) == 0 {
-			if !global.Cfg().SkipNoPkTable {
+			if !s.cfg.SkipNoPkTable {
 				return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
 			}
 		}
@@ -352,7 +374,7 @@ func (s *StockService) completeRules() error {
 		}
 
 		if rule.LuaEnable() {
-			if err := rule.CompileLuaScript(global.Cfg().DataDir); err != nil {
+			if err := rule.CompileLuaScript(s.cfg.DataDir); err != nil {
 				return err
 			}
 		}
@@ -365,7 +387,7 @@ func (s *StockService) addDumpDatabaseOrTable() {
 	var schema string
 	schemas := make(map[string]int)
 	tables := make([]string, 0, global.RuleInsTotal())
-	for _, rule := range global.RuleInsList() {
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
 		schema = rule.Table
 		schemas[rule.Schema] = 1
 		tables = append(tables, rule.Table)
@@ -21,49 +21,65 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
 	"go.uber.org/atomic"
 
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
 	"go-mysql-transfer/service/endpoint"
 	"go-mysql-transfer/storage"
 	"go-mysql-transfer/util/logs"
 )
 
-const _transferLoopInterval = 1
+const (
+	_transferLoopInterval = 1
+	_binlogEventsPageSize = 1000
+)
+
+// sqlExecutor 在源库上执行查询，由canal实现
+type sqlExecutor interface {
+	Execute(cmd string, args ...interface{}) (*mysql.Result, error)
+}
 
 type TransferService struct {
+	cfg          *global.Config
 	canal        *canal.Canal
 	canalCfg     *canal.Config
 	canalHandler *handler
 	canalEnable  atomic.Bool
 	lockOfCanal  sync.Mutex
 	firstsStart  atomic.Bool
+	disabled     atomic.Bool // 管道被单独停止
 
 	wg             sync.WaitGroup
 	endpoint       endpoint.Endpoint
 	endpointEnable atomic.Bool
 	positionDao    storage.PositionStorage
+	spool          storage.SpoolStorage
+	deadLetter     storage.DeadLetterStorage
+	history        *endpoint.SchemaHistory // 表结构历史，没有开启时为nil
 	loopStopSignal chan struct{}
 }
 
 func (s *TransferService) initialize() error {
 	s.canalCfg = canal.NewDefaultConfig()
-	s.canalCfg.Addr = global.Cfg().Addr
-	s.canalCfg.User = global.Cfg().User
-	s.canalCfg.Password = global.Cfg().Password
-	s.canalCfg.Charset = global.Cfg().Charset
-	s.canalCfg.Flavor = global.Cfg().Flavor
-	s.canalCfg.ServerID = global.Cfg().SlaveID
-	s.canalCfg.Dump.ExecutionPath = global.Cfg().DumpExec
+	s.canalCfg.Addr = s.cfg.Addr
+	s.canalCfg.User = s.cfg.User
+	s.canalCfg.Password = s.cfg.Password
+	s.canalCfg.Charset = s.cfg.Charset
+	s.canalCfg.Flavor = s.cfg.Flavor
+	s.canalCfg.ServerID = s.cfg.SlaveID
+	s.canalCfg.Dump.ExecutionPath = s.cfg.DumpExec
 	s.canalCfg.Dump.DiscardErr = false
-	s.canalCfg.Dump.SkipMasterData = global.Cfg().SkipMasterData
+	s.canalCfg.Dump.SkipMasterData = s.cfg.SkipMasterData
 
 	if err := s.createCanal(); err != nil {
 		return errors.Trace(err)
@@ -75,27 +91,51 @@ func (s *TransferService) initialize() error {
 
 	s.addDumpDatabaseOrTable()
 
-	positionDao := storage.NewPositionStorage()
+	positionDao := storage.NewPositionStorage(s.cfg.PositionKey())
 	if err := positionDao.Initialize(); err != nil {
 		return errors.Trace(err)
 	}
 	s.positionDao = positionDao
 
+	if s.cfg.EnableSpool {
+		spool := storage.NewSpoolStorage(s.cfg.PositionKey())
+		if err := spool.Initialize(); err != nil {
+			return errors.Trace(err)
+		}
+		s.spool = spool
+	}
+
+	if deadLetter := storage.NewDeadLetterStorage(s.cfg); deadLetter != nil {
+		if err := deadLetter.Initialize(); err != nil {
+			return errors.Trace(err)
+		}
+		s.deadLetter = deadLetter
+	}
+
+	history, err := endpoint.SchemaHistoryOf(s.cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s.history = history
+
 	// endpoint
-	endpoint := endpoint.NewEndpoint(s.canal)
+	endpoint := endpoint.NewEndpoint(s.cfg, s.canal)
 	if err := endpoint.Connect(); err != nil {
 		return errors.Trace(err)
 	}
 	// 异步，必须要ping下才能确定连接成功
-	if global.Cfg().IsMongodb() {
+	if s.cfg.IsMongodb() {
 		err := endpoint.Ping()
 		if err != nil {
 			return err
 		}
 	}
 	s.endpoint = endpoint
+	if err := s.restoreTargets(); err != nil {
+		return errors.Trace(err)
+	}
 	s.endpointEnable.Store(true)
-	metrics.SetDestState(metrics.DestStateOK)
+	metrics.SetDestState(s.cfg.PipelineName(), metrics.DestStateOK)
 
 	s.firstsStart.Store(true)
 	s.startLoop()
@@ -103,17 +143,50 @@ func (s *TransferService) initialize() error {
 	return nil
 }
 
+// restoreTargets 多目标时恢复每个目标的位点状态
+func (s *TransferService) restoreTargets() error {
+	c, ok := s.endpoint.(endpoint.Checkpointer)
+	if !ok {
+		return nil
+	}
+	current, err := s.positionDao.Get()
+	if err != nil {
+		return err
+	}
+	return c.Restore(current)
+}
+
 func (s *TransferService) run() error {
 	current, err := s.positionDao.Get()
 	if err != nil {
 		return err
 	}
 
+	if err := s.snapshotSchema(); err != nil {
+		return errors.Trace(err)
+	}
+
+	gset, stored, err := s.loadGTIDSet(s.canal, current)
+	if err != nil {
+		logs.Warnf("load gtid set err %v, run from position only", err)
+		gset, stored = nil, false
+	}
+	if gset != nil {
+		s.canalHandler.gset = gset.Clone()
+	}
+
 	s.wg.Add(1)
-	go func(p mysql.Position) {
+	go func(p mysql.Position, gs mysql.GTIDSet) {
 		s.canalEnable.Store(true)
-		log.Println(fmt.Sprintf("transfer run from position(%s %d)", p.Name, p.Pos))
-		if err := s.canal.RunFrom(p); err != nil {
+		var err error
+		if gs != nil {
+			log.Println(fmt.Sprintf("transfer run from gtid set(%s)", gs.String()))
+			err = s.canal.StartFromGTID(gs)
+		} else {
+			log.Println(fmt.Sprintf("transfer run from position(%s %d)", p.Name, p.Pos))
+			err = s.canal.RunFrom(p)
+		}
+		if err != nil {
 			log.Println(fmt.Sprintf("start transfer : %v", err))
 			logs.Errorf("canal : %v", errors.ErrorStack(err))
 			if s.canalHandler != nil {
@@ -126,19 +199,146 @@ func (s *TransferService) run() error {
 		s.canalEnable.Store(false)
 		s.canal = nil
 		s.wg.Done()
-	}(current)
+	}(current, startGTIDSet(gset, stored))
 
 	// canal未提供回调，停留一秒，确保RunFrom启动成功
 	time.Sleep(time.Second)
 	return nil
 }
 
+// 只有已保存的GTID集合才用于启动，根据位点推算出的集合仅用于后续跟踪
+func startGTIDSet(gset mysql.GTIDSet, stored bool) mysql.GTIDSet {
+	if !stored {
+		return nil
+	}
+	return gset
+}
+
+// snapshotSchema 没有历史版本的表保存当前的表结构；当前的表结构只在master当前的位点生效，
+// 历史从这个位点开始，之前的binlog(如从旧的位点启动)没有历史版本，按照当前的表结构解析
+func (s *TransferService) snapshotSchema() error {
+	if s.history == nil {
+		return nil
+	}
+
+	pos, err := s.canal.GetMasterPos()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
+		if err := s.history.Snapshot(pos, rule.TableInfo); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// loadGTIDSet 优先使用已保存的GTID集合；没有时根据binlog位点推算，数据库未开启GTID时返回nil
+func (s *TransferService) loadGTIDSet(e sqlExecutor, current mysql.Position) (mysql.GTIDSet, bool, error) {
+	gtid, err := s.positionDao.GetGTID()
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	if gtid != "" {
+		gset, err := mysql.ParseGTIDSet(s.canalCfg.Flavor, gtid)
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+		return gset, true, nil
+	}
+
+	if current.Name == "" {
+		return nil, false, nil
+	}
+
+	gset, err := s.resolveGTIDSet(e, current)
+	return gset, false, err
+}
+
+// resolveGTIDSet 推算执行到binlog位点时的GTID集合
+func (s *TransferService) resolveGTIDSet(e sqlExecutor, pos mysql.Position) (mysql.GTIDSet, error) {
+	switch s.canalCfg.Flavor {
+	case mysql.MariaDBFlavor:
+		res, err := e.Execute(fmt.Sprintf("SELECT BINLOG_GTID_POS('%s', %d)", pos.Name, pos.Pos))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		gtid, _ := res.GetString(0, 0)
+		if gtid == "" {
+			return nil, nil
+		}
+		return mysql.ParseMariadbGTIDSet(gtid)
+	case mysql.MySQLFlavor:
+		res, err := e.Execute("SELECT @@GLOBAL.gtid_mode")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		mode, _ := res.GetString(0, 0)
+		if strings.ToUpper(mode) != "ON" {
+			return nil, nil
+		}
+		return scanBinlogGTIDSet(e, pos)
+	}
+
+	return nil, nil
+}
+
+// scanBinlogGTIDSet 以binlog文件头部的Previous_gtids为基础，累加位点之前的每个Gtid事件
+func scanBinlogGTIDSet(e sqlExecutor, pos mysql.Position) (mysql.GTIDSet, error) {
+	var gset mysql.GTIDSet
+	var from uint64 = 4
+	for {
+		res, err := e.Execute(fmt.Sprintf("SHOW BINLOG EVENTS IN '%s' FROM %d LIMIT %d",
+			pos.Name, from, _binlogEventsPageSize))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rows := res.RowNumber()
+		for i := 0; i < rows; i++ {
+			evPos, _ := res.GetUintByName(i, "Pos")
+			if evPos >= uint64(pos.Pos) {
+				return gset, nil
+			}
+			from, _ = res.GetUintByName(i, "End_log_pos")
+
+			eventType, _ := res.GetStringByName(i, "Event_type")
+			info, _ := res.GetStringByName(i, "Info")
+			switch eventType {
+			case "Previous_gtids":
+				info = strings.NewReplacer("\n", "", "\r", "", " ", "").Replace(info)
+				gset, err = mysql.ParseMysqlGTIDSet(info)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+			case "Gtid":
+				// SET @@SESSION.GTID_NEXT= 'uuid:n'
+				begin := strings.Index(info, "'")
+				end := strings.LastIndex(info, "'")
+				if gset == nil || begin < 0 || end <= begin {
+					continue
+				}
+				if err := gset.Update(info[begin+1 : end]); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		}
+		if rows < _binlogEventsPageSize {
+			return gset, nil
+		}
+	}
+}
+
 func (s *TransferService) StartUp() {
 	s.lockOfCanal.Lock()
 	defer s.lockOfCanal.Unlock()
 
+	s.startUp()
+}
+
+// startUp 在lockOfCanal内调用
+func (s *TransferService) startUp() {
 	if s.firstsStart.Load() {
-		s.canalHandler = newHandler()
+		s.canalHandler = newHandler(s)
 		s.canal.SetEventHandler(s.canalHandler)
 		s.canalHandler.startListener()
 		s.firstsStart.Store(false)
@@ -156,7 +356,7 @@ func (s *TransferService) restart() {
 
 	s.createCanal()
 	s.addDumpDatabaseOrTable()
-	s.canalHandler = newHandler()
+	s.canalHandler = newHandler(s)
 	s.canal.SetEventHandler(s.canalHandler)
 	s.canalHandler.startListener()
 	s.run()
@@ -185,9 +385,67 @@ func (s *TransferService) stopDump() {
 	log.Println("dumper stopped")
 }
 
+// Name 管道名称，默认管道为default
+func (s *TransferService) Name() string {
+	return s.cfg.PipelineName()
+}
+
+// Info 管道信息
+func (s *TransferService) Info() model.PipelineInfo {
+	info := model.PipelineInfo{
+		Name:   s.cfg.PipelineName(),
+		Status: model.PipelineInfoNormal,
+	}
+	if s.disabled.Load() {
+		info.Status = model.PipelineInfoDisable
+	}
+	return info
+}
+
+// Enable 单独启动管道，运行中的管道不重新启动
+func (s *TransferService) Enable() {
+	s.disabled.Store(false)
+
+	s.lockOfCanal.Lock()
+	defer s.lockOfCanal.Unlock()
+
+	if s.canalEnable.Load() {
+		return
+	}
+	s.startUp()
+}
+
+// Disable 单独停止管道，不影响其他管道
+func (s *TransferService) Disable() {
+	s.disabled.Store(true)
+	s.stopDump()
+}
+
+// QueueDepth 待处理队列中的行数及估算的字节数
+func (s *TransferService) QueueDepth() (int64, int64) {
+	s.lockOfCanal.Lock()
+	defer s.lockOfCanal.Unlock()
+
+	if s.canalHandler == nil {
+		return 0, 0
+	}
+	return s.canalHandler.queue.depth()
+}
+
+// TargetHealth 每个目标的健康状态
+func (s *TransferService) TargetHealth() map[string]bool {
+	if c, ok := s.endpoint.(*endpoint.CompositeEndpoint); ok {
+		return c.Health()
+	}
+	return map[string]bool{s.cfg.Target: s.endpointEnable.Load()}
+}
+
 func (s *TransferService) Close() {
 	s.stopDump()
 	s.loopStopSignal <- struct{}{}
+	if s.deadLetter != nil {
+		s.deadLetter.Close()
+	}
 }
 
 func (s *TransferService) Position() (mysql.Position, error) {
@@ -195,7 +453,7 @@ func (s *TransferService) Position() (mysql.Position, error) {
 }
 
 func (s *TransferService) createCanal() error {
-	for _, rc := range global.Cfg().RuleConfigs {
+	for _, rc := range s.cfg.RuleConfigs {
 		s.canalCfg.IncludeTableRegex = append(s.canalCfg.IncludeTableRegex, rc.Schema+"\\."+rc.Table)
 	}
 	var err error
@@ -205,13 +463,13 @@ func (s *TransferService) createCanal() error {
 
 func (s *TransferService) completeRules() error {
 	wildcards := make(map[string]bool)
-	for _, rc := range global.Cfg().RuleConfigs {
+	for _, rc := range s.cfg.RuleConfigs {
 		if rc.Table == "*" {
 			return errors.Errorf("wildcard * is not allowed for table name")
 		}
 
 		if regexp.QuoteMeta(rc.Table) != rc.Table { //通配符
-			if _, ok := wildcards[global.RuleKey(rc.Schema, rc.Schema)]; ok {
+			if _, ok := wildcards[s.cfg.RuleKey(rc.Schema, rc.Schema)]; ok {
 				return errors.Errorf("duplicate wildcard table defined for %s.%s", rc.Schema, rc.Table)
 			}
 
@@ -232,7 +490,8 @@ func (s *TransferService) completeRules() error {
 					return errors.Trace(err)
 				}
 				newRule.Table = tableName
-				ruleKey := global.RuleKey(rc.Schema, tableName)
+				newRule.Pipeline = s.cfg.Name
+				ruleKey := s.cfg.RuleKey(rc.Schema, tableName)
 				global.AddRuleIns(ruleKey, newRule)
 			}
 		} else {
@@ -240,38 +499,111 @@ func (s *TransferService) completeRules() error {
 			if err != nil {
 				return errors.Trace(err)
 			}
-			ruleKey := global.RuleKey(rc.Schema, rc.Table)
+			newRule.Pipeline = s.cfg.Name
+			ruleKey := s.cfg.RuleKey(rc.Schema, rc.Table)
 			global.AddRuleIns(ruleKey, newRule)
 		}
 	}
 
-	for _, rule := range global.RuleInsList() {
-		tableMata, err := s.canal.GetTable(rule.Schema, rule.Table)
-		if err != nil {
-			return errors.Trace(err)
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
+		if err := s.initRule(rule); err != nil {
+			return err
 		}
-		if len(tableMata.PKColumns) == 0 {
-			if !global.Cfg().SkipNoPkTable {
-				return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
-			}
+	}
+
+	return nil
+}
+
+func (s *TransferService) initRule(rule *global.Rule) error {
+	tableMata, err := s.canal.GetTable(rule.Schema, rule.Table)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tableMata.PKColumns) == 0 {
+		if !s.cfg.SkipNoPkTable {
+			return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
 		}
-		if len(tableMata.PKColumns) > 1 {
-			rule.IsCompositeKey = true // 组合主键
+	}
+	if len(tableMata.PKColumns) > 1 {
+		rule.IsCompositeKey = true // 组合主键
+	}
+	rule.TableInfo = tableMata
+	rule.TableColumnSize = len(tableMata.Columns)
+
+	if err := rule.Initialize(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if rule.LuaEnable() {
+		if err := rule.CompileLuaScript(s.cfg.DataDir); err != nil {
+			return err
 		}
-		rule.TableInfo = tableMata
-		rule.TableColumnSize = len(tableMata.Columns)
+	}
+	return nil
+}
 
-		if err := rule.Initialize(); err != nil {
-			return errors.Trace(err)
+// attachRule 新建的表匹配通配符规则时，克隆规则并开始同步
+func (s *TransferService) attachRule(schema, table string) error {
+	ruleKey := s.cfg.RuleKey(schema, table)
+	if global.RuleInsExist(ruleKey) {
+		return nil
+	}
+
+	for _, rc := range s.cfg.RuleConfigs {
+		if rc.Schema != schema {
+			continue
+		}
+		// 被删除的表重新创建时按表名匹配，通配符与启动时information_schema中的RLIKE一致
+		if rc.Table != table {
+			if regexp.QuoteMeta(rc.Table) == rc.Table {
+				continue
+			}
+			if matched, _ := regexp.MatchString(rc.Table, table); !matched {
+				continue
+			}
 		}
 
-		if rule.LuaEnable() {
-			if err := rule.CompileLuaScript(global.Cfg().DataDir); err != nil {
-				return err
+		newRule, err := global.RuleDeepClone(rc)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		newRule.Table = table
+		newRule.Pipeline = s.cfg.Name
+		if err := s.initRule(newRule); err != nil {
+			return errors.Trace(err)
+		}
+		if p, ok := s.endpoint.(endpoint.RulePreparer); ok {
+			if err := p.PrepareRule(newRule); err != nil {
+				return errors.Trace(err)
 			}
 		}
+		global.AddRuleIns(ruleKey, newRule)
+		logs.Infof("table %s.%s matches %s.%s, start syncing", schema, table, rc.Schema, rc.Table)
+		return nil
+	}
+	return nil
+}
+
+// retireRule 表被删除或重命名之后移除原表名的规则；同名的表已经重新创建时更新表结构
+func (s *TransferService) retireRule(ddl *model.DDLRequest) error {
+	if !global.RuleInsExist(ddl.RuleKey) {
+		return nil
+	}
+
+	_, err := s.canal.GetTable(ddl.Schema, ddl.Table)
+	if err == nil {
+		return s.updateRule(ddl.Schema, ddl.Table)
+	}
+	if !isTableNotExist(err) {
+		return errors.Trace(err)
 	}
 
+	global.RemoveRuleIns(ddl.RuleKey)
+	if ddl.Type == model.DDLRename {
+		logs.Infof("table %s.%s renamed to %s.%s, stop syncing", ddl.Schema, ddl.Table, ddl.NewSchema, ddl.NewTable)
+	} else {
+		logs.Infof("table %s.%s dropped, stop syncing", ddl.Schema, ddl.Table)
+	}
 	return nil
 }
 
@@ -279,7 +611,7 @@ func (s *TransferService) addDumpDatabaseOrTable() {
 	var schema string
 	schemas := make(map[string]int)
 	tables := make([]string, 0, global.RuleInsTotal())
-	for _, rule := range global.RuleInsList() {
+	for _, rule := range global.PipelineRuleInsList(s.cfg.Name) {
 		schema = rule.Table
 		schemas[rule.Schema] = 1
 		tables = append(tables, rule.Table)
@@ -296,33 +628,45 @@ func (s *TransferService) addDumpDatabaseOrTable() {
 }
 
 func (s *TransferService) updateRule(schema, table string) error {
-	rule, ok := global.RuleIns(global.RuleKey(schema, table))
-	if ok {
-		tableInfo, err := s.canal.GetTable(schema, table)
-		if err != nil {
-			return errors.Trace(err)
+	rule, ok := global.RuleIns(s.cfg.RuleKey(schema, table))
+	if !ok {
+		// 新表加入失败不影响其他表的同步
+		if err := s.attachRule(schema, table); err != nil {
+			logs.Errorf("attach table %s.%s err %s", schema, table, errors.ErrorStack(err))
 		}
+		return nil
+	}
 
-		if len(tableInfo.PKColumns) == 0 {
-			if !global.Cfg().SkipNoPkTable {
-				return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
-			}
+	tableInfo, err := s.canal.GetTable(schema, table)
+	if err != nil {
+		// 表被删除或重命名，队列中的数据处理完之后在retireRule中移除规则；
+		// 其他错误保留原来的表结构，不中断同步
+		if isTableNotExist(err) {
+			logs.Warnf("table %s.%s not exist, rule will be retired", schema, table)
+		} else {
+			logs.Errorf("get table %s.%s err %s", schema, table, errors.ErrorStack(err))
 		}
+		return nil
+	}
 
-		if len(tableInfo.PKColumns) > 1 {
-			rule.IsCompositeKey = true
+	if len(tableInfo.PKColumns) == 0 {
+		if !s.cfg.SkipNoPkTable {
+			return errors.Errorf("%s.%s must have a PK for a column", rule.Schema, rule.Table)
 		}
+	}
 
-		rule.TableInfo = tableInfo
-		rule.TableColumnSize = len(tableInfo.Columns)
-
-		err = rule.AfterUpdateTableInfo()
-		if err != nil {
-			return err
-		}
+	if len(tableInfo.PKColumns) > 1 {
+		rule.IsCompositeKey = true
 	}
 
-	return nil
+	rule.TableInfo = tableInfo
+	rule.TableColumnSize = len(tableInfo.Columns)
+
+	return rule.AfterUpdateTableInfo()
+}
+
+func isTableNotExist(err error) bool {
+	return errors.Cause(err) == schema.ErrTableNotExist
 }
 
 func (s *TransferService) startLoop() {
@@ -339,11 +683,10 @@ func (s *TransferService) startLoop() {
 						logs.Error(err.Error())
 					} else {
 						s.endpointEnable.Store(true)
-						if global.Cfg().IsRabbitmq() {
-							s.endpoint.Connect()
+						if !s.disabled.Load() {
+							s.StartUp()
 						}
-						s.StartUp()
-						metrics.SetDestState(metrics.DestStateOK)
+						metrics.SetDestState(s.cfg.PipelineName(), metrics.DestStateOK)
 					}
 				}
 			case <-s.loopStopSignal:
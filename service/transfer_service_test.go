@@ -0,0 +1,154 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/storage"
+)
+
+const _testUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+// fakeExecutor 按照查询前缀返回结果
+type fakeExecutor struct {
+	results map[string]*mysql.Result
+	queries []string
+}
+
+func (s *fakeExecutor) Execute(cmd string, _ ...interface{}) (*mysql.Result, error) {
+	s.queries = append(s.queries, cmd)
+	for prefix, r := range s.results {
+		if strings.HasPrefix(cmd, prefix) {
+			return r, nil
+		}
+	}
+	return nil, errors.Errorf("unexpected query %s", cmd)
+}
+
+func testResult(t *testing.T, names []string, values ...[]interface{}) *mysql.Result {
+	rs, err := mysql.BuildSimpleTextResultset(names, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.FieldNames = make(map[string]int, len(names))
+	for i, name := range names {
+		rs.FieldNames[name] = i
+	}
+	for _, data := range rs.RowDatas {
+		row, err := data.ParseText(rs.Fields, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Values = append(rs.Values, row)
+	}
+	return &mysql.Result{Resultset: rs}
+}
+
+func newGTIDService(t *testing.T, key, flavor, gtid string) *TransferService {
+	positionDao := storage.NewPositionStorage(key)
+	if err := positionDao.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := positionDao.SaveWithGTID(mysql.Position{Name: "mysql-bin.000002", Pos: 4}, gtid); err != nil {
+		t.Fatal(err)
+	}
+	return &TransferService{
+		cfg:         global.Cfg(),
+		canalCfg:    &canal.Config{Flavor: flavor},
+		positionDao: positionDao,
+	}
+}
+
+func TestLoadStoredGTIDSet(t *testing.T) {
+	s := newGTIDService(t, "test_gtid_stored", mysql.MySQLFlavor, _testUUID+":1-5")
+	e := &fakeExecutor{}
+	gset, stored, err := s.loadGTIDSet(e, mysql.Position{Name: "mysql-bin.000002", Pos: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored || gset.String() != _testUUID+":1-5" {
+		t.Fatalf("expect stored gtid set, got %v %v", gset, stored)
+	}
+	if len(e.queries) != 0 {
+		t.Fatalf("stored gtid set should not query source, got %v", e.queries)
+	}
+	if startGTIDSet(gset, stored) == nil {
+		t.Fatal("stored gtid set should be used for start")
+	}
+}
+
+func TestLoadGTIDSetFallback(t *testing.T) {
+	s := newGTIDService(t, "test_gtid_fallback", mysql.MySQLFlavor, "")
+
+	// 没有位点时从头开始，不推算GTID集合
+	e := &fakeExecutor{}
+	gset, stored, err := s.loadGTIDSet(e, mysql.Position{})
+	if err != nil || gset != nil || stored || len(e.queries) != 0 {
+		t.Fatalf("expect nothing loaded without position, got %v %v %v", gset, stored, err)
+	}
+
+	// 根据binlog事件推算位点时的GTID集合，只用于跟踪
+	names := []string{"Log_name", "Pos", "Event_type", "Server_id", "End_log_pos", "Info"}
+	e = &fakeExecutor{results: map[string]*mysql.Result{
+		"SELECT @@GLOBAL.gtid_mode": testResult(t, []string{"@@GLOBAL.gtid_mode"}, []interface{}{"ON"}),
+		"SHOW BINLOG EVENTS": testResult(t, names,
+			[]interface{}{"mysql-bin.000002", uint64(4), "Format_desc", uint64(1), uint64(123), "Server ver: 5.7.30-log, Binlog ver: 4"},
+			[]interface{}{"mysql-bin.000002", uint64(123), "Previous_gtids", uint64(1), uint64(194), _testUUID + ":1-\n5"},
+			[]interface{}{"mysql-bin.000002", uint64(194), "Gtid", uint64(1), uint64(259), "SET @@SESSION.GTID_NEXT= '" + _testUUID + ":6'"},
+			[]interface{}{"mysql-bin.000002", uint64(259), "Xid", uint64(1), uint64(290), "COMMIT /* xid=10 */"},
+			[]interface{}{"mysql-bin.000002", uint64(290), "Gtid", uint64(1), uint64(355), "SET @@SESSION.GTID_NEXT= '" + _testUUID + ":7'"},
+		),
+	}}
+	gset, stored, err = s.loadGTIDSet(e, mysql.Position{Name: "mysql-bin.000002", Pos: 290})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored || gset == nil || gset.String() != _testUUID+":1-6" {
+		t.Fatalf("expect resolved gtid set %s:1-6, got %v %v", _testUUID, gset, stored)
+	}
+	if startGTIDSet(gset, stored) != nil {
+		t.Fatal("resolved gtid set should not be used for start")
+	}
+
+	// 数据库未开启GTID
+	e.results["SELECT @@GLOBAL.gtid_mode"] = testResult(t, []string{"@@GLOBAL.gtid_mode"}, []interface{}{"OFF"})
+	gset, _, err = s.loadGTIDSet(e, mysql.Position{Name: "mysql-bin.000002", Pos: 290})
+	if err != nil || gset != nil {
+		t.Fatalf("expect no gtid set when gtid mode off, got %v %v", gset, err)
+	}
+
+	// MariaDB通过BINLOG_GTID_POS推算
+	s.canalCfg.Flavor = mysql.MariaDBFlavor
+	e = &fakeExecutor{results: map[string]*mysql.Result{
+		"SELECT BINLOG_GTID_POS": testResult(t, []string{"gtid"}, []interface{}{"0-1-100"}),
+	}}
+	gset, stored, err = s.loadGTIDSet(e, mysql.Position{Name: "mysql-bin.000002", Pos: 290})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored || gset == nil || gset.String() != "0-1-100" {
+		t.Fatalf("expect resolved gtid set 0-1-100, got %v %v", gset, stored)
+	}
+}
+
+func TestLoadGTIDSetFlavorMismatch(t *testing.T) {
+	// 保存的是MySQL的GTID集合，数据源切换为MariaDB后无法解析，返回错误由调用方按照位点启动
+	s := newGTIDService(t, "test_gtid_mismatch", mysql.MariaDBFlavor, _testUUID+":1-5")
+	gset, stored, err := s.loadGTIDSet(&fakeExecutor{}, mysql.Position{Name: "mysql-bin.000002", Pos: 4})
+	if err == nil {
+		t.Fatalf("expect error for mismatched flavor, got %v", gset)
+	}
+	if gset != nil || stored {
+		t.Fatalf("expect nothing loaded for mismatched flavor, got %v %v", gset, stored)
+	}
+
+	s = newGTIDService(t, "test_gtid_mismatch", mysql.MySQLFlavor, "0-1-100")
+	if _, _, err := s.loadGTIDSet(&fakeExecutor{}, mysql.Position{Name: "mysql-bin.000002", Pos: 4}); err == nil {
+		t.Fatal("expect error for mariadb gtid set with mysql flavor")
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package service
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"go.uber.org/atomic"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/stringutil"
+)
+
+const (
+	_workerQueueSize    = 16 // 每个工作协程的待处理分区数，队列满时阻塞binlog的读取
+	_workerWaitInterval = 10 * time.Millisecond
+)
+
+// workerPool 按照规则和主键将行分区到固定的工作协程，同一行的变更保持顺序，不同行并行处理。
+// 批次按分发顺序编号，只有某个批次之前的全部批次都处理完成，该批次之后的位点才能保存
+type workerPool struct {
+	handler *handler
+	workers []chan *poolTask
+	wg      sync.WaitGroup
+	closed  atomic.Bool
+
+	lock     sync.Mutex
+	seq      uint64         // 最近分发的批次序号
+	remains  map[uint64]int // 未完成批次的剩余分区数
+	finished uint64         // 不大于该序号的批次都已处理完成
+	err      error          // 第一个处理失败的错误，之后的分区不再处理
+}
+
+type poolTask struct {
+	seq      uint64
+	from     mysql.Position
+	requests []*model.RowRequest
+}
+
+func newWorkerPool(h *handler, size int) *workerPool {
+	p := &workerPool{
+		handler: h,
+		remains: make(map[uint64]int),
+	}
+	for i := 0; i < size; i++ {
+		ch := make(chan *poolTask, _workerQueueSize)
+		p.workers = append(p.workers, ch)
+		p.wg.Add(1)
+		go p.work(ch)
+	}
+	return p
+}
+
+// dispatch 将批次拆分到各个工作协程，返回批次序号
+func (p *workerPool) dispatch(from mysql.Position, requests []*model.RowRequest) uint64 {
+	parts := make([][]*model.RowRequest, len(p.workers))
+	for _, r := range requests {
+		i := partition(r, len(p.workers))
+		parts[i] = append(parts[i], r)
+	}
+
+	p.lock.Lock()
+	p.seq++
+	seq := p.seq
+	var n int
+	for _, part := range parts {
+		if len(part) > 0 {
+			n++
+		}
+	}
+	p.remains[seq] = n
+	p.advance()
+	p.lock.Unlock()
+
+	for i, part := range parts {
+		if len(part) > 0 {
+			p.workers[i] <- &poolTask{seq: seq, from: from, requests: part}
+		}
+	}
+	return seq
+}
+
+func (p *workerPool) work(ch chan *poolTask) {
+	defer p.wg.Done()
+	for t := range ch {
+		if p.closed.Load() || p.failed() != nil {
+			continue
+		}
+		if err := p.handler.deliver(t.from, t.requests); err != nil {
+			p.lock.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.lock.Unlock()
+			continue
+		}
+		p.done(t.seq)
+	}
+}
+
+func (p *workerPool) done(seq uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.remains[seq]--
+	if p.remains[seq] <= 0 {
+		delete(p.remains, seq)
+	}
+	p.advance()
+}
+
+// advance 在lock内调用，推进连续完成的批次序号
+func (p *workerPool) advance() {
+	for p.finished < p.seq {
+		if _, ok := p.remains[p.finished+1]; ok {
+			return
+		}
+		p.finished++
+	}
+}
+
+// wait 等待已分发的批次全部完成
+func (p *workerPool) wait() error {
+	for {
+		if err := p.failed(); err != nil {
+			return err
+		}
+		if p.completed() >= p.dispatched() {
+			return nil
+		}
+		time.Sleep(_workerWaitInterval)
+	}
+}
+
+// dispatched 最近分发的批次序号
+func (p *workerPool) dispatched() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.seq
+}
+
+// completed 不大于返回值的批次都已处理完成
+func (p *workerPool) completed() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.finished
+}
+
+func (p *workerPool) failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// close 丢弃未处理的分区，等待处理中的分区完成
+func (p *workerPool) close() {
+	p.closed.Store(true)
+	for _, ch := range p.workers {
+		close(ch)
+	}
+	p.wg.Wait()
+}
+
+// partition 按规则及主键值计算分区，没有主键的表整表一个分区
+func partition(r *model.RowRequest, size int) int {
+	h := fnv.New32a()
+	h.Write([]byte(r.RuleKey))
+	if rule, ok := global.RuleIns(r.RuleKey); ok && rule.TableInfo != nil {
+		for _, i := range rule.TableInfo.PKColumns {
+			if i < len(r.Row) {
+				h.Write([]byte(stringutil.ToString(r.Row[i])))
+			}
+		}
+	}
+	return int(h.Sum32() % uint32(size))
+}
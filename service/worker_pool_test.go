@@ -0,0 +1,127 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	addTestRule("eseap.t_pool_order")
+	defer global.RemoveRuleIns("eseap.t_pool_order")
+
+	e := &recordEndpoint{delay: time.Millisecond}
+	p := newWorkerPool(newTestHandler(e), 4)
+	defer p.close()
+
+	// 每一行的变更分散在多个批次中
+	const ids, versions = 16, 10
+	for v := 0; v < versions; v++ {
+		var requests []*model.RowRequest
+		for id := 0; id < ids; id++ {
+			requests = append(requests, testRow("eseap.t_pool_order", id, v))
+		}
+		p.dispatch(mysql.Position{}, requests)
+	}
+	if err := p.wait(); err != nil {
+		t.Fatal(err)
+	}
+	if p.completed() != versions {
+		t.Fatalf("expect %d batches completed, got %d", versions, p.completed())
+	}
+
+	rows := e.received()
+	if len(rows) != ids*versions {
+		t.Fatalf("expect %d rows, got %d", ids*versions, len(rows))
+	}
+	last := make(map[int]int)
+	workers := make(map[int]bool)
+	for _, r := range rows {
+		id, v := r.Row[0].(int), r.Row[1].(int)
+		if prev, ok := last[id]; ok && v != prev+1 {
+			t.Fatalf("row %d: version %d after %d", id, v, prev)
+		}
+		last[id] = v
+		workers[partition(r, 4)] = true
+	}
+	if len(workers) < 2 {
+		t.Fatalf("expect rows spread across workers, got %d", len(workers))
+	}
+}
+
+func TestWorkerPoolFailure(t *testing.T) {
+	addTestRule("eseap.t_pool_fail")
+	defer global.RemoveRuleIns("eseap.t_pool_fail")
+
+	failed := testRow("eseap.t_pool_fail", 3, 0)
+	e := &recordEndpoint{fail: func(r *model.RowRequest) error {
+		if r.Row[0] == failed.Row[0] {
+			return errTestConsume
+		}
+		return nil
+	}}
+	p := newWorkerPool(newTestHandler(e), 4)
+	defer p.close()
+
+	var requests []*model.RowRequest
+	for id := 0; id < 8; id++ {
+		requests = append(requests, testRow("eseap.t_pool_fail", id, 0))
+	}
+	p.dispatch(mysql.Position{}, requests)
+	if err := p.wait(); err != errTestConsume {
+		t.Fatalf("expect consume error, got %v", err)
+	}
+
+	// 失败之后错误保持不变，之后的批次不再处理，失败的批次不会完成
+	received := len(e.received())
+	p.dispatch(mysql.Position{}, []*model.RowRequest{testRow("eseap.t_pool_fail", 1, 1)})
+	time.Sleep(5 * _workerWaitInterval)
+	if err := p.failed(); err != errTestConsume {
+		t.Fatalf("expect error kept, got %v", err)
+	}
+	if len(e.received()) != received {
+		t.Fatal("expect no rows delivered after failure")
+	}
+	if p.completed() != 0 {
+		t.Fatalf("expect no batch completed, got %d", p.completed())
+	}
+}
+
+func TestWorkerPoolClose(t *testing.T) {
+	addTestRule("eseap.t_pool_close")
+	defer global.RemoveRuleIns("eseap.t_pool_close")
+
+	e := &recordEndpoint{delay: 20 * time.Millisecond}
+	p := newWorkerPool(newTestHandler(e), 2)
+	for v := 0; v < 8; v++ {
+		p.dispatch(mysql.Position{}, []*model.RowRequest{
+			testRow("eseap.t_pool_close", 1, v),
+			testRow("eseap.t_pool_close", 2, v),
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked")
+	}
+
+	// 关闭时丢弃未处理的分区，关闭之后不再写入
+	received := len(e.received())
+	if received >= 16 {
+		t.Fatalf("expect pending partitions dropped, got %d rows", received)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(e.received()) != received {
+		t.Fatal("expect no rows delivered after close")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"github.com/juju/errors"
+	"github.com/vmihailenco/msgpack"
+	"go.etcd.io/bbolt"
+
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/byteutil"
+)
+
+type boltDeadLetterStorage struct {
+	key string
+}
+
+func (s *boltDeadLetterStorage) id() []byte {
+	if s.key == "" {
+		return []byte(_defaultPipelineKey)
+	}
+	return []byte(s.key)
+}
+
+func (s *boltDeadLetterStorage) Initialize() error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.Bucket(_deadLetterBucket).CreateBucketIfNotExists(s.id())
+		return err
+	})
+}
+
+func (s *boltDeadLetterStorage) Save(letter *model.DeadLetter) error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		bt := tx.Bucket(_deadLetterBucket).Bucket(s.id())
+		id, err := bt.NextSequence()
+		if err != nil {
+			return err
+		}
+		letter.Id = id
+		data, err := msgpack.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		return bt.Put(byteutil.Uint64ToBytes(id), data)
+	})
+}
+
+func (s *boltDeadLetterStorage) List(offset, limit int) ([]*model.DeadLetter, error) {
+	var ls []*model.DeadLetter
+	err := _bolt.View(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(_deadLetterBucket).Bucket(s.id()).Cursor()
+		index := 0
+		for k, v := cursor.First(); k != nil && len(ls) < limit; k, v = cursor.Next() {
+			if index < offset {
+				index++
+				continue
+			}
+			var letter model.DeadLetter
+			if err := msgpack.Unmarshal(v, &letter); err != nil {
+				return err
+			}
+			ls = append(ls, &letter)
+		}
+		return nil
+	})
+
+	return ls, errors.Trace(err)
+}
+
+func (s *boltDeadLetterStorage) Get(id uint64) (*model.DeadLetter, error) {
+	var ret *model.DeadLetter
+	err := _bolt.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(_deadLetterBucket).Bucket(s.id()).Get(byteutil.Uint64ToBytes(id))
+		if data == nil {
+			return nil
+		}
+		var letter model.DeadLetter
+		if err := msgpack.Unmarshal(data, &letter); err != nil {
+			return err
+		}
+		ret = &letter
+		return nil
+	})
+
+	return ret, errors.Trace(err)
+}
+
+func (s *boltDeadLetterStorage) Delete(id uint64) error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(_deadLetterBucket).Bucket(s.id()).Delete(byteutil.Uint64ToBytes(id))
+	})
+}
+
+func (s *boltDeadLetterStorage) Close() {
+}
@@ -25,14 +25,20 @@ import (
 )
 
 type boltPositionStorage struct {
-	Name string
-	Pos  uint32
+	key string
+}
+
+func (s *boltPositionStorage) id() []byte {
+	if s.key == "" {
+		return _fixPositionId
+	}
+	return []byte(s.key)
 }
 
 func (s *boltPositionStorage) Initialize() error {
 	return _bolt.Update(func(tx *bbolt.Tx) error {
 		bt := tx.Bucket(_positionBucket)
-		data := bt.Get(_fixPositionId)
+		data := bt.Get(s.id())
 		if data != nil {
 			return nil
 		}
@@ -41,26 +47,44 @@ func (s *boltPositionStorage) Initialize() error {
 		if err != nil {
 			return err
 		}
-		return bt.Put(_fixPositionId, bytes)
+		return bt.Put(s.id(), bytes)
 	})
 }
 
 func (s *boltPositionStorage) Save(pos mysql.Position) error {
+	return s.SaveWithGTID(pos, "")
+}
+
+func (s *boltPositionStorage) SaveWithGTID(pos mysql.Position, gtid string) error {
 	return _bolt.Update(func(tx *bbolt.Tx) error {
 		bt := tx.Bucket(_positionBucket)
-		data, err := msgpack.Marshal(pos)
+		data, err := msgpack.Marshal(positionEntity{
+			Name: pos.Name,
+			Pos:  pos.Pos,
+			GTID: gtid,
+		})
 		if err != nil {
 			return err
 		}
-		return bt.Put(_fixPositionId, data)
+		return bt.Put(s.id(), data)
 	})
 }
 
 func (s *boltPositionStorage) Get() (mysql.Position, error) {
-	var entity mysql.Position
+	entity, err := s.get()
+	return entity.position(), err
+}
+
+func (s *boltPositionStorage) GetGTID() (string, error) {
+	entity, err := s.get()
+	return entity.GTID, err
+}
+
+func (s *boltPositionStorage) get() (positionEntity, error) {
+	var entity positionEntity
 	err := _bolt.View(func(tx *bbolt.Tx) error {
 		bt := tx.Bucket(_positionBucket)
-		data := bt.Get(_fixPositionId)
+		data := bt.Get(s.id())
 		if data == nil {
 			return errors.NotFoundf("PositionStorage")
 		}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"go.etcd.io/bbolt"
+
+	"go-mysql-transfer/model"
+)
+
+type boltSchemaHistoryStorage struct {
+	key string
+}
+
+func (s *boltSchemaHistoryStorage) id() []byte {
+	if s.key == "" {
+		return []byte(_defaultPipelineKey)
+	}
+	return []byte(s.key)
+}
+
+func (s *boltSchemaHistoryStorage) Initialize() error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.Bucket(_schemaHistoryBucket).CreateBucketIfNotExists(s.id())
+		return err
+	})
+}
+
+func (s *boltSchemaHistoryStorage) Save(schema, table string, version *model.SchemaVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	key := []byte(historyVersionKey(mysql.Position{Name: version.PosName, Pos: version.Pos}))
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		bt, err := tx.Bucket(_schemaHistoryBucket).Bucket(s.id()).CreateBucketIfNotExists([]byte(historyTableKey(schema, table)))
+		if err != nil {
+			return err
+		}
+		if bt.Get(key) != nil {
+			return nil
+		}
+		return bt.Put(key, data)
+	})
+}
+
+func (s *boltSchemaHistoryStorage) List(schema, table string) ([]*model.SchemaVersion, error) {
+	var list []*model.SchemaVersion
+	err := _bolt.View(func(tx *bbolt.Tx) error {
+		bt := tx.Bucket(_schemaHistoryBucket).Bucket(s.id()).Bucket([]byte(historyTableKey(schema, table)))
+		if bt == nil {
+			return nil
+		}
+		return bt.ForEach(func(k, v []byte) error {
+			var version model.SchemaVersion
+			if err := json.Unmarshal(v, &version); err != nil {
+				return errors.Trace(err)
+			}
+			list = append(list, &version)
+			return nil
+		})
+	})
+	sortVersions(list)
+
+	return list, err
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"strings"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// DeadLetterStorage 死信，记录处理失败的行。kafka类型只支持写入
+type DeadLetterStorage interface {
+	Initialize() error
+	Save(letter *model.DeadLetter) error
+	List(offset, limit int) ([]*model.DeadLetter, error) // 按写入顺序分页查询
+	Get(id uint64) (*model.DeadLetter, error)            // 不存在时返回nil
+	Delete(id uint64) error
+	Close()
+}
+
+// NewDeadLetterStorage 未配置死信时返回nil
+func NewDeadLetterStorage(cfg *global.Config) DeadLetterStorage {
+	if cfg.DeadLetter == nil {
+		return nil
+	}
+
+	switch strings.ToUpper(cfg.DeadLetter.Type) {
+	case global.DeadLetterFile:
+		return &fileDeadLetterStorage{path: cfg.DeadLetter.FilePath}
+	case global.DeadLetterKafka:
+		return &kafkaDeadLetterStorage{cfg: cfg}
+	}
+
+	return &boltDeadLetterStorage{key: cfg.PositionKey()}
+}
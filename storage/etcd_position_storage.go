@@ -27,6 +27,14 @@ import (
 )
 
 type etcdPositionStorage struct {
+	key string
+}
+
+func (s *etcdPositionStorage) dir() string {
+	if s.key == "" {
+		return global.Cfg().ZkPositionDir()
+	}
+	return global.Cfg().ZkPositionDir() + "/" + s.key
 }
 
 func (s *etcdPositionStorage) Initialize() error {
@@ -35,7 +43,7 @@ func (s *etcdPositionStorage) Initialize() error {
 		return err
 	}
 
-	err = etcds.CreateIfNecessary(global.Cfg().ZkPositionDir(), string(data), _etcdOps)
+	err = etcds.CreateIfNecessary(s.dir(), string(data), _etcdOps)
 	if err != nil {
 		return err
 	}
@@ -44,18 +52,36 @@ func (s *etcdPositionStorage) Initialize() error {
 }
 
 func (s *etcdPositionStorage) Save(pos mysql.Position) error {
-	data, err := json.Marshal(pos)
+	return s.SaveWithGTID(pos, "")
+}
+
+func (s *etcdPositionStorage) SaveWithGTID(pos mysql.Position, gtid string) error {
+	data, err := json.Marshal(positionEntity{
+		Name: pos.Name,
+		Pos:  pos.Pos,
+		GTID: gtid,
+	})
 	if err != nil {
 		return err
 	}
 
-	return etcds.Save(global.Cfg().ZkPositionDir(), string(data), _etcdOps)
+	return etcds.Save(s.dir(), string(data), _etcdOps)
 }
 
 func (s *etcdPositionStorage) Get() (mysql.Position, error) {
-	var entity mysql.Position
+	entity, err := s.get()
+	return entity.position(), err
+}
+
+func (s *etcdPositionStorage) GetGTID() (string, error) {
+	entity, err := s.get()
+	return entity.GTID, err
+}
+
+func (s *etcdPositionStorage) get() (positionEntity, error) {
+	var entity positionEntity
 
-	data, _, err := etcds.Get(global.Cfg().ZkPositionDir(), _etcdOps)
+	data, _, err := etcds.Get(s.dir(), _etcdOps)
 	if err != nil {
 		return entity, err
 	}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/etcds"
+)
+
+type etcdSchemaHistoryStorage struct {
+	key string
+}
+
+func (s *etcdSchemaHistoryStorage) dir(schema, table string) string {
+	key := s.key
+	if key == "" {
+		key = _defaultPipelineKey
+	}
+	return global.Cfg().ZkSchemaHistoryDir() + "/" + key + "/" + historyTableKey(schema, table)
+}
+
+func (s *etcdSchemaHistoryStorage) Initialize() error {
+	return nil
+}
+
+func (s *etcdSchemaHistoryStorage) Save(schema, table string, version *model.SchemaVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	key := s.dir(schema, table) + "/" + historyVersionKey(mysql.Position{Name: version.PosName, Pos: version.Pos})
+	return etcds.CreateIfNecessary(key, string(data), _etcdOps)
+}
+
+func (s *etcdSchemaHistoryStorage) List(schema, table string) ([]*model.SchemaVersion, error) {
+	nodes, err := etcds.List(s.dir(schema, table)+"/", _etcdOps)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*model.SchemaVersion, 0, len(nodes))
+	for _, node := range nodes {
+		var version model.SchemaVersion
+		if err := json.Unmarshal(node.Value, &version); err != nil {
+			return nil, errors.Trace(err)
+		}
+		list = append(list, &version)
+	}
+	sortVersions(list)
+	return list, nil
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/vmihailenco/msgpack"
+
+	"go-mysql-transfer/model"
+)
+
+const _fileDeadLetterMaxLine = 64 * 1024 * 1024
+
+// fileDeadLetterStorage 每行一条JSON格式的死信，raw为msgpack编码的原始数据，用于重放时还原数据类型
+type fileDeadLetterStorage struct {
+	path string
+	lock sync.Mutex
+}
+
+type fileDeadLetter struct {
+	*model.DeadLetter
+	Raw []byte `json:"raw"`
+}
+
+func (s *fileDeadLetterStorage) Initialize() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return file.Close()
+}
+
+func (s *fileDeadLetterStorage) Save(letter *model.DeadLetter) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letter.Id = uint64(time.Now().UnixNano())
+	raw, err := msgpack.Marshal(letter)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	line, err := json.Marshal(fileDeadLetter{DeadLetter: letter, Raw: raw})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return errors.Trace(err)
+}
+
+func (s *fileDeadLetterStorage) List(offset, limit int) ([]*model.DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ls []*model.DeadLetter
+	index := 0
+	err := s.scan(func(letter *model.DeadLetter, _ []byte) bool {
+		if index >= offset {
+			ls = append(ls, letter)
+		}
+		index++
+		return len(ls) < limit
+	})
+	return ls, err
+}
+
+func (s *fileDeadLetterStorage) Get(id uint64) (*model.DeadLetter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ret *model.DeadLetter
+	err := s.scan(func(letter *model.DeadLetter, _ []byte) bool {
+		if letter.Id == id {
+			ret = letter
+			return false
+		}
+		return true
+	})
+	return ret, err
+}
+
+// Delete 重写文件，去掉指定的行
+func (s *fileDeadLetterStorage) Delete(id uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var writeErr error
+	err = s.scan(func(letter *model.DeadLetter, line []byte) bool {
+		if letter.Id == id {
+			return true
+		}
+		if _, writeErr = tmp.Write(append(line, '\n')); writeErr != nil {
+			return false
+		}
+		return true
+	})
+	tmp.Close()
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(os.Rename(tmpPath, s.path))
+}
+
+// scan 按行遍历，fn返回false时停止
+func (s *fileDeadLetterStorage) scan(fn func(letter *model.DeadLetter, line []byte) bool) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), _fileDeadLetterMaxLine)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entity fileDeadLetter
+		if err := json.Unmarshal(line, &entity); err != nil {
+			return errors.Trace(err)
+		}
+		var letter model.DeadLetter
+		if err := msgpack.Unmarshal(entity.Raw, &letter); err != nil {
+			return errors.Trace(err)
+		}
+		letter.Id = entity.Id
+		if !fn(&letter, line) {
+			return nil
+		}
+	}
+
+	return errors.Trace(scanner.Err())
+}
+
+func (s *fileDeadLetterStorage) Close() {
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/kafkas"
+)
+
+// kafkaDeadLetterStorage 死信以JSON格式写入kafka，不支持查询和删除
+type kafkaDeadLetterStorage struct {
+	cfg      *global.Config
+	producer sarama.SyncProducer
+}
+
+func (s *kafkaDeadLetterStorage) Initialize() error {
+	cfg := sarama.NewConfig()
+	cfg.Producer.Return.Successes = true
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	if err := kafkas.Apply(cfg, s.cfg.KafkaSecurity()); err != nil {
+		return errors.Errorf("invalid kafka security config: %q", err)
+	}
+
+	producer, err := sarama.NewSyncProducer(strings.Split(s.cfg.DeadLetter.KafkaAddrs, ","), cfg)
+	if err != nil {
+		return errors.Errorf("unable to create kafka dead letter producer: %q", err)
+	}
+	s.producer = producer
+	return nil
+}
+
+func (s *kafkaDeadLetterStorage) Save(letter *model.DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: s.cfg.DeadLetter.KafkaTopic,
+		Key:   sarama.StringEncoder(letter.RuleKey),
+		Value: sarama.ByteEncoder(data),
+	})
+	return errors.Trace(err)
+}
+
+func (s *kafkaDeadLetterStorage) List(offset, limit int) ([]*model.DeadLetter, error) {
+	return nil, errors.NotSupportedf("query kafka dead letter, consume topic %s instead", s.cfg.DeadLetter.KafkaTopic)
+}
+
+func (s *kafkaDeadLetterStorage) Get(id uint64) (*model.DeadLetter, error) {
+	return nil, errors.NotSupportedf("query kafka dead letter, consume topic %s instead", s.cfg.DeadLetter.KafkaTopic)
+}
+
+func (s *kafkaDeadLetterStorage) Delete(id uint64) error {
+	return errors.NotSupportedf("delete kafka dead letter")
+}
+
+func (s *kafkaDeadLetterStorage) Close() {
+	if s.producer != nil {
+		s.producer.Close()
+	}
+}
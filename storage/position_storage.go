@@ -27,17 +27,34 @@ type PositionStorage interface {
 	Initialize() error
 	Save(pos mysql.Position) error
 	Get() (mysql.Position, error)
+	SaveWithGTID(pos mysql.Position, gtid string) error // 同时保存binlog位点和GTID集合
+	GetGTID() (string, error)                           // 获取GTID集合，为空表示只能按照binlog位点恢复
 }
 
-func NewPositionStorage() PositionStorage {
+// 持久化的位点，兼容只保存了Name和Pos的旧数据
+type positionEntity struct {
+	Name string
+	Pos  uint32
+	GTID string
+}
+
+func (s positionEntity) position() mysql.Position {
+	return mysql.Position{
+		Name: s.Name,
+		Pos:  s.Pos,
+	}
+}
+
+// NewPositionStorage 按照key区分不同管道的位点，key为空表示默认管道
+func NewPositionStorage(key string) PositionStorage {
 	if global.Cfg().IsCluster() {
 		if global.Cfg().IsZk() {
-			return &zkPositionStorage{}
+			return &zkPositionStorage{key: key}
 		}
 		if global.Cfg().IsEtcd() {
-			return &etcdPositionStorage{}
+			return &etcdPositionStorage{key: key}
 		}
 	}
 
-	return &boltPositionStorage{}
+	return &boltPositionStorage{key: key}
 }
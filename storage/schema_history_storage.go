@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+)
+
+// SchemaHistoryStorage 表结构历史，按照binlog位点保存每个版本，从旧的位点恢复时按照数据写入时的表结构解析
+type SchemaHistoryStorage interface {
+	Initialize() error
+	Save(schema, table string, version *model.SchemaVersion) error // 位点已存在的版本不覆盖
+	List(schema, table string) ([]*model.SchemaVersion, error)     // 按照位点升序
+}
+
+// NewSchemaHistoryStorage 按照key区分不同管道，key为空表示默认管道；集群保存在zookeeper或etcd中，与位点一致，单机保存在本地的boltdb中
+func NewSchemaHistoryStorage(key string) SchemaHistoryStorage {
+	if global.Cfg().IsCluster() {
+		if global.Cfg().IsZk() {
+			return &zkSchemaHistoryStorage{key: key}
+		}
+		if global.Cfg().IsEtcd() {
+			return &etcdSchemaHistoryStorage{key: key}
+		}
+	}
+	return &boltSchemaHistoryStorage{key: key}
+}
+
+func historyTableKey(schema, table string) string {
+	return strings.ToLower(schema + "." + table)
+}
+
+// historyVersionKey 版本的唯一标识；binlog文件名的序号位数可能增加(mysql-bin.999999之后为mysql-bin.1000000)，
+// 字典序不是位点顺序，读取后由sortVersions排序
+func historyVersionKey(pos mysql.Position) string {
+	return fmt.Sprintf("%s#%010d", pos.Name, pos.Pos)
+}
+
+// sortVersions 按照位点升序
+func sortVersions(list []*model.SchemaVersion) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return model.ComparePosition(
+			mysql.Position{Name: list[i].PosName, Pos: list[i].Pos},
+			mysql.Position{Name: list[j].PosName, Pos: list[j].Pos}) < 0
+	})
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/model"
+)
+
+func TestSortVersions(t *testing.T) {
+	// mysql-bin.999999之后为mysql-bin.1000000，按字典序会排在前面
+	list := []*model.SchemaVersion{
+		{PosName: "mysql-bin.1000000", Pos: 4},
+		{PosName: "mysql-bin.999999", Pos: 900},
+		{PosName: "mysql-bin.999999", Pos: 120},
+	}
+	sortVersions(list)
+	expects := []string{"mysql-bin.999999#0000000120", "mysql-bin.999999#0000000900", "mysql-bin.1000000#0000000004"}
+	for i, v := range list {
+		if key := historyVersionKey(mysql.Position{Name: v.PosName, Pos: v.Pos}); key != expects[i] {
+			t.Fatalf("version %d expect %s, got %s", i, expects[i], key)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"github.com/juju/errors"
+	"github.com/vmihailenco/msgpack"
+	"go.etcd.io/bbolt"
+
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/byteutil"
+)
+
+const _defaultPipelineKey = "default" // 默认管道在bucket中的key
+
+// SpoolStorage 预写日志，批量数据在处理之前先落盘，重启后重放，保存位点后截断。
+// 只保存在本地的boltdb中
+type SpoolStorage interface {
+	Initialize() error
+	Append(requests []*model.RowRequest) (uint64, error)                   // 追加一个批次，返回批次序号
+	ForEach(fn func(seq uint64, requests []*model.RowRequest) error) error // 按序号顺序遍历未截断的批次
+	Truncate(seq uint64) error                                             // 删除序号不大于seq的批次
+}
+
+type boltSpoolStorage struct {
+	key string
+}
+
+// NewSpoolStorage 按照key区分不同管道，key为空表示默认管道
+func NewSpoolStorage(key string) SpoolStorage {
+	return &boltSpoolStorage{key: key}
+}
+
+func (s *boltSpoolStorage) id() []byte {
+	if s.key == "" {
+		return []byte(_defaultPipelineKey)
+	}
+	return []byte(s.key)
+}
+
+func (s *boltSpoolStorage) Initialize() error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.Bucket(_spoolBucket).CreateBucketIfNotExists(s.id())
+		return err
+	})
+}
+
+func (s *boltSpoolStorage) Append(requests []*model.RowRequest) (uint64, error) {
+	data, err := msgpack.Marshal(requests)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var seq uint64
+	err = _bolt.Update(func(tx *bbolt.Tx) error {
+		bt := tx.Bucket(_spoolBucket).Bucket(s.id())
+		seq, err = bt.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bt.Put(byteutil.Uint64ToBytes(seq), data)
+	})
+
+	return seq, errors.Trace(err)
+}
+
+func (s *boltSpoolStorage) ForEach(fn func(seq uint64, requests []*model.RowRequest) error) error {
+	return _bolt.View(func(tx *bbolt.Tx) error {
+		bt := tx.Bucket(_spoolBucket).Bucket(s.id())
+		return bt.ForEach(func(k, v []byte) error {
+			var requests []*model.RowRequest
+			if err := msgpack.Unmarshal(v, &requests); err != nil {
+				return errors.Trace(err)
+			}
+			return fn(byteutil.BytesToUint64(k), requests)
+		})
+	})
+}
+
+func (s *boltSpoolStorage) Truncate(seq uint64) error {
+	return _bolt.Update(func(tx *bbolt.Tx) error {
+		cursor := tx.Bucket(_spoolBucket).Bucket(s.id()).Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.First() {
+			if byteutil.BytesToUint64(k) > seq {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
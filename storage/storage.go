@@ -43,8 +43,11 @@ const (
 )
 
 var (
-	_positionBucket = []byte("Position")
-	_fixPositionId  = byteutil.Uint64ToBytes(uint64(1))
+	_positionBucket      = []byte("Position")
+	_spoolBucket         = []byte("Spool")
+	_deadLetterBucket    = []byte("DeadLetter")
+	_schemaHistoryBucket = []byte("SchemaHistory")
+	_fixPositionId       = byteutil.Uint64ToBytes(uint64(1))
 
 	_bolt           *bbolt.DB
 	_zkConn         *zk.Conn
@@ -89,6 +92,9 @@ func initBolt() error {
 
 	err = bolt.Update(func(tx *bbolt.Tx) error {
 		tx.CreateBucketIfNotExists(_positionBucket)
+		tx.CreateBucketIfNotExists(_spoolBucket)
+		tx.CreateBucketIfNotExists(_deadLetterBucket)
+		tx.CreateBucketIfNotExists(_schemaHistoryBucket)
 		return nil
 	})
 
@@ -27,6 +27,14 @@ import (
 )
 
 type zkPositionStorage struct {
+	key string
+}
+
+func (s *zkPositionStorage) dir() string {
+	if s.key == "" {
+		return global.Cfg().ZkPositionDir()
+	}
+	return global.Cfg().ZkPositionDir() + "/" + s.key
 }
 
 func (s *zkPositionStorage) Initialize() error {
@@ -35,35 +43,60 @@ func (s *zkPositionStorage) Initialize() error {
 		return err
 	}
 
-	err = zookeepers.CreateDirWithDataIfNecessary(global.Cfg().ZkPositionDir(), pos ,_zkConn)
+	err = zookeepers.CreateDirWithDataIfNecessary(global.Cfg().ZkPositionDir(), pos, _zkConn)
 	if err != nil {
 		return err
 	}
 
+	if s.key != "" {
+		err = zookeepers.CreateDirWithDataIfNecessary(s.dir(), pos, _zkConn)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = zookeepers.CreateDirIfNecessary(global.Cfg().ZkNodesDir(), _zkConn)
 	return err
 }
 
 func (s *zkPositionStorage) Save(pos mysql.Position) error {
-	_, stat, err := _zkConn.Get(global.Cfg().ZkPositionDir())
+	return s.SaveWithGTID(pos, "")
+}
+
+func (s *zkPositionStorage) SaveWithGTID(pos mysql.Position, gtid string) error {
+	_, stat, err := _zkConn.Get(s.dir())
 	if err != nil {
 		return err
 	}
 
-	data, err := json.Marshal(pos)
+	data, err := json.Marshal(positionEntity{
+		Name: pos.Name,
+		Pos:  pos.Pos,
+		GTID: gtid,
+	})
 	if err != nil {
 		return err
 	}
 
-	_, err = _zkConn.Set(global.Cfg().ZkPositionDir(), data, stat.Version)
+	_, err = _zkConn.Set(s.dir(), data, stat.Version)
 
 	return err
 }
 
 func (s *zkPositionStorage) Get() (mysql.Position, error) {
-	var entity mysql.Position
+	entity, err := s.get()
+	return entity.position(), err
+}
+
+func (s *zkPositionStorage) GetGTID() (string, error) {
+	entity, err := s.get()
+	return entity.GTID, err
+}
+
+func (s *zkPositionStorage) get() (positionEntity, error) {
+	var entity positionEntity
 
-	data, _, err := _zkConn.Get(global.Cfg().ZkPositionDir())
+	data, _, err := _zkConn.Get(s.dir())
 	if err != nil {
 		return entity, err
 	}
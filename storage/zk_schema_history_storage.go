@@ -0,0 +1,96 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/juju/errors"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/siddontang/go-mysql/mysql"
+
+	"go-mysql-transfer/global"
+	"go-mysql-transfer/model"
+	"go-mysql-transfer/util/zookeepers"
+)
+
+type zkSchemaHistoryStorage struct {
+	key string
+}
+
+func (s *zkSchemaHistoryStorage) root() string {
+	key := s.key
+	if key == "" {
+		key = _defaultPipelineKey
+	}
+	return global.Cfg().ZkSchemaHistoryDir() + "/" + key
+}
+
+func (s *zkSchemaHistoryStorage) dir(schema, table string) string {
+	return s.root() + "/" + historyTableKey(schema, table)
+}
+
+func (s *zkSchemaHistoryStorage) Initialize() error {
+	if err := zookeepers.CreateDirIfNecessary(global.Cfg().ZkSchemaHistoryDir(), _zkConn); err != nil {
+		return err
+	}
+	return zookeepers.CreateDirIfNecessary(s.root(), _zkConn)
+}
+
+func (s *zkSchemaHistoryStorage) Save(schema, table string, version *model.SchemaVersion) error {
+	data, err := json.Marshal(version)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	dir := s.dir(schema, table)
+	if err := zookeepers.CreateDirIfNecessary(dir, _zkConn); err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+	key := dir + "/" + historyVersionKey(mysql.Position{Name: version.PosName, Pos: version.Pos})
+	if err := zookeepers.CreateDirWithDataIfNecessary(key, data, _zkConn); err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+	return nil
+}
+
+func (s *zkSchemaHistoryStorage) List(schema, table string) ([]*model.SchemaVersion, error) {
+	dir := s.dir(schema, table)
+	children, _, err := _zkConn.Children(dir)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*model.SchemaVersion, 0, len(children))
+	for _, child := range children {
+		data, _, err := _zkConn.Get(dir + "/" + child)
+		if err != nil {
+			return nil, err
+		}
+		var version model.SchemaVersion
+		if err := json.Unmarshal(data, &version); err != nil {
+			return nil, errors.Trace(err)
+		}
+		list = append(list, &version)
+	}
+	sortVersions(list)
+	return list, nil
+}
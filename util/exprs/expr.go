@@ -0,0 +1,596 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package exprs
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+
+	"go-mysql-transfer/util/stringutil"
+)
+
+// Env 标识符的取值，如：status、old.status
+type Env func(ident string) interface{}
+
+// Expr 编译后的表达式，语法与SQL的WHERE条件相近：
+// 比较运算 = == != <> < <= > >=，逻辑运算 AND OR NOT(&& || !)，
+// IN、NOT IN、LIKE、NOT LIKE、IS NULL、IS NOT NULL，字面量支持数字、字符串、true、false、null
+type Expr struct {
+	src    string
+	root   node
+	idents []string
+}
+
+// Compile 编译表达式
+func Compile(src string) (*Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, idents: make(map[string]struct{})}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, errors.Errorf("unexpected '%s' at position %d", t.val, t.pos)
+	}
+
+	idents := make([]string, 0, len(p.idents))
+	for ident := range p.idents {
+		idents = append(idents, ident)
+	}
+	return &Expr{src: src, root: root, idents: idents}, nil
+}
+
+// Eval 表达式结果是否为真
+func (e *Expr) Eval(env Env) bool {
+	return truthy(e.root.eval(env))
+}
+
+// Idents 表达式中使用的标识符
+func (e *Expr) Idents() []string {
+	return e.idents
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	idents map[string]struct{}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// acceptKeyword 下一个token是关键字或运算符时前进
+func (p *parser) acceptKeyword(kws ...string) bool {
+	t := p.peek()
+	for _, kw := range kws {
+		if t.keyword(kw) || (t.typ == tokenOperator && t.val == kw) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(typ tokenType, val string) error {
+	t := p.next()
+	if t.typ != typ {
+		return errors.Errorf("expected '%s' at position %d", val, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("OR", "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("AND", "&&") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.acceptKeyword("NOT", "!") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.typ == tokenOperator {
+		switch t.val {
+		case "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+			p.next()
+			right, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &compareNode{op: t.val, left: left, right: right}, nil
+		}
+	}
+
+	if p.acceptKeyword("IS") {
+		not := p.acceptKeyword("NOT")
+		if !p.acceptKeyword("NULL") {
+			return nil, errors.Errorf("expected NULL at position %d", p.peek().pos)
+		}
+		return &isNullNode{x: left, not: not}, nil
+	}
+
+	not := p.acceptKeyword("NOT")
+	switch {
+	case p.acceptKeyword("IN"):
+		list, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		return &inNode{x: left, list: list, not: not}, nil
+	case p.acceptKeyword("LIKE"):
+		pattern, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return newLikeNode(left, pattern, not), nil
+	case not:
+		return nil, errors.Errorf("expected IN or LIKE at position %d", p.peek().pos)
+	}
+	return left, nil
+}
+
+func (p *parser) parseList() ([]node, error) {
+	if err := p.expect(tokenLParen, "("); err != nil {
+		return nil, err
+	}
+	var list []node
+	for {
+		x, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, x)
+		if p.peek().typ != tokenComma {
+			break
+		}
+		p.next()
+	}
+	return list, p.expect(tokenRParen, ")")
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.typ {
+	case tokenLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(tokenRParen, ")")
+	case tokenNumber:
+		return parseNumber(t.val, t.pos)
+	case tokenString:
+		return &literalNode{val: t.val}, nil
+	case tokenOperator:
+		if t.val == "-" && p.peek().typ == tokenNumber {
+			return parseNumber("-"+p.next().val, t.pos)
+		}
+	case tokenIdent:
+		switch {
+		case t.keyword("true"):
+			return &literalNode{val: true}, nil
+		case t.keyword("false"):
+			return &literalNode{val: false}, nil
+		case t.keyword("null"):
+			return &literalNode{val: nil}, nil
+		}
+		for _, kw := range []string{"AND", "OR", "NOT", "IN", "IS", "LIKE"} {
+			if t.keyword(kw) {
+				return nil, errors.Errorf("unexpected keyword %s at position %d", t.val, t.pos)
+			}
+		}
+		p.idents[t.val] = struct{}{}
+		return &identNode{name: t.val}, nil
+	case tokenEOF:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, errors.Errorf("unexpected '%s' at position %d", t.val, t.pos)
+}
+
+func parseNumber(s string, pos int) (node, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return &literalNode{val: i}, nil
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return &literalNode{val: u}, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid number %s at position %d", s, pos)
+	}
+	return &literalNode{val: f}, nil
+}
+
+type node interface {
+	eval(env Env) interface{}
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n *literalNode) eval(Env) interface{} {
+	return n.val
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(env Env) interface{} {
+	return env(n.name)
+}
+
+type notNode struct {
+	x node
+}
+
+func (n *notNode) eval(env Env) interface{} {
+	return !truthy(n.x.eval(env))
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) eval(env Env) interface{} {
+	return truthy(n.left.eval(env)) && truthy(n.right.eval(env))
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) eval(env Env) interface{} {
+	return truthy(n.left.eval(env)) || truthy(n.right.eval(env))
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(env Env) interface{} {
+	// 与SQL一致，null参与的比较结果为false，判断null使用IS NULL
+	a, b := n.left.eval(env), n.right.eval(env)
+	if a == nil || b == nil {
+		return false
+	}
+	c := compare(a, b)
+	switch n.op {
+	case "=", "==":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+type inNode struct {
+	x    node
+	list []node
+	not  bool
+}
+
+func (n *inNode) eval(env Env) interface{} {
+	v := n.x.eval(env)
+	if v == nil {
+		return false
+	}
+	for _, e := range n.list {
+		if o := e.eval(env); o != nil && compare(v, o) == 0 {
+			return !n.not
+		}
+	}
+	return n.not
+}
+
+type isNullNode struct {
+	x   node
+	not bool
+}
+
+func (n *isNullNode) eval(env Env) interface{} {
+	return (n.x.eval(env) == nil) != n.not
+}
+
+type likeNode struct {
+	x       node
+	pattern node
+	regex   *regexp.Regexp // 模式为字面量时预先编译
+	not     bool
+}
+
+func newLikeNode(x, pattern node, not bool) *likeNode {
+	n := &likeNode{x: x, pattern: pattern, not: not}
+	if l, ok := pattern.(*literalNode); ok && l.val != nil {
+		n.regex = likeRegexp(stringutil.ToString(l.val))
+	}
+	return n
+}
+
+func (n *likeNode) eval(env Env) interface{} {
+	v := n.x.eval(env)
+	if v == nil {
+		return false
+	}
+	regex := n.regex
+	if regex == nil {
+		p := n.pattern.eval(env)
+		if p == nil {
+			return false
+		}
+		regex = likeRegexp(stringutil.ToString(p))
+	}
+	return regex.MatchString(stringutil.ToString(v)) != n.not
+}
+
+// likeRegexp %匹配任意多个字符，_匹配单个字符
+func likeRegexp(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// compare 有一边是数字(数字字面量或数值列)时按照数字比较，整数之间精确比较，有浮点数时按照float64比较；
+// 两边都是字符串时按照字符串比较，不转换为数字，如'10' < '9'
+func compare(a, b interface{}) int {
+	if !isNumber(a) && !isNumber(b) {
+		return strings.Compare(stringutil.ToString(a), stringutil.ToString(b))
+	}
+	if ia, ok := toInteger(a); ok {
+		if ib, ok := toInteger(b); ok {
+			return ia.compare(ib)
+		}
+	}
+	if fa, ok := toNumber(a); ok {
+		if fb, ok := toNumber(b); ok {
+			switch {
+			case fa < fb:
+				return -1
+			case fa > fb:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	return strings.Compare(stringutil.ToString(a), stringutil.ToString(b))
+}
+
+// isNumber 值本身是数字，字符串即使内容是数字也不算
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		return true
+	}
+	return false
+}
+
+// integer 整数按照符号和绝对值表示，int64与uint64之间可以精确比较
+type integer struct {
+	neg bool
+	abs uint64
+}
+
+func signed(v int64) integer {
+	if v < 0 {
+		return integer{neg: true, abs: uint64(-(v + 1)) + 1}
+	}
+	return integer{abs: uint64(v)}
+}
+
+func (a integer) compare(b integer) int {
+	if a.neg != b.neg {
+		if a.neg {
+			return -1
+		}
+		return 1
+	}
+	c := 0
+	switch {
+	case a.abs < b.abs:
+		c = -1
+	case a.abs > b.abs:
+		c = 1
+	}
+	if a.neg {
+		return -c
+	}
+	return c
+}
+
+func toInteger(v interface{}) (integer, bool) {
+	switch v := v.(type) {
+	case int:
+		return signed(int64(v)), true
+	case int8:
+		return signed(int64(v)), true
+	case int16:
+		return signed(int64(v)), true
+	case int32:
+		return signed(int64(v)), true
+	case int64:
+		return signed(v), true
+	case uint:
+		return integer{abs: uint64(v)}, true
+	case uint8:
+		return integer{abs: uint64(v)}, true
+	case uint16:
+		return integer{abs: uint64(v)}, true
+	case uint32:
+		return integer{abs: uint64(v)}, true
+	case uint64:
+		return integer{abs: v}, true
+	case bool:
+		if v {
+			return integer{abs: 1}, true
+		}
+		return integer{}, true
+	case string:
+		return parseInteger(v)
+	case []byte:
+		return parseInteger(string(v))
+	}
+	return integer{}, false
+}
+
+func parseInteger(s string) (integer, bool) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return signed(i), true
+	}
+	if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return integer{abs: u}, true
+	}
+	return integer{}, false
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// truthy 单独的值作为条件时，null、false、0、空字符串为假
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "0"
+	case []byte:
+		return len(v) > 0 && string(v) != "0"
+	}
+	if f, ok := toNumber(v); ok {
+		return f != 0
+	}
+	return true
+}
@@ -0,0 +1,101 @@
+package exprs
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	row := map[string]interface{}{
+		"id":         int64(7),
+		"status":     "active",
+		"tenant_id":  int64(5),
+		"price":      12.5,
+		"name":       "wangjie",
+		"deleted_at": nil,
+		"old.status": "deleted",
+		"action":     "update",
+		"big_id":     int64(1234567890123456789),
+		"unsigned":   uint64(18446744073709551615),
+		"code":       "10",
+	}
+	env := func(ident string) interface{} {
+		return row[ident]
+	}
+
+	cases := []struct {
+		expr   string
+		expect bool
+	}{
+		{"status != 'deleted' AND tenant_id IN (3,5)", true},
+		{"status <> 'active' OR tenant_id in (3, 4)", false},
+		{"tenant_id NOT IN (3,5)", false},
+		{"action = 'update' and old.status = 'deleted'", true},
+		{"price >= 12.5 && price < 13", true},
+		{"id = '7'", true},
+		{"id > -1", true},
+		{"name LIKE 'wang%'", true},
+		{"name like 'wang_'", false},
+		{"name NOT LIKE '%jie'", false},
+		{"deleted_at IS NULL", true},
+		{"deleted_at IS NOT NULL", false},
+		{"deleted_at = null", false},
+		{"missing != 1", false},
+		{"NOT (status = \"active\")", false},
+		{"!(tenant_id = 3) && id", true},
+		{"`status` == 'active'", true},
+		{"status = 'it''s'", false},
+		{"big_id = 1234567890123456789", true},
+		{"big_id = 1234567890123456788", false},
+		{"big_id > 1234567890123456788", true},
+		{"big_id IN (1234567890123456780, 1234567890123456789)", true},
+		{"big_id = '1234567890123456788'", false},
+		{"unsigned = 18446744073709551615", true},
+		{"unsigned = 18446744073709551614", false},
+		{"unsigned > 9223372036854775807", true},
+		{"unsigned > -1", true},
+		{"id < 7.5", true},
+		{"code < '9'", true}, // 字符串之间不转换为数字
+		{"code = '10.0'", false},
+		{"code < 9", false}, // 数字字面量按照数字比较
+		{"code = 10.0", true},
+		{"code IN ('10.0', 9)", false},
+	}
+	for _, c := range cases {
+		e, err := Compile(c.expr)
+		if err != nil {
+			t.Fatalf("compile %s err %s", c.expr, err.Error())
+		}
+		if got := e.Eval(env); got != c.expect {
+			t.Fatalf("%s expect %v, got %v", c.expr, c.expect, got)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"status =",
+		"status = 'active",
+		"(status = 1",
+		"status = 1 tenant_id = 2",
+		"tenant_id IN 3",
+		"status NOT 1",
+		"status IS 1",
+		"status # 1",
+		"and = 1",
+	} {
+		if _, err := Compile(src); err == nil {
+			t.Fatalf("%s expect compile error", src)
+		}
+	}
+}
+
+func TestIdents(t *testing.T) {
+	e, err := Compile("status = 'a' AND (old.status = 'b' OR status IS NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Idents()) != 2 {
+		t.Fatalf("expect 2 idents, got %v", e.Idents())
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package exprs
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+// keyword 关键字不区分大小写
+func (t token) keyword(kw string) bool {
+	return t.typ == tokenIdent && strings.EqualFold(t.val, kw)
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{typ: tokenLParen, val: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{typ: tokenRParen, val: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{typ: tokenComma, val: ",", pos: i})
+			i++
+		case c == '\'' || c == '"':
+			val, n, err := scanString(src[i:])
+			if err != nil {
+				return nil, errors.Annotatef(err, "position %d", i)
+			}
+			tokens = append(tokens, token{typ: tokenString, val: val, pos: i})
+			i += n
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokenNumber, val: src[start:i], pos: start})
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && (isIdentStart(src[i]) || isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokenIdent, val: src[start:i], pos: start})
+		case c == '`':
+			end := strings.IndexByte(src[i+1:], '`')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated identifier at position %d", i)
+			}
+			tokens = append(tokens, token{typ: tokenIdent, val: src[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			op := scanOperator(src[i:])
+			if op == "" {
+				return nil, errors.Errorf("unexpected character '%c' at position %d", c, i)
+			}
+			tokens = append(tokens, token{typ: tokenOperator, val: op, pos: i})
+			i += len(op)
+		}
+	}
+	tokens = append(tokens, token{typ: tokenEOF, pos: len(src)})
+	return tokens, nil
+}
+
+// scanString 单引号或双引号字符串，支持反斜杠转义和连续两个引号
+func scanString(src string) (string, int, error) {
+	quote := src[0]
+	var sb strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '\\' && i+1 < len(src):
+			i++
+			sb.WriteByte(src[i])
+		case c == quote:
+			if i+1 < len(src) && src[i+1] == quote {
+				sb.WriteByte(quote)
+				i++
+				continue
+			}
+			return sb.String(), i + 1, nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+var _operators = []string{"<=", ">=", "<>", "!=", "==", "&&", "||", "=", "<", ">", "!", "-"}
+
+func scanOperator(src string) string {
+	for _, op := range _operators {
+		if strings.HasPrefix(src, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package kafkas
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+)
+
+const (
+	SASLMechanismPlain       = "PLAIN"
+	SASLMechanismScramSHA256 = "SCRAM-SHA-256"
+	SASLMechanismScramSHA512 = "SCRAM-SHA-512"
+	SASLMechanismOAuthBearer = "OAUTHBEARER"
+)
+
+// Security kafka连接的TLS和SASL认证配置
+type Security struct {
+	TLSEnable             bool
+	TLSCaFile             string // CA证书，为空时使用系统的CA
+	TLSCertFile           string // 客户端证书，与TLSKeyFile同时配置
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+
+	SASLMechanism string // 为空时，配置了用户名和密码则使用PLAIN
+	SASLUser      string // OAUTHBEARER时为client id
+	SASLPassword  string // OAUTHBEARER时为client secret
+	OAuthTokenUrl string // OAUTHBEARER时获取token的地址
+	OAuthScopes   string // 多个用逗号分隔
+}
+
+// Apply 将TLS和SASL配置写入sarama配置
+func Apply(cfg *sarama.Config, sec *Security) error {
+	if sec.TLSEnable {
+		tlsCfg, err := NewTLSConfig(sec)
+		if err != nil {
+			return err
+		}
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsCfg
+	}
+
+	mechanism := strings.ToUpper(sec.SASLMechanism)
+	if mechanism == "" {
+		if sec.SASLUser == "" || sec.SASLPassword == "" {
+			return nil
+		}
+		mechanism = SASLMechanismPlain
+	}
+
+	cfg.Net.SASL.Enable = true
+	cfg.Net.SASL.User = sec.SASLUser
+	cfg.Net.SASL.Password = sec.SASLPassword
+	switch mechanism {
+	case SASLMechanismPlain:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLMechanismScramSHA256:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: _sha256}
+		}
+	case SASLMechanismScramSHA512:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: _sha512}
+		}
+	case SASLMechanismOAuthBearer:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeOAuth
+		cfg.Net.SASL.TokenProvider = newTokenProvider(sec.OAuthTokenUrl, sec.SASLUser, sec.SASLPassword, sec.OAuthScopes)
+	default:
+		return errors.Errorf("unsupported kafka sasl mechanism: %s", sec.SASLMechanism)
+	}
+	return nil
+}
+
+// NewTLSConfig 加载CA证书和客户端证书
+func NewTLSConfig(sec *Security) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: sec.TLSInsecureSkipVerify,
+	}
+
+	if sec.TLSCaFile != "" {
+		data, err := ioutil.ReadFile(sec.TLSCaFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificate found in %s", sec.TLSCaFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if sec.TLSCertFile != "" || sec.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(sec.TLSCertFile, sec.TLSKeyFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
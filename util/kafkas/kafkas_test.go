@@ -0,0 +1,263 @@
+package kafkas
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		tmpl.DNSNames = []string{"localhost"}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// brokerReporter 握手失败是预期的结果，只记录日志
+type brokerReporter struct {
+	t *testing.T
+}
+
+func (r brokerReporter) Error(args ...interface{})                 { r.t.Log(args...) }
+func (r brokerReporter) Errorf(format string, args ...interface{}) { r.t.Logf(format, args...) }
+func (r brokerReporter) Fatal(args ...interface{})                 { r.t.Fatal(args...) }
+func (r brokerReporter) Fatalf(format string, args ...interface{}) { r.t.Fatalf(format, args...) }
+
+// newTLSBroker 本地的TLS kafka替身，要求客户端证书
+func newTLSBroker(t *testing.T, ca, server *testCert) *sarama.MockBroker {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.der}, PrivateKey: server.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := sarama.NewMockBrokerListener(brokerReporter{t}, 1, listener)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("t_user", 0, broker.BrokerID()),
+	})
+	return broker
+}
+
+func TestApplyTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "transfer-ca", nil, 0)
+	server := newTestCert(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "transfer", ca, x509.ExtKeyUsageClientAuth)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := client.write(t, dir, "client")
+
+	broker := newTLSBroker(t, ca, server)
+	defer broker.Close()
+
+	connect := func(sec *Security) error {
+		cfg := sarama.NewConfig()
+		cfg.Net.DialTimeout = 3 * time.Second
+		cfg.Metadata.Retry.Max = 0
+		if err := Apply(cfg, sec); err != nil {
+			return err
+		}
+		c, err := sarama.NewClient([]string{broker.Addr()}, cfg)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		_, err = c.Partitions("t_user")
+		return err
+	}
+
+	if err := connect(&Security{TLSEnable: true, TLSCaFile: caFile, TLSCertFile: certFile, TLSKeyFile: keyFile}); err != nil {
+		t.Fatalf("expect tls connected, got %v", err)
+	}
+	// 没有客户端证书时服务端拒绝握手
+	if err := connect(&Security{TLSEnable: true, TLSCaFile: caFile}); err == nil {
+		t.Fatalf("expect rejected without client certificate")
+	}
+	// 不信任自签名的CA
+	if err := connect(&Security{TLSEnable: true, TLSCertFile: certFile, TLSKeyFile: keyFile}); err == nil {
+		t.Fatalf("expect unknown authority")
+	}
+	if _, err := NewTLSConfig(&Security{TLSCaFile: keyFile}); err == nil {
+		t.Fatalf("expect no certificate found")
+	}
+}
+
+func TestApplySASL(t *testing.T) {
+	cfg := sarama.NewConfig()
+	if err := Apply(cfg, &Security{}); err != nil || cfg.Net.SASL.Enable {
+		t.Fatalf("expect sasl disabled, got %v", err)
+	}
+
+	cfg = sarama.NewConfig()
+	Apply(cfg, &Security{SASLUser: "admin", SASLPassword: "secret"})
+	if !cfg.Net.SASL.Enable || cfg.Net.SASL.Mechanism != sarama.SASLTypePlaintext {
+		t.Fatalf("expect PLAIN, got %s", cfg.Net.SASL.Mechanism)
+	}
+
+	cfg = sarama.NewConfig()
+	Apply(cfg, &Security{SASLMechanism: "scram-sha-512", SASLUser: "admin", SASLPassword: "secret"})
+	if cfg.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA512 || cfg.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Fatalf("expect SCRAM-SHA-512, got %s", cfg.Net.SASL.Mechanism)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Apply(sarama.NewConfig(), &Security{SASLMechanism: "GSSAPI"}); err == nil {
+		t.Fatalf("expect unsupported mechanism")
+	}
+}
+
+func TestScramClient(t *testing.T) {
+	for _, hash := range []scram.HashGeneratorFcn{_sha256, _sha512} {
+		stored, err := hash.NewClient("admin", "secret", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		credentials := stored.GetStoredCredentials(scram.KeyFactors{Salt: "transfer", Iters: 4096})
+		server, err := hash.NewServer(func(user string) (scram.StoredCredentials, error) {
+			return credentials, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, password := range []string{"secret", "wrong"} {
+			client := &scramClient{hash: hash}
+			if err := client.Begin("admin", password, ""); err != nil {
+				t.Fatal(err)
+			}
+			conversation := server.NewConversation()
+			var challenge string
+			var authErr error
+			for !client.Done() {
+				var response string
+				if response, authErr = client.Step(challenge); authErr != nil || client.Done() {
+					break
+				}
+				if challenge, authErr = conversation.Step(response); authErr != nil {
+					break
+				}
+			}
+			if ok := authErr == nil && conversation.Valid(); ok != (password == "secret") {
+				t.Fatalf("password %s: unexpected result %v", password, authErr)
+			}
+		}
+	}
+}
+
+func TestTokenProvider(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		user, pass, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "client_credentials" || user != "transfer" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("scope") != "kafka.read kafka.write" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"token-1","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	cfg := sarama.NewConfig()
+	if err := Apply(cfg, &Security{
+		SASLMechanism: SASLMechanismOAuthBearer,
+		SASLUser:      "transfer",
+		SASLPassword:  "secret",
+		OAuthTokenUrl: server.URL,
+		OAuthScopes:   "kafka.read,kafka.write",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Net.SASL.Mechanism != sarama.SASLTypeOAuth {
+		t.Fatalf("expect OAUTHBEARER, got %s", cfg.Net.SASL.Mechanism)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := cfg.Net.SASL.TokenProvider.Token()
+		if err != nil || token.Token != "token-1" {
+			t.Fatalf("expect token-1, got %v %v", token, err)
+		}
+	}
+	// token未过期时不重复请求
+	if requests != 1 {
+		t.Fatalf("expect 1 request, got %d", requests)
+	}
+
+	_, err := newTokenProvider(server.URL, "transfer", "wrong", "").Token()
+	if err == nil {
+		t.Fatalf("expect unauthorized error")
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package kafkas
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/juju/errors"
+)
+
+const (
+	_tokenTimeout = 10 * time.Second
+	_tokenExpiry  = 30 * time.Second // 提前刷新token
+)
+
+// tokenProvider 使用OAuth2 client credentials模式获取OAUTHBEARER的token，过期之前重复使用
+type tokenProvider struct {
+	url          string
+	clientId     string
+	clientSecret string
+	scopes       string
+	inner        *http.Client
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type tokenRespond struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func newTokenProvider(addr, clientId, clientSecret, scopes string) *tokenProvider {
+	return &tokenProvider{
+		url:          addr,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		inner:        &http.Client{Timeout: _tokenTimeout},
+	}
+}
+
+func (p *tokenProvider) Token() (*sarama.AccessToken, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.token != "" && time.Now().Before(p.expires) {
+		return &sarama.AccessToken{Token: p.token}, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if p.scopes != "" {
+		form.Set("scope", strings.Join(strings.Split(p.scopes, ","), " "))
+	}
+	request, err := http.NewRequest(http.MethodPost, p.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+
+	response, err := p.inner.Do(request)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("fetch oauth token err status %d: %s", response.StatusCode, data)
+	}
+
+	var resp tokenRespond
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.AccessToken == "" {
+		return nil, errors.Errorf("fetch oauth token err: empty access_token")
+	}
+
+	p.token = resp.AccessToken
+	p.expires = time.Now().Add(time.Duration(resp.ExpiresIn)*time.Second - _tokenExpiry)
+	return &sarama.AccessToken{Token: p.token}, nil
+}
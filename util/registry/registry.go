@@ -0,0 +1,144 @@
+/*
+ * Copyright 2020-2021 the original author(https://github.com/wj596)
+ *
+ * <p>
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ * </p>
+ */
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	SchemaTypeAvro     = "AVRO"
+	SchemaTypeProtobuf = "PROTOBUF"
+
+	MagicByte = byte(0) // Confluent消息格式的魔数
+
+	_contentType = "application/vnd.schemaregistry.v1+json"
+	_timeout     = 10 * time.Second
+)
+
+// Client Confluent Schema Registry的客户端，只实现了注册schema
+type Client struct {
+	url      string
+	username string
+	password string
+	inner    *http.Client
+
+	lock sync.RWMutex
+	ids  map[string]int // subject + schema -> id
+}
+
+type registerRequest struct {
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"` // AVRO时为空，兼容旧版本的registry
+}
+
+type registerRespond struct {
+	Id int `json:"id"`
+}
+
+type errorRespond struct {
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func NewClient(addr, username, password string) *Client {
+	return &Client{
+		url:      strings.TrimRight(addr, "/"),
+		username: username,
+		password: password,
+		inner:    &http.Client{Timeout: _timeout},
+		ids:      make(map[string]int),
+	}
+}
+
+// Register 在subject下注册schema并返回schema id；schema已经存在时registry返回原来的id
+func (c *Client) Register(subject, schemaType, schema string) (int, error) {
+	key := subject + "\x00" + schema
+	c.lock.RLock()
+	id, ok := c.ids[key]
+	c.lock.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	req := registerRequest{Schema: schema}
+	if schemaType != SchemaTypeAvro {
+		req.SchemaType = schemaType
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, c.url+"/subjects/"+url.PathEscape(subject)+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	request.Header.Set("Content-Type", _contentType)
+	request.Header.Set("Accept", _contentType)
+	if c.username != "" {
+		request.SetBasicAuth(c.username, c.password)
+	}
+
+	response, err := c.inner.Do(request)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if response.StatusCode != http.StatusOK {
+		var e errorRespond
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return 0, errors.Errorf("register schema subject %s err %d: %s", subject, e.ErrorCode, e.Message)
+		}
+		return 0, errors.Errorf("register schema subject %s err status %d", subject, response.StatusCode)
+	}
+
+	var resp registerRespond
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	c.lock.Lock()
+	c.ids[key] = resp.Id
+	c.lock.Unlock()
+	return resp.Id, nil
+}
+
+// Frame 按照Confluent的格式在消息体前加上魔数和schema id
+// protobuf的消息还需要在schema id之后加上消息的索引，由调用方写入payload
+func Frame(id int, payload []byte) []byte {
+	data := make([]byte, 5, 5+len(payload))
+	data[0] = MagicByte
+	binary.BigEndian.PutUint32(data[1:], uint32(id))
+	return append(data, payload...)
+}
@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry 本地的schema registry替身，相同的schema返回相同的id
+type fakeRegistry struct {
+	lock     sync.Mutex
+	ids      map[string]int
+	requests int
+	reject   string // 该subject返回409，模拟不兼容的schema
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests++
+
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != _contentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/subjects/") || !strings.HasSuffix(r.URL.Path, "/versions") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+	if subject == f.reject {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(`{"error_code":409,"message":"Schema being registered is incompatible with an earlier schema"}`))
+		return
+	}
+
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	key := req.SchemaType + req.Schema
+	id, ok := f.ids[key]
+	if !ok {
+		id = len(f.ids) + 1
+		f.ids[key] = id
+	}
+	w.Header().Set("Content-Type", _contentType)
+	w.Write([]byte(`{"id":` + strconv.Itoa(id) + `}`))
+}
+
+func TestRegister(t *testing.T) {
+	fake := &fakeRegistry{ids: make(map[string]int), reject: "t_order-value"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", "admin", "secret")
+	id, err := client.Register("t_user-value", SchemaTypeAvro, `{"type":"string"}`)
+	if err != nil || id != 1 {
+		t.Fatalf("expect id 1, got %d %v", id, err)
+	}
+
+	// 相同的schema使用缓存，不再请求registry
+	id, err = client.Register("t_user-value", SchemaTypeAvro, `{"type":"string"}`)
+	if err != nil || id != 1 || fake.requests != 1 {
+		t.Fatalf("expect cached id 1, got %d %v, requests %d", id, err, fake.requests)
+	}
+
+	id, err = client.Register("t_user-value", SchemaTypeProtobuf, `syntax = "proto3";`)
+	if err != nil || id != 2 {
+		t.Fatalf("expect id 2, got %d %v", id, err)
+	}
+
+	_, err = client.Register("t_order-value", SchemaTypeAvro, `{"type":"long"}`)
+	if err == nil || !strings.Contains(err.Error(), "incompatible") {
+		t.Fatalf("expect incompatible error, got %v", err)
+	}
+
+	_, err = NewClient(server.URL, "admin", "wrong").Register("t_user-value", SchemaTypeAvro, `{"type":"int"}`)
+	if err == nil {
+		t.Fatalf("expect unauthorized error")
+	}
+}
+
+func TestFrame(t *testing.T) {
+	data := Frame(258, []byte{0x0a})
+	expect := []byte{MagicByte, 0, 0, 1, 2, 0x0a}
+	if string(data) != string(expect) {
+		t.Fatalf("expect %v, got %v", expect, data)
+	}
+}
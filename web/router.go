@@ -15,6 +15,7 @@ import (
 
 	"go-mysql-transfer/global"
 	"go-mysql-transfer/metrics"
+	"go-mysql-transfer/model"
 	"go-mysql-transfer/util/logs"
 )
 
@@ -35,6 +36,9 @@ func Start() error {
 	g.Static("/statics", statics)
 	g.LoadHTMLFiles(index)
 	g.GET("/", webAdminFunc)
+	g.GET("/pipelines", pipelinesFunc)
+	g.POST("/pipelines/:name/start", pipelineStartFunc)
+	g.POST("/pipelines/:name/stop", pipelineStopFunc)
 
 	port := global.Cfg().WebAdminPort
 	listen := fmt.Sprintf(":%s", strconv.Itoa(port))
@@ -90,7 +94,7 @@ func webAdminFunc(c *gin.Context) {
 		"binPos":        pos.Pos,
 		"destName":      global.Cfg().DestStdName(),
 		"destAddr":      global.Cfg().DestAddr(),
-		"destState":     metrics.DestState(),
+		"destState":     metrics.DestState(service.TransferServiceIns().Name()),
 		"bootTime":      dates.Layout(global.BootTime(), dates.DayTimeMinuteFormatter),
 		"insertAmount":  metrics.InsertAmount(),
 		"updateAmount":  metrics.UpdateAmount(),
@@ -125,6 +129,46 @@ func webAdminFunc(c *gin.Context) {
 	c.HTML(200, "index.html", h)
 }
 
+func pipelinesFunc(c *gin.Context) {
+	var list []gin.H
+	for _, s := range service.TransferServiceList() {
+		info := s.Info()
+		pos, _ := s.Position()
+		rows, bytes := s.QueueDepth()
+		cfg, _ := global.PipelineCfg(info.Name)
+		list = append(list, gin.H{
+			"name":       info.Name,
+			"status":     info.Status,
+			"mysql":      cfg.Addr,
+			"destName":   cfg.DestStdName(),
+			"destAddr":   cfg.DestAddr(),
+			"binName":    pos.Name,
+			"binPos":     pos.Pos,
+			"destState":  metrics.DestState(info.Name),
+			"targets":    s.TargetHealth(),
+			"queueRows":  rows,
+			"queueBytes": bytes,
+		})
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func pipelineStartFunc(c *gin.Context) {
+	if err := service.EnablePipeline(c.Param("name")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": model.PipelineInfoNormal})
+}
+
+func pipelineStopFunc(c *gin.Context) {
+	if err := service.DisablePipeline(c.Param("name")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": model.PipelineInfoDisable})
+}
+
 func Close() {
 	if _server == nil {
 		return